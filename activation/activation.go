@@ -0,0 +1,95 @@
+// Package activation takes the listeners systemd passes to a socket
+// activated service, so that the sockets, their permissions and the
+// connections waiting on them outlive restarts of the plugin.
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor systemd passes, SD_LISTEN_FDS_START.
+const listenFdsStart = 3
+
+// Names the socket units give the listeners with FileDescriptorName=.
+const (
+	KMS  = "kms"
+	HTTP = "http"
+	TCP  = "tcp"
+)
+
+// Listeners returns the listeners passed to this process by name, nil when
+// the process was not socket activated or handed the listeners by Handoff. A
+// single listener that is not named is taken to be the KMS socket. The
+// LISTEN_* variables are unset so that they are not passed on to child
+// processes.
+func Listeners() (listeners map[string]net.Listener, err error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(handoffParent)
+	}()
+	names, err := parse(os.Getenv, os.Getpid(), os.Getppid())
+	if err != nil || names == nil {
+		return nil, err
+	}
+
+	listeners = map[string]net.Listener{}
+	for i, name := range names {
+		// net.FileListener duplicates the descriptor, close-on-exec, so the
+		// inherited one is closed either way.
+		file := os.NewFile(uintptr(listenFdsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, fmt.Errorf("socket activation file descriptor %d %q: %w", listenFdsStart+i, name, err)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// parse returns the names of the descriptors passed from LISTEN_FDS onward,
+// nil when they were passed to another process.
+func parse(getenv func(string) string, pid, ppid int) ([]string, error) {
+	fds := getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	// systemd sets LISTEN_PID to ours after it forks. Handoff can not know
+	// our process ID before it starts us, so it names itself instead.
+	listenPid := getenv("LISTEN_PID")
+	if listenPid != strconv.Itoa(pid) && (listenPid != "" || getenv(handoffParent) != strconv.Itoa(ppid)) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS %q is not a positive number", fds)
+	}
+	var split []string
+	if fdNames := getenv("LISTEN_FDNAMES"); fdNames != "" {
+		split = strings.Split(fdNames, ":")
+	}
+	names := make([]string, count)
+	seen := map[string]bool{}
+	for i := range names {
+		if i < len(split) {
+			names[i] = split[i]
+		}
+		if count == 1 && names[i] != HTTP && names[i] != TCP {
+			names[i] = KMS
+		}
+		if seen[names[i]] {
+			return nil, fmt.Errorf("socket activation file descriptor %d %q: passed twice", listenFdsStart+i, names[i])
+		}
+		seen[names[i]] = true
+	}
+	return names, nil
+}
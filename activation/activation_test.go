@@ -0,0 +1,82 @@
+package activation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	const pid, ppid = 100, 99
+	tests := []struct {
+		name  string
+		env   map[string]string
+		names []string
+		err   string
+	}{{
+		name: "not activated",
+		env:  map[string]string{},
+	}, {
+		name:  "systemd",
+		env:   map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "3", "LISTEN_FDNAMES": "kms:http:tcp"},
+		names: []string{KMS, HTTP, TCP},
+	}, {
+		name: "another process",
+		env:  map[string]string{"LISTEN_PID": "101", "LISTEN_FDS": "1"},
+	}, {
+		name:  "handoff",
+		env:   map[string]string{"LISTEN_FDS": "2", "LISTEN_FDNAMES": "http:kms", handoffParent: "99"},
+		names: []string{HTTP, KMS},
+	}, {
+		name: "handoff to another process",
+		env:  map[string]string{"LISTEN_FDS": "1", handoffParent: "98"},
+	}, {
+		name: "handoff names a parent but systemd a process",
+		env:  map[string]string{"LISTEN_PID": "101", "LISTEN_FDS": "1", handoffParent: "99"},
+	}, {
+		name:  "single unnamed",
+		env:   map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "1"},
+		names: []string{KMS},
+	}, {
+		name:  "single named by systemd",
+		env:   map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "tang-kms.socket"},
+		names: []string{KMS},
+	}, {
+		name:  "single health port",
+		env:   map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "http"},
+		names: []string{HTTP},
+	}, {
+		name:  "fewer names",
+		env:   map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "kms"},
+		names: []string{KMS, ""},
+	}, {
+		name: "not a number",
+		env:  map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "two"},
+		err:  `LISTEN_FDS "two" is not a positive number`,
+	}, {
+		name: "zero",
+		env:  map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "0"},
+		err:  `LISTEN_FDS "0" is not a positive number`,
+	}, {
+		name: "passed twice",
+		env:  map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "kms:kms"},
+		err:  `file descriptor 4 "kms": passed twice`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names, err := parse(func(key string) string { return test.env[key] }, pid, ppid)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, test.names) {
+				t.Fatalf("got %q, want %q", names, test.names)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package activation
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	handoffParent = "TANG_KMS_HANDOFF_PARENT"
+	handoffReady  = "TANG_KMS_HANDOFF_READY_FD"
+)
+
+// Handoff starts a new copy of this executable, with the same arguments and
+// environment, passes it the listeners by name as socket activation would
+// and waits until it reports with Ready that it is serving. It then tells
+// systemd that the new process is the main process of the service, so that
+// our exit does not stop the service. If the new process is not ready within
+// the timeout, or systemd is not told, it is killed and the error returned,
+// the caller keeps serving. Without NOTIFY_SOCKET nothing is started and
+// ErrNoSupervisor returned.
+func Handoff(listeners map[string]*os.File, timeout time.Duration) (process *os.Process, err error) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return nil, ErrNoSupervisor
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	var names []string
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	command := exec.Command(executable, os.Args[1:]...)
+	command.Stdout, command.Stderr = os.Stdout, os.Stderr
+	for _, name := range names {
+		command.ExtraFiles = append(command.ExtraFiles, listeners[name])
+	}
+	command.ExtraFiles = append(command.ExtraFiles, readyWriter)
+	command.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		handoffParent+"="+strconv.Itoa(os.Getpid()),
+		handoffReady+"="+strconv.Itoa(listenFdsStart+len(names)),
+	)
+	err = command.Start()
+	readyWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// The pipe reads end of file without a byte if the new process exits,
+	// or closes it without reporting ready.
+	reported := make(chan error, 1)
+	go func() {
+		buffer, err := ioutil.ReadAll(ready)
+		if err == nil && len(buffer) == 0 {
+			err = errors.New("exited before it was ready")
+		}
+		reported <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-reported:
+	case <-timer.C:
+		err = fmt.Errorf("not ready after %v", timeout)
+	}
+	if err == nil {
+		err = Notify(fmt.Sprintf("MAINPID=%d", command.Process.Pid))
+	}
+	if err != nil {
+		command.Process.Kill()
+		command.Wait()
+		return nil, fmt.Errorf("handoff to process %d: %w", command.Process.Pid, err)
+	}
+	// The new process outlives us, nobody waits for it but its new parent.
+	go command.Wait()
+	return command.Process, nil
+}
+
+// Ready tells the process that started this one with Handoff, and systemd
+// when NOTIFY_SOCKET is set, that this one is serving.
+func Ready() error {
+	value := os.Getenv(handoffReady)
+	os.Unsetenv(handoffReady)
+	if value == "" {
+		return Notify("READY=1")
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a file descriptor", handoffReady, value)
+	}
+	pipe := os.NewFile(uintptr(fd), "handoff")
+	defer pipe.Close()
+	if _, err = pipe.Write([]byte{1}); err != nil {
+		return err
+	}
+	return Notify("READY=1")
+}
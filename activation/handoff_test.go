@@ -0,0 +1,204 @@
+package activation
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What the copy of the test binary Handoff starts does, set before the handoff
+// and inherited.
+const replacement = "TANG_KMS_TEST_REPLACEMENT"
+
+// The replacement takes the listeners, reports ready and answers one
+// connection on the KMS socket with the names it was passed.
+func replace() int {
+	switch os.Getenv(replacement) {
+	case "exit":
+		return 0
+	case "hang":
+		time.Sleep(time.Minute)
+		return 0
+	}
+	listeners, err := Listeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var names []string
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	conn, err := listeners[KMS].Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+	conn.Write([]byte(strings.Join(names, ":")))
+	return 0
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(handoffParent) != "" {
+		os.Exit(replace())
+	}
+	os.Exit(m.Run())
+}
+
+// A service manager listening on a datagram socket in dir, returning the
+// states it was sent.
+func notifySocket(t *testing.T, dir string) func() []string {
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return func() (states []string) {
+		buffer := make([]byte, 256)
+		for {
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			read, err := conn.Read(buffer)
+			if err != nil {
+				sort.Strings(states)
+				return states
+			}
+			states = append(states, string(buffer[:read]))
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Fatalf("expected nothing without a NOTIFY_SOCKET, got %v", err)
+	}
+	received := notifySocket(t, t.TempDir())
+	if err := Notify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if states := received(); len(states) != 1 || states[0] != "READY=1" {
+		t.Fatalf("got %q", states)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		notify  string
+		timeout time.Duration
+		err     string
+	}{{
+		name:   "ready",
+		mode:   "ready",
+		notify: "listening",
+	}, {
+		name: "no supervisor",
+		mode: "ready",
+		err:  "NOTIFY_SOCKET is not set",
+	}, {
+		name:   "supervisor gone",
+		mode:   "ready",
+		notify: "missing",
+		err:    "no such file or directory",
+	}, {
+		name:   "exits",
+		mode:   "exit",
+		notify: "listening",
+		err:    "exited before it was ready",
+	}, {
+		name:    "hangs",
+		mode:    "hang",
+		notify:  "listening",
+		timeout: 200 * time.Millisecond,
+		err:     "not ready after 200ms",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv(replacement, test.mode)
+			t.Setenv("NOTIFY_SOCKET", "")
+			var received func() []string
+			switch test.notify {
+			case "listening":
+				received = notifySocket(t, dir)
+			case "missing":
+				t.Setenv("NOTIFY_SOCKET", filepath.Join(dir, "missing"))
+			}
+			kms, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "kms.sock"), Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer kms.Close()
+			http, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer http.Close()
+			files := map[string]*os.File{}
+			for name, listener := range map[string]interface{ File() (*os.File, error) }{KMS: kms, HTTP: http} {
+				file, err := listener.File()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				files[name] = file
+			}
+			timeout := test.timeout
+			if timeout == 0 {
+				timeout = 10 * time.Second
+			}
+
+			process, err := Handoff(files, timeout)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				if test.notify == "" && !errors.Is(err, ErrNoSupervisor) {
+					t.Fatalf("expected ErrNoSupervisor, got %v", err)
+				}
+				if received != nil {
+					if states := received(); len(states) != 0 {
+						t.Fatalf("systemd was told %q", states)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.Dial("unix", kms.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			answer, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(answer) != "http:kms" {
+				t.Fatalf("the replacement was passed %q", answer)
+			}
+			want := []string{fmt.Sprintf("MAINPID=%d", process.Pid), "READY=1"}
+			if states := received(); strings.Join(states, ",") != strings.Join(want, ",") {
+				t.Fatalf("systemd was told %q, want %q", states, want)
+			}
+		})
+	}
+}
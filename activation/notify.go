@@ -0,0 +1,28 @@
+package activation
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ErrNoSupervisor is returned by Handoff when no service manager is told
+// about the new process, it would be seen as the service exiting.
+var ErrNoSupervisor = errors.New("NOTIFY_SOCKET is not set, a handoff needs a systemd service with Type=notify and NotifyAccess=all, restart the service instead")
+
+// Notify sends state to the service manager as sd_notify does, as in
+// READY=1. It does nothing when NOTIFY_SOCKET is not set.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// Go names an abstract socket with a leading @, as systemd does.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
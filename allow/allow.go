@@ -0,0 +1,82 @@
+// Package allow restricts the Tang servers the plugin talks to, so that a
+// ciphertext naming some other server can not make the plugin send requests
+// to it.
+package allow
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrNotAllowed is returned for a request to a URL outside the allowlist.
+var ErrNotAllowed = errors.New("allow: Tang server not in the allowlist")
+
+// List is a list of Tang server URLs. A URL is allowed if it is one of them or
+// below one of them.
+type List []string
+
+// The scheme and host compare without case, the path after it is cleaned and
+// without a trailing slash.
+func parse(location string) (*url.URL, bool) {
+	parsed, err := url.Parse(location)
+	if err != nil || parsed.Host == "" {
+		return nil, false
+	}
+	cleaned := path.Clean("/" + parsed.Path)
+	return &url.URL{
+		Scheme: strings.ToLower(parsed.Scheme),
+		Host:   strings.ToLower(parsed.Host),
+		Path:   strings.TrimSuffix(cleaned, "/"),
+	}, true
+}
+
+// Allows reports whether location is one of the servers or below one of them.
+func (l List) Allows(location string) bool {
+	sought, ok := parse(location)
+	if !ok {
+		return false
+	}
+	for _, entry := range l {
+		allowed, ok := parse(entry)
+		if !ok || allowed.Scheme != sought.Scheme || allowed.Host != sought.Host {
+			continue
+		}
+		if sought.Path == allowed.Path || strings.HasPrefix(sought.Path, allowed.Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type transport struct {
+	base http.RoundTripper
+	list List
+}
+
+// NewTransport wraps base, which defaults to http.DefaultTransport, so that it
+// refuses requests outside the list. It returns base itself when the list is
+// empty.
+func NewTransport(base http.RoundTripper, list List) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if len(list) == 0 {
+		return base
+	}
+	return &transport{base: base, list: list}
+}
+
+func (t *transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	location := url.URL{Scheme: request.URL.Scheme, Host: request.URL.Host, Path: request.URL.Path}
+	if !t.list.Allows(location.String()) {
+		if request.Body != nil {
+			request.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotAllowed, location.String())
+	}
+	return t.base.RoundTrip(request)
+}
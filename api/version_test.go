@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flatheadmill/tang-encryption-provider/buildinfo"
+)
+
+func TestVersion(t *testing.T) {
+	info := buildinfo.Info{
+		Path:      "github.com/flatheadmill/tang-encryption-provider",
+		Version:   "v1.2.3",
+		Revision:  "8fc6f3d63a40",
+		GoVersion: "go1.18",
+	}
+	recorder := httptest.NewRecorder()
+	Version(info).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got content type %q", contentType)
+	}
+	var served map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"path":       info.Path,
+		"version":    info.Version,
+		"revision":   info.Revision,
+		"go_version": info.GoVersion,
+	}
+	if len(served) != len(want) {
+		t.Errorf("got %v, want %v", served, want)
+	}
+	for name, value := range want {
+		if served[name] != value {
+			t.Errorf("got %s %v, want %v", name, served[name], value)
+		}
+	}
+}
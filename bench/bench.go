@@ -0,0 +1,191 @@
+// Package bench measures encrypt and decrypt throughput and latency through
+// the KMS gRPC socket and directly against a crypter.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"google.golang.org/grpc"
+
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/plugin"
+)
+
+const (
+	Encrypt = "encrypt"
+	Decrypt = "decrypt"
+)
+
+// Counter reports the number of requests a Tang server has served, nil when
+// the Tang server is not ours to count.
+type Counter func() int64
+
+// Result is one run of one operation with one payload size and concurrency.
+type Result struct {
+	Backend     string        `json:"backend"`
+	Mode        string        `json:"mode"`
+	Operation   string        `json:"operation"`
+	Size        int           `json:"size"`
+	Concurrency int           `json:"concurrency"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"`
+	Elapsed     time.Duration `json:"elapsed"`
+	P50         time.Duration `json:"p50"`
+	P99         time.Duration `json:"p99"`
+	// AllocsPerOp counts every allocation in the process, when the server is
+	// in process that is the client and the server both.
+	AllocsPerOp float64 `json:"allocs_per_op"`
+	// TangPerOp is -1 when the Tang server is not counted.
+	TangPerOp float64 `json:"tang_per_op"`
+}
+
+func (r Result) Throughput() float64 {
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// Dial connects to a KMS plugin listening on a unix domain socket.
+func Dial(socket string) (*grpc.ClientConn, error) {
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", addr)
+	}
+	return grpc.Dial(socket, grpc.WithContextDialer(dialer), grpc.WithInsecure())
+}
+
+// Payload returns a random plain text of the given size.
+func Payload(size int) []byte {
+	return []byte(crypter.RandomHex(size))
+}
+
+// Run calls op requests times from concurrency goroutines and measures each
+// call.
+func Run(concurrency int, requests int, tang Counter, op func() error) Result {
+	latencies := make([]time.Duration, requests)
+	failures := make([]int, concurrency)
+
+	var before, after runtime.MemStats
+	var tangBefore int64
+	if tang != nil {
+		tangBefore = tang()
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for i := worker; i < requests; i += concurrency {
+				began := time.Now()
+				if err := op(); err != nil {
+					failures[worker]++
+				}
+				latencies[i] = time.Since(began)
+			}
+		}(worker)
+	}
+	wait.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	result := Result{
+		Concurrency: concurrency,
+		Requests:    requests,
+		Elapsed:     elapsed,
+		AllocsPerOp: float64(after.Mallocs-before.Mallocs) / float64(requests),
+		TangPerOp:   -1,
+	}
+	for _, failed := range failures {
+		result.Errors += failed
+	}
+	if tang != nil {
+		result.TangPerOp = float64(tang()-tangBefore) / float64(requests)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.P50 = percentile(latencies, 0.50)
+	result.P99 = percentile(latencies, 0.99)
+	return result
+}
+
+// Socket measures encrypt or decrypt through the KMS plugin's gRPC socket.
+func Socket(conn *grpc.ClientConn, operation string, size int, concurrency int, requests int, tang Counter) (result Result, err error) {
+	defer err2.Return(&err)
+
+	client := plugin.NewKeyManagementServiceClient(conn)
+	ctx := context.Background()
+	plain := Payload(size)
+
+	var op func() error
+	switch operation {
+	case Encrypt:
+		op = func() error {
+			_, err := client.Encrypt(ctx, &plugin.EncryptRequest{Version: "v1beta1", Plain: plain})
+			return err
+		}
+	case Decrypt:
+		cipher := try.To1(client.Encrypt(ctx, &plugin.EncryptRequest{Version: "v1beta1", Plain: plain})).Cipher
+		op = func() error {
+			_, err := client.Decrypt(ctx, &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+			return err
+		}
+	default:
+		return Result{}, fmt.Errorf("unknown operation %q", operation)
+	}
+
+	result = Run(concurrency, requests, tang, op)
+	result.Mode, result.Operation, result.Size = "grpc", operation, size
+	return result, nil
+}
+
+// Crypter is the part of a backend that is benchmarked directly.
+type Crypter interface {
+	Encrypt(ctx context.Context, plain []byte) ([]byte, error)
+	Decrypt(ctx context.Context, cipher []byte) ([]byte, error)
+}
+
+// Direct measures encrypt or decrypt called directly on a crypter, one call
+// at a time. The Go benchmarks in crypter and go-jose count allocations
+// exactly, here they include whatever else the process is doing.
+func Direct(crypt Crypter, operation string, size int, requests int, tang Counter) (result Result, err error) {
+	defer err2.Return(&err)
+
+	plain := Payload(size)
+	var op func() error
+	switch operation {
+	case Encrypt:
+		op = func() error {
+			_, err := crypt.Encrypt(context.Background(), plain)
+			return err
+		}
+	case Decrypt:
+		cipher := try.To1(crypt.Encrypt(context.Background(), plain))
+		op = func() error {
+			_, err := crypt.Decrypt(context.Background(), cipher)
+			return err
+		}
+	default:
+		return Result{}, fmt.Errorf("unknown operation %q", operation)
+	}
+
+	result = Run(1, requests, tang, op)
+	result.Mode, result.Operation, result.Size = "direct", operation, size
+	return result, nil
+}
@@ -0,0 +1,64 @@
+// Package buildinfo reports the module version and VCS revision the binary
+// was built from, as recorded by the Go toolchain.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Info is the build information of the running binary. Fields the toolchain
+// did not record, such as the revision of a binary built outside of a
+// checkout, are empty.
+type Info struct {
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Read returns the build information of the running binary.
+func Read() Info {
+	info := Info{Version: "(devel)", GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Path = build.Main.Path
+	if build.Main.Version != "" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// RuntimeVersion is the version reported to the apiserver. Newer toolchains
+// stamp the module version of a checkout as a pseudo-version that already
+// names the revision, as in `v0.0.0-20261019033914-8fc6f3d63a40+dirty`, older
+// ones leave it `(devel)` and we add the short revision, and dirty if the
+// checkout was modified.
+func (i Info) RuntimeVersion() string {
+	if i.Version != "(devel)" || i.Revision == "" {
+		return i.Version
+	}
+	revision := i.Revision
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	version := i.Version + "+" + revision
+	if i.Modified {
+		version += "-dirty"
+	}
+	return version
+}
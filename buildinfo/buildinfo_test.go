@@ -0,0 +1,39 @@
+package buildinfo
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestRuntimeVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    Info
+		version string
+	}{
+		{"release", Info{Version: "v1.2.3", Revision: "8fc6f3d63a40aa"}, "v1.2.3"},
+		{"pseudo-version", Info{Version: "v0.0.0-20261019033914-8fc6f3d63a40+dirty", Revision: "8fc6f3d63a40aa", Modified: true}, "v0.0.0-20261019033914-8fc6f3d63a40+dirty"},
+		{"devel", Info{Version: "(devel)", Revision: "8fc6f3d63a40aabbccdd"}, "(devel)+8fc6f3d63a40"},
+		{"devel modified", Info{Version: "(devel)", Revision: "8fc6f3d63a40aabbccdd", Modified: true}, "(devel)+8fc6f3d63a40-dirty"},
+		{"devel short revision", Info{Version: "(devel)", Revision: "8fc6f3d"}, "(devel)+8fc6f3d"},
+		{"no revision", Info{Version: "(devel)"}, "(devel)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if version := test.info.RuntimeVersion(); version != test.version {
+				t.Errorf("got %q, want %q", version, test.version)
+			}
+		})
+	}
+}
+
+// A test binary has build information but no module version of its own.
+func TestRead(t *testing.T) {
+	info := Read()
+	if info.GoVersion != runtime.Version() {
+		t.Errorf("got Go version %q, want %q", info.GoVersion, runtime.Version())
+	}
+	if info.Version == "" {
+		t.Errorf("empty version")
+	}
+}
@@ -0,0 +1,155 @@
+// Package cache holds decrypted plain texts keyed by the SHA-256 digest of
+// their ciphertext, so that the ciphertexts the apiserver decrypts again and
+// again do not each cost a Tang recovery.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+type key [sha256.Size]byte
+
+type entry struct {
+	key     key
+	plain   []byte
+	expires time.Time
+}
+
+// Stats are the counts since the cache was created.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+}
+
+// Cache is a bounded least recently used cache whose entries also expire a
+// fixed time after they were added. Plain texts are copied in and out and
+// zeroed when they are evicted.
+type Cache struct {
+	size    int
+	ttl     time.Duration
+	now     func() time.Time
+	mutex   sync.Mutex
+	entries map[key]*list.Element
+	// Most recently used at the front.
+	order *list.List
+	// Runs every ttl while there are entries.
+	janitor *time.Timer
+	stats   Stats
+}
+
+// New creates a cache of at most size entries that expire after ttl.
+func New(size int, ttl time.Duration) *Cache {
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[key]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (c *Cache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*entry)
+	delete(c.entries, entry.key)
+	secret.Wipe(entry.plain)
+}
+
+func (c *Cache) evict(element *list.Element) {
+	c.remove(element)
+	c.stats.Evictions++
+}
+
+// Expired entries are removed when they are looked up, but one that is never
+// looked up again would keep its plain text in memory until it fell off the
+// end, so every ttl while there are entries the janitor looks for them all.
+func (c *Cache) sweep() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if !now.Before(element.Value.(*entry).expires) {
+			c.evict(element)
+		}
+		element = next
+	}
+	if c.order.Len() == 0 {
+		c.janitor = nil
+	} else {
+		c.janitor.Reset(c.ttl)
+	}
+}
+
+// Get returns a copy of the plain text of the ciphertext if it is cached and
+// has not expired.
+func (c *Cache) Get(cipher []byte) ([]byte, bool) {
+	digest := key(sha256.Sum256(cipher))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[digest]
+	if ok && !c.now().Before(element.Value.(*entry).expires) {
+		c.evict(element)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return append([]byte{}, element.Value.(*entry).plain...), true
+}
+
+// Put caches a copy of the plain text of the ciphertext, evicting the least
+// recently used entry if the cache is full.
+func (c *Cache) Put(cipher []byte, plain []byte) {
+	digest := key(sha256.Sum256(cipher))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	if element, ok := c.entries[digest]; ok {
+		c.remove(element)
+	}
+	for c.order.Len() >= c.size && c.order.Len() != 0 {
+		c.evict(c.order.Back())
+	}
+	if c.size < 1 {
+		return
+	}
+	c.entries[digest] = c.order.PushFront(&entry{
+		key:     digest,
+		plain:   append([]byte{}, plain...),
+		expires: now.Add(c.ttl),
+	})
+	if c.janitor == nil {
+		c.janitor = time.AfterFunc(c.ttl, c.sweep)
+	}
+}
+
+// Purge zeroes and removes every entry.
+func (c *Cache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.order.Len() != 0 {
+		c.evict(c.order.Back())
+	}
+	if c.janitor != nil {
+		c.janitor.Stop()
+		c.janitor = nil
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	return stats
+}
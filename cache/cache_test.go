@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+// A fake clock, the janitor's timer still runs on the real one.
+func newCache(size int) (*Cache, *time.Time) {
+	now := time.Now()
+	c := New(size, time.Minute)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCache(t *testing.T) {
+	type step struct {
+		// put, get, advance or purge
+		op     string
+		cipher string
+		hit    bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		stats Stats
+	}{{
+		name: "least recently used is evicted",
+		steps: []step{
+			{op: "put", cipher: "a"}, {op: "put", cipher: "b"}, {op: "get", cipher: "a", hit: true},
+			{op: "put", cipher: "c"},
+			{op: "get", cipher: "b"}, {op: "get", cipher: "a", hit: true}, {op: "get", cipher: "c", hit: true},
+		},
+		stats: Stats{Hits: 3, Misses: 1, Evictions: 1, Entries: 2},
+	}, {
+		name: "put replaces",
+		steps: []step{
+			{op: "put", cipher: "a"}, {op: "put", cipher: "a"}, {op: "put", cipher: "b"},
+			{op: "get", cipher: "a", hit: true}, {op: "get", cipher: "b", hit: true},
+		},
+		stats: Stats{Hits: 2, Entries: 2},
+	}, {
+		name: "expired",
+		steps: []step{
+			{op: "put", cipher: "a"}, {op: "advance"}, {op: "put", cipher: "b"}, {op: "get", cipher: "a", hit: true},
+			{op: "advance"}, {op: "get", cipher: "a"}, {op: "get", cipher: "b", hit: true},
+			{op: "advance"}, {op: "get", cipher: "b"},
+		},
+		stats: Stats{Hits: 2, Misses: 2, Evictions: 2},
+	}, {
+		name: "purged",
+		steps: []step{
+			{op: "put", cipher: "a"}, {op: "put", cipher: "b"}, {op: "purge"}, {op: "get", cipher: "a"},
+		},
+		stats: Stats{Misses: 1, Evictions: 2},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, now := newCache(2)
+			for i, step := range test.steps {
+				switch step.op {
+				case "put":
+					c.Put([]byte(step.cipher), []byte(step.cipher+" plain"))
+				case "get":
+					plain, hit := c.Get([]byte(step.cipher))
+					if hit != step.hit || hit && string(plain) != step.cipher+" plain" {
+						t.Fatalf("step %d: got %q %v, want hit %v", i, plain, hit, step.hit)
+					}
+				case "advance":
+					*now = now.Add(40 * time.Second)
+				case "purge":
+					c.Purge()
+				}
+			}
+			if stats := c.Stats(); stats != test.stats {
+				t.Fatalf("got %+v, want %+v", stats, test.stats)
+			}
+		})
+	}
+}
+
+// Entries that are never looked up again expire all the same, and the janitor
+// stops once the cache is empty.
+func TestJanitor(t *testing.T) {
+	c := New(8, 10*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		c.Put([]byte(fmt.Sprint(i)), []byte("plain"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Entries != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries never swept", c.Stats().Entries)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.janitor != nil {
+		t.Errorf("janitor runs with an empty cache")
+	}
+}
+
+// The cache keeps its own copies, and zeroes them however they leave it.
+func TestWipe(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(c *Cache, now *time.Time)
+	}{
+		{"evicted", func(c *Cache, now *time.Time) { c.Put([]byte("other"), []byte("other plain")) }},
+		{"expired on get", func(c *Cache, now *time.Time) {
+			*now = now.Add(time.Minute)
+			c.Get([]byte("cipher"))
+		}},
+		{"expired on sweep", func(c *Cache, now *time.Time) {
+			*now = now.Add(time.Minute)
+			c.sweep()
+		}},
+		{"replaced", func(c *Cache, now *time.Time) { c.Put([]byte("cipher"), []byte("new plain")) }},
+		{"purged", func(c *Cache, now *time.Time) { c.Purge() }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now()
+			c := New(1, time.Minute)
+			c.now = func() time.Time { return now }
+
+			plain := []byte("plain")
+			c.Put([]byte("cipher"), plain)
+			got, ok := c.Get([]byte("cipher"))
+			if !ok || string(got) != "plain" {
+				t.Fatalf("got %q %v", got, ok)
+			}
+			secret.Wipe(plain, got)
+			cached := c.order.Front().Value.(*entry).plain
+			if string(cached) != "plain" {
+				t.Fatalf("cache shares its plain text with callers, got %q", cached)
+			}
+
+			test.remove(c, &now)
+			if !secret.Wiped(cached) {
+				t.Errorf("plain text left in memory: %q", cached)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package census
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/flatheadmill/tang-encryption-provider/corpus"
+	"github.com/flatheadmill/tang-encryption-provider/inspect"
+)
+
+// Entry counts the ciphertexts encrypted to one Tang exchange key, as named by
+// the kid, on one Tang server, whose advertisement was signed by the same set
+// of signing keys.
+type Entry struct {
+	KeyID   string   `json:"kid"`
+	URL     string   `json:"url"`
+	Signers []string `json:"signers"`
+	Count   int      `json:"count"`
+	// Advertised is only set after Check.
+	Advertised *bool `json:"advertised,omitempty"`
+}
+
+type Failure struct {
+	Source string `json:"source"`
+	Error  string `json:"error"`
+}
+
+type Census struct {
+	entries  map[string]*Entry
+	Failures []Failure
+}
+
+func New() *Census {
+	return &Census{entries: map[string]*Entry{}}
+}
+
+// Add counts an item against every key it was encrypted to, those of the
+// JWEs nested in sss pins included, or records it as a failure if it could
+// not be read, decoded or inspected.
+func (c *Census) Add(item corpus.Item) {
+	if item.Err != nil {
+		c.Failures = append(c.Failures, Failure{Source: item.Source, Error: item.Err.Error()})
+		return
+	}
+	report, err := inspect.Inspect(item.Value)
+	if err != nil {
+		c.Failures = append(c.Failures, Failure{Source: item.Source, Error: err.Error()})
+		return
+	}
+	counted := map[*Entry]bool{}
+	report.Walk(func(report *inspect.Report) {
+		if report.Pin == "sss" {
+			return
+		}
+		signers := report.Signers()
+		sort.Strings(signers)
+		key := strings.Join([]string{report.KeyID, report.URL, strings.Join(signers, ",")}, " ")
+		entry, ok := c.entries[key]
+		if !ok {
+			entry = &Entry{KeyID: report.KeyID, URL: report.URL, Signers: signers}
+			c.entries[key] = entry
+		}
+		if !counted[entry] {
+			counted[entry] = true
+			entry.Count++
+		}
+	})
+}
+
+// Check asks each Tang server whether it still advertises the kids counted
+// against it, in an advertisement signed by the signing key with the
+// thumbprint. If tang is not empty it is asked about every kid instead of the
+// server named in the ciphertexts.
+func (c *Census) Check(tang string, thumbprint string) error {
+	advertised := map[string]map[string]bool{}
+	for _, entry := range c.entries {
+		url := entry.URL
+		if tang != "" {
+			url = tang
+		}
+		thumbprints, ok := advertised[url]
+		if !ok {
+			var err error
+			if thumbprints, err = inspect.Advertised(url, thumbprint); err != nil {
+				return err
+			}
+			advertised[url] = thumbprints
+		}
+		found := thumbprints[entry.KeyID]
+		entry.Advertised = &found
+	}
+	return nil
+}
+
+// Entries returns the counts sorted by URL and kid.
+func (c *Census) Entries() []Entry {
+	entries := []Entry{}
+	for _, entry := range c.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].URL == entries[j].URL {
+			return entries[i].KeyID < entries[j].KeyID
+		}
+		return entries[i].URL < entries[j].URL
+	})
+	return entries
+}
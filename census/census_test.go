@@ -0,0 +1,138 @@
+package census_test
+
+import (
+	"context"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/flatheadmill/tang-encryption-provider/census"
+	"github.com/flatheadmill/tang-encryption-provider/corpus"
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/envelope"
+	"github.com/flatheadmill/tang-encryption-provider/inspect"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+// An sss JWE around the shares, the census only reads its header.
+func sss(t *testing.T, shares ...[]byte) []byte {
+	jwes := make([]string, len(shares))
+	for i, share := range shares {
+		jwes[i] = string(share)
+	}
+	protected, err := json.Marshal(map[string]interface{}{
+		"alg":    "dir",
+		"enc":    "A256GCM",
+		"clevis": map[string]interface{}{"pin": "sss", "sss": map[string]interface{}{"t": 1, "jwe": jwes}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode64 := base64.RawURLEncoding.EncodeToString
+	return []byte(strings.Join([]string{encode64(protected), "", encode64(make([]byte, 12)), encode64(make([]byte, 32)), encode64(make([]byte, 16))}, "."))
+}
+
+func kid(t *testing.T, cipher []byte) string {
+	report, err := inspect.Inspect(cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report.KeyID
+}
+
+func TestCensus(t *testing.T) {
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := server.Start()
+	defer started.Close()
+	encrypt := func() []byte {
+		encrypter, err := crypter.NewCrypter(server.NewClient, started.URL, server.Thumbprint(), suite.Default, suite.Policy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher, err := encrypter.Encrypt(context.Background(), []byte("dek"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cipher
+	}
+	stale, staleSigner := encrypt(), server.Thumbprint()
+	if err := server.Rotate(elliptic.P256()); err != nil {
+		t.Fatal(err)
+	}
+	current, currentSigner := encrypt(), server.Thumbprint()
+
+	tally := census.New()
+	for _, item := range []corpus.Item{
+		{Source: "stale", Value: stale},
+		{Source: "current", Value: current},
+		{Source: "envelope", Value: (&envelope.Envelope{Provider: "tang", Key: current, Data: []byte("data")}).Bytes()},
+		// Counted once against each key, however many shares name it.
+		{Source: "sss", Value: sss(t, stale, sss(t, current, stale))},
+		{Source: "unreadable", Err: errors.New("permission denied")},
+		{Source: "malformed", Value: []byte("eyJ.a.b.c.d")},
+	} {
+		tally.Add(item)
+	}
+
+	yes, no := true, false
+	want := []census.Entry{
+		{KeyID: kid(t, stale), URL: started.URL, Signers: []string{staleSigner}, Count: 2, Advertised: &no},
+		{KeyID: kid(t, current), URL: started.URL, Signers: []string{currentSigner}, Count: 3, Advertised: &yes},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].KeyID < want[j].KeyID })
+	if failures := tally.Failures; len(failures) != 2 || failures[0].Source != "unreadable" || failures[1].Source != "malformed" {
+		t.Errorf("got failures %v", failures)
+	}
+
+	tests := []struct {
+		name       string
+		tang       string
+		thumbprint string
+		err        string
+	}{{
+		name: "no thumbprint",
+		err:  "thumbprint of a trusted signing key is required",
+	}, {
+		name:       "unknown signing key",
+		thumbprint: base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+		err:        "404",
+	}, {
+		name:       "another server",
+		tang:       "http://127.0.0.1:1",
+		thumbprint: currentSigner,
+		err:        "connection refused",
+	}, {
+		name:       "current signing key",
+		thumbprint: currentSigner,
+	}, {
+		name:       "url given",
+		tang:       started.URL,
+		thumbprint: currentSigner,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := tally.Check(test.tang, test.thumbprint)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries := tally.Entries(); !reflect.DeepEqual(entries, want) {
+				t.Fatalf("got %+v, want %+v", entries, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Package clevis decrypts clevis JWEs bound with the `tang` pin, or with the
+// `sss` pin over any number of nested `tang` and `sss` pins, as produced by
+// `clevis encrypt`, clevis.go and this project.
+package clevis
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+)
+
+var (
+	// ErrMalformed is returned for input that is not a compact clevis JWE.
+	ErrMalformed = errors.New("malformed clevis JWE")
+	// ErrUnsupported is returned for a pin, algorithm or encryption we do not
+	// implement.
+	ErrUnsupported = errors.New("unsupported clevis JWE")
+	// ErrAuthentication is returned when the recovered key does not decrypt
+	// the JWE, it was tampered with or the key is wrong.
+	ErrAuthentication = errors.New("clevis JWE failed authentication")
+	// ErrRejected is returned for a JWE whose algorithm or encryption the
+	// Decrypter's policy does not accept.
+	ErrRejected = suite.ErrRejected
+)
+
+// RecoveryError is returned when the Tang server named by a JWE does not
+// answer the McCallum-Relyea exchange.
+type RecoveryError struct {
+	URL   string
+	KeyID string
+	Err   error
+}
+
+func (e *RecoveryError) Error() string {
+	return fmt.Sprintf("tang recovery from %s with key %s failed: %v", e.URL, e.KeyID, e.Err)
+}
+
+func (e *RecoveryError) Unwrap() error {
+	return e.Err
+}
+
+// ThresholdError is returned when fewer than the threshold of an `sss` pin's
+// shares could be decrypted, Errors are the failures of the shares that could
+// not. Inspect them to tell a Tang server that is down from a ciphertext that
+// is corrupt.
+type ThresholdError struct {
+	Threshold int
+	Recovered int
+	Errors    []error
+}
+
+func (e *ThresholdError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("sss recovered %d of %d required shares: %s", e.Recovered, e.Threshold, strings.Join(messages, "; "))
+}
+
+func malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, args...))
+}
+
+func unsupported(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrUnsupported, fmt.Sprintf(format, args...))
+}
+
+func decode64(encoded string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
+
+// Decrypter decrypts clevis JWEs.
+type Decrypter struct {
+	// NewClient creates the client for the Tang server named in a JWE,
+	// defaults to tang.NewClient.
+	NewClient func(url string) (*tang.Client, error)
+	// Policy limits the algorithms and encryptions accepted, the zero
+	// Policy accepts every one we implement.
+	Policy suite.Policy
+}
+
+var defaultDecrypter = &Decrypter{}
+
+// Decrypt decrypts with the default Tang client.
+func Decrypt(cipher []byte) ([]byte, error) {
+	return defaultDecrypter.Decrypt(context.Background(), cipher)
+}
+
+func (d *Decrypter) client(url string) (*tang.Client, error) {
+	if d.NewClient != nil {
+		return d.NewClient(url)
+	}
+	return tang.NewClient(url)
+}
+
+type header struct {
+	Algorithm   string          `json:"alg"`
+	Encryption  string          `json:"enc"`
+	KeyID       string          `json:"kid"`
+	Compression string          `json:"zip"`
+	PartyU      string          `json:"apu"`
+	PartyV      string          `json:"apv"`
+	Ephemeral   json.RawMessage `json:"epk"`
+	Clevis      json.RawMessage `json:"clevis"`
+}
+
+type message struct {
+	// The protected header as it appears in the JWE, the AAD.
+	protected  string
+	header     header
+	encrypted  []byte
+	iv         []byte
+	ciphertext []byte
+	tag        []byte
+}
+
+func parse(compact []byte) (msg *message, err error) {
+	parts := strings.Split(string(bytes.TrimSpace(compact)), ".")
+	if len(parts) != 5 {
+		return nil, malformed("compact JWE must have five parts, found %d", len(parts))
+	}
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		if decoded[i], err = decode64(part); err != nil {
+			return nil, malformed("part %d is not base64url: %v", i, err)
+		}
+	}
+	msg = &message{
+		protected:  parts[0],
+		encrypted:  decoded[1],
+		iv:         decoded[2],
+		ciphertext: decoded[3],
+		tag:        decoded[4],
+	}
+	if err := json.Unmarshal(decoded[0], &msg.header); err != nil {
+		return nil, malformed("protected header: %v", err)
+	}
+	if msg.header.Compression != "" {
+		return nil, unsupported("compression %s", msg.header.Compression)
+	}
+	return msg, nil
+}
+
+// The pin name and its configuration from the `clevis` header member.
+func (m *message) pin() (pin string, config json.RawMessage, err error) {
+	if m.header.Clevis == nil {
+		return "", nil, malformed("protected header has no clevis member")
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(m.header.Clevis, &members); err != nil {
+		return "", nil, malformed("clevis member: %v", err)
+	}
+	if err := json.Unmarshal(members["pin"], &pin); err != nil || pin == "" {
+		return "", nil, malformed("clevis member has no pin")
+	}
+	config, ok := members[pin]
+	if !ok {
+		return "", nil, malformed("clevis member has no %s configuration", pin)
+	}
+	return pin, config, nil
+}
+
+func keySize(encryption string) (int, error) {
+	size, err := suite.KeySize(encryption)
+	if err != nil {
+		return 0, unsupported("encryption %q", encryption)
+	}
+	return size, nil
+}
+
+// MaxDepth is how deep sss pins may be nested in sss pins, a JWE nested deeper
+// is refused rather than followed.
+const MaxDepth = 8
+
+// Decrypt recovers the content encryption key with the JWE's pin and
+// decrypts it. The policy is checked against the header of every JWE, nested
+// ones included, before any Tang server is asked.
+func (d *Decrypter) Decrypt(ctx context.Context, compact []byte) (plain []byte, err error) {
+	return d.decrypt(ctx, compact, 0)
+}
+
+func (d *Decrypter) decrypt(ctx context.Context, compact []byte, depth int) (plain []byte, err error) {
+	defer err2.Return(&err)
+
+	if depth > MaxDepth {
+		return nil, malformed("sss pins nested deeper than %d", MaxDepth)
+	}
+	msg := try.To1(parse(compact))
+	size := try.To1(keySize(msg.header.Encryption))
+	err2.Check(d.Policy.CheckEnc(msg.header.Encryption))
+	pin, config := try.To2(msg.pin())
+
+	var key []byte
+	switch pin {
+	case "tang":
+		key = try.To1(d.tang(ctx, msg, config, size))
+	case "sss":
+		key = try.To1(d.sss(ctx, msg, config, depth))
+	default:
+		return nil, unsupported("pin %s", pin)
+	}
+	// The AES key schedule is beyond our reach, the key is not.
+	defer secret.Wipe(key)
+	if len(key) != size {
+		return nil, malformed("recovered key is %d bytes, %s needs %d", len(key), msg.header.Encryption, size)
+	}
+
+	aead, tagSize := try.To2(suite.NewContentCipher(msg.header.Encryption, key))
+	if len(msg.iv) != aead.NonceSize() || len(msg.tag) != tagSize {
+		return nil, malformed("iv or tag has the wrong length")
+	}
+	plain, err = aead.Open(nil, msg.iv, append(msg.ciphertext, msg.tag...), []byte(msg.protected))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plain, nil
+}
+
+func lengthPrefixed(data []byte) []byte {
+	out := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(out, uint32(len(data)))
+	copy(out[4:], data)
+	return out
+}
+
+// ConcatKDF is the single-step KDF of NIST SP 800-56A with SHA-256 that JWA
+// uses to derive the ECDH-ES key from the shared secret z. For direct key
+// agreement algorithm is the `enc` value, for key wrapping the `alg` value.
+func ConcatKDF(z []byte, algorithm string, partyU []byte, partyV []byte, size int) []byte {
+	var other []byte
+	other = append(other, lengthPrefixed([]byte(algorithm))...)
+	other = append(other, lengthPrefixed(partyU)...)
+	other = append(other, lengthPrefixed(partyV)...)
+	bits := make([]byte, 4)
+	binary.BigEndian.PutUint32(bits, uint32(size)*8)
+	other = append(other, bits...)
+
+	var key []byte
+	for counter := uint32(1); len(key) < size; counter++ {
+		digest := sha256.New()
+		binary.Write(digest, binary.BigEndian, counter)
+		digest.Write(z)
+		digest.Write(other)
+		key = digest.Sum(key)
+	}
+	secret.Wipe(key[size:])
+	return key[:size]
+}
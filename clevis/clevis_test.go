@@ -0,0 +1,221 @@
+package clevis_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"github.com/flatheadmill/tang-encryption-provider/clevis"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+var errOffline = errors.New("tang is offline")
+
+// recorder keeps the requests it is asked to make and makes none of them.
+type recorder struct {
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	var body []byte
+	if request.Body != nil {
+		body, _ = ioutil.ReadAll(request.Body)
+	}
+	r.requests = append(r.requests, request)
+	r.bodies = append(r.bodies, body)
+	return nil, errOffline
+}
+
+func (r *recorder) newClient(url string) (*tang.Client, error) {
+	client, err := tang.NewClient(url)
+	if err != nil {
+		return nil, err
+	}
+	client.HTTPClient = &http.Client{Transport: r}
+	return client, nil
+}
+
+// The JWE `clevis encrypt tang` produced for the README, on P-521, whose Tang
+// keys are long gone. It can not be decrypted, but we can check that it parses
+// and that it makes the recovery request clevis would.
+func TestREADME(t *testing.T) {
+	cipher, err := ioutil.ReadFile("../testdata/clevis/readme.jwe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recorder{}
+	decrypter := &clevis.Decrypter{NewClient: recorder.newClient}
+	_, err = decrypter.Decrypt(context.Background(), bytes.TrimSpace(cipher))
+
+	const url, kid = "http://localhost:8080", "x3G9Om-aF73m_oa7_kOqcGqa1mYsKFxS7k19S3jUls0"
+	var recovery *clevis.RecoveryError
+	if !errors.As(err, &recovery) {
+		t.Fatalf("got %v, want a recovery error", err)
+	}
+	if recovery.URL != url || recovery.KeyID != kid || !errors.Is(err, errOffline) {
+		t.Errorf("got %v", err)
+	}
+
+	if len(recorder.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(recorder.requests))
+	}
+	request := recorder.requests[0]
+	if request.Method != http.MethodPost || request.URL.String() != url+"/rec/"+kid {
+		t.Errorf("got %s %s", request.Method, request.URL)
+	}
+	if contentType := request.Header.Get("Content-Type"); contentType != "application/jwk+json" {
+		t.Errorf("got content type %q", contentType)
+	}
+	key, err := jwk.ParseKey(recorder.bodies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Algorithm() != "ECMR" {
+		t.Errorf("got algorithm %q, want ECMR", key.Algorithm())
+	}
+	public := &ecdsa.PublicKey{}
+	if err := key.Raw(public); err != nil {
+		t.Fatal(err)
+	}
+	if public.Curve != elliptic.P521() || !public.Curve.IsOnCurve(public.X, public.Y) {
+		t.Errorf("recovery request is not a point on P-521")
+	}
+}
+
+func jwe(header string) []byte {
+	return []byte(base64.RawURLEncoding.EncodeToString([]byte(header)) + "....")
+}
+
+// An sss pin around a single share, only the headers are read before the
+// nesting is refused.
+func nest(share []byte) []byte {
+	config, _ := json.Marshal(map[string]interface{}{"p": base64.RawURLEncoding.EncodeToString([]byte{251}), "t": 1, "jwe": []string{string(share)}})
+	return jwe(`{"alg":"dir","enc":"A256GCM","clevis":{"pin":"sss","sss":` + string(config) + `}}`)
+}
+
+// Failures are reported with typed errors so that callers can tell a tampered
+// ciphertext from a Tang server that is down.
+func TestErrors(t *testing.T) {
+	const vectors = "../testdata/vectors"
+	server, err := tangtest.Load(filepath.Join(vectors, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) []byte {
+		cipher, err := ioutil.ReadFile(filepath.Join(vectors, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.TrimSpace(cipher)
+	}
+	pin := read("provider-000.jwe")
+	sss := read("clevis.go-sss-001.jwe")
+	nested := pin
+	for i := 0; i <= clevis.MaxDepth; i++ {
+		nested = nest(nested)
+	}
+	tampered := append([]byte{}, pin...)
+	if tampered[len(tampered)-2] == 'A' {
+		tampered[len(tampered)-2] = 'B'
+	} else {
+		tampered[len(tampered)-2] = 'A'
+	}
+
+	online := &clevis.Decrypter{NewClient: server.NewClient}
+	offline := &clevis.Decrypter{NewClient: (&recorder{}).newClient}
+
+	isRecovery := func(err error) bool {
+		var recovery *clevis.RecoveryError
+		return errors.As(err, &recovery) && errors.Is(err, errOffline)
+	}
+	tests := []struct {
+		name      string
+		decrypter *clevis.Decrypter
+		cipher    []byte
+		expected  func(error) bool
+	}{
+		{"malformed", online, []byte("eyJ.not.a.jwe"), func(err error) bool { return errors.Is(err, clevis.ErrMalformed) }},
+		{"no clevis member", online, jwe(`{"alg":"ECDH-ES","enc":"A256GCM"}`), func(err error) bool { return errors.Is(err, clevis.ErrMalformed) }},
+		{"unsupported pin", online, jwe(`{"alg":"ECDH-ES","enc":"A256GCM","clevis":{"pin":"tpm2","tpm2":{}}}`), func(err error) bool { return errors.Is(err, clevis.ErrUnsupported) }},
+		{"unsupported encryption", online, jwe(`{"alg":"ECDH-ES","enc":"XC20P","clevis":{"pin":"tang","tang":{}}}`), func(err error) bool { return errors.Is(err, clevis.ErrUnsupported) }},
+		{"tampered", online, tampered, func(err error) bool { return errors.Is(err, clevis.ErrAuthentication) }},
+		{"offline tang", offline, pin, isRecovery},
+		{"offline sss", offline, sss, func(err error) bool {
+			var threshold *clevis.ThresholdError
+			return errors.As(err, &threshold) && len(threshold.Errors) != 0 && isRecovery(threshold.Errors[0])
+		}},
+		{"nested too deep", offline, nested, func(err error) bool { return strings.Contains(err.Error(), "nested deeper than 8") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.decrypter.Decrypt(context.Background(), test.cipher)
+			if err == nil || !test.expected(err) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+// The KDF hashes whole SHA-256 blocks and zeroes what is left over past the
+// key it returns.
+func TestConcatKDFWipe(t *testing.T) {
+	for _, size := range []int{16, 24, 32, 48, 64} {
+		key := clevis.ConcatKDF(bytes.Repeat([]byte{1}, 32), "A128GCM", nil, nil, size)
+		if len(key) != size {
+			t.Fatalf("got %d bytes, want %d", len(key), size)
+		}
+		if tail := key[len(key):cap(key)]; !secret.Wiped(tail) {
+			t.Errorf("%d byte key leaves %x in memory", size, tail)
+		}
+	}
+}
+
+// The policy is checked against nested JWEs too, and before any Tang server
+// is asked.
+func TestPolicy(t *testing.T) {
+	cipher, err := ioutil.ReadFile("../testdata/vectors/clevis.go-sss-000.jwe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		policy suite.Policy
+	}{
+		{"alg", suite.Policy{Algorithms: []string{suite.ECDHESA256KW}}},
+		{"curve", suite.Policy{Curves: []string{"P-256"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &recorder{}
+			decrypter := &clevis.Decrypter{NewClient: recorder.newClient, Policy: test.policy}
+			_, err := decrypter.Decrypt(context.Background(), bytes.TrimSpace(cipher))
+			var threshold *clevis.ThresholdError
+			if !errors.As(err, &threshold) || len(threshold.Errors) == 0 {
+				t.Fatalf("got %v, want a threshold error", err)
+			}
+			for _, share := range threshold.Errors {
+				if !errors.Is(share, clevis.ErrRejected) {
+					t.Errorf("got %v, want %v", share, clevis.ErrRejected)
+				}
+			}
+			if len(recorder.requests) != 0 {
+				t.Errorf("asked Tang %d times", len(recorder.requests))
+			}
+		})
+	}
+}
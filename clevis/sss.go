@@ -0,0 +1,118 @@
+package clevis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+type sssConfig struct {
+	Prime     string   `json:"p"`
+	Threshold int      `json:"t"`
+	Shares    []string `json:"jwe"`
+}
+
+type point struct {
+	x, y *big.Int
+}
+
+// The sss pin encrypts directly with the constant term of a random polynomial
+// over the prime field, and encrypts points of the polynomial with the nested
+// pins. Any threshold of points recover the key by Lagrange interpolation.
+func (d *Decrypter) sss(ctx context.Context, msg *message, raw json.RawMessage, depth int) (key []byte, err error) {
+	if msg.header.Algorithm != "dir" {
+		return nil, unsupported("sss pin with algorithm %q", msg.header.Algorithm)
+	}
+	if len(msg.encrypted) != 0 {
+		return nil, malformed("dir must not have an encrypted key")
+	}
+	var config sssConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, malformed("sss configuration: %v", err)
+	}
+	encoded, err := decode64(config.Prime)
+	if err != nil || len(encoded) == 0 {
+		return nil, malformed("sss prime is missing or not base64url")
+	}
+	prime := new(big.Int).SetBytes(encoded)
+	if !prime.ProbablyPrime(64) {
+		return nil, malformed("sss p is not prime")
+	}
+	if config.Threshold < 1 || len(config.Shares) < config.Threshold {
+		return nil, malformed("sss threshold %d with %d shares", config.Threshold, len(config.Shares))
+	}
+
+	size := len(encoded)
+	var points []point
+	var failures []error
+	for i, share := range config.Shares {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		decrypted, err := d.decrypt(ctx, []byte(share), depth+1)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("share %d: %w", i, err))
+			continue
+		}
+		if len(decrypted) != 2*size {
+			secret.Wipe(decrypted)
+			failures = append(failures, fmt.Errorf("share %d: %w", i, malformed("point is %d bytes, expected %d", len(decrypted), 2*size)))
+			continue
+		}
+		points = append(points, point{
+			x: new(big.Int).SetBytes(decrypted[:size]),
+			y: new(big.Int).SetBytes(decrypted[size:]),
+		})
+		secret.Wipe(decrypted)
+		if len(points) == config.Threshold {
+			break
+		}
+	}
+	if len(points) < config.Threshold {
+		return nil, &ThresholdError{Threshold: config.Threshold, Recovered: len(points), Errors: failures}
+	}
+
+	defer func() {
+		for _, point := range points {
+			secret.WipeInt(point.x, point.y)
+		}
+	}()
+	constant, err := interpolate(prime, points)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.WipeInt(constant)
+	if constant.BitLen() > size*8 {
+		return nil, malformed("sss secret is longer than the prime")
+	}
+	return constant.FillBytes(make([]byte, size)), nil
+}
+
+// The value of the polynomial through the points at zero.
+func interpolate(prime *big.Int, points []point) (*big.Int, error) {
+	constant := new(big.Int)
+	for j := range points {
+		basis := big.NewInt(1)
+		for m := range points {
+			if m == j {
+				continue
+			}
+			numerator := new(big.Int).Neg(points[m].x)
+			denominator := new(big.Int).Sub(points[j].x, points[m].x)
+			if denominator.ModInverse(denominator.Mod(denominator, prime), prime) == nil {
+				return nil, malformed("sss shares have the same x")
+			}
+			basis.Mul(basis, numerator)
+			basis.Mul(basis, denominator)
+			basis.Mod(basis, prime)
+		}
+		basis.Mul(basis, points[j].y)
+		constant.Add(constant, basis)
+		constant.Mod(constant, prime)
+		secret.WipeInt(basis)
+	}
+	return constant, nil
+}
@@ -0,0 +1,135 @@
+package clevis
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"github.com/flatheadmill/tang-encryption-provider/mcr"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+)
+
+type tangConfig struct {
+	URL           string          `json:"url"`
+	Advertisement json.RawMessage `json:"adv"`
+}
+
+// The exchange key named by the kid, from the advertisement clevis copied
+// into the header when it encrypted.
+func exchangeKey(config tangConfig, kid string) (exchange *ecdsa.PublicKey, err error) {
+	keys, err := jwk.Parse(config.Advertisement)
+	if err != nil {
+		return nil, malformed("tang advertisement: %v", err)
+	}
+	advertisement := &tang.Advertisement{Payload: config.Advertisement, Keys: keys}
+	key, err := advertisement.Find(kid)
+	if err != nil {
+		return nil, malformed("tang advertisement: %v", err)
+	}
+	if key == nil {
+		return nil, malformed("exchange key %s is not in the tang advertisement", kid)
+	}
+	exchange = &ecdsa.PublicKey{}
+	if err := key.Raw(exchange); err != nil {
+		return nil, malformed("exchange key %s: %v", kid, err)
+	}
+	return exchange, nil
+}
+
+func (m *message) ephemeral() (*ecdsa.PublicKey, error) {
+	if m.header.Ephemeral == nil {
+		return nil, malformed("protected header has no epk")
+	}
+	ephemeral := &ecdsa.PublicKey{}
+	if err := jwk.ParseRawKey(m.header.Ephemeral, ephemeral); err != nil {
+		return nil, malformed("epk: %v", err)
+	}
+	return ephemeral, nil
+}
+
+func (m *message) parties() (partyU []byte, partyV []byte, err error) {
+	if partyU, err = decode64(m.header.PartyU); err != nil {
+		return nil, nil, malformed("apu: %v", err)
+	}
+	if partyV, err = decode64(m.header.PartyV); err != nil {
+		return nil, nil, malformed("apv: %v", err)
+	}
+	return partyU, partyV, nil
+}
+
+// The tang pin encrypts with ECDH-ES to the exchange key named by the kid. We
+// recover the ECDH shared secret with the McCallum-Relyea exchange and derive
+// the content encryption key from it, or with ECDH-ES+A*KW the key that
+// unwraps it.
+func (d *Decrypter) tang(ctx context.Context, msg *message, raw json.RawMessage, size int) (key []byte, err error) {
+	defer err2.Return(&err)
+
+	wrapSize, err := suite.WrapSize(msg.header.Algorithm)
+	if err != nil {
+		return nil, unsupported("tang pin with algorithm %q", msg.header.Algorithm)
+	}
+	err2.Check(d.Policy.CheckAlg(msg.header.Algorithm))
+	if wrapSize == 0 && len(msg.encrypted) != 0 {
+		return nil, malformed("ECDH-ES must not have an encrypted key")
+	}
+	if wrapSize != 0 && len(msg.encrypted) != size+8 {
+		return nil, malformed("%s encrypted key is %d bytes, expected %d", msg.header.Algorithm, len(msg.encrypted), size+8)
+	}
+	var config tangConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, malformed("tang configuration: %v", err)
+	}
+	if config.URL == "" || config.Advertisement == nil {
+		return nil, malformed("tang configuration must have a url and an adv")
+	}
+
+	exchange := try.To1(exchangeKey(config, msg.header.KeyID))
+	ephemeral := try.To1(msg.ephemeral())
+	err2.Check(d.Policy.CheckCurve(exchange.Curve.Params().Name))
+	err2.Check(d.Policy.CheckCurve(ephemeral.Curve.Params().Name))
+	partyU, partyV := try.To2(msg.parties())
+
+	blinding, err := mcr.Blind(exchange, ephemeral)
+	if err != nil {
+		return nil, malformed("epk: %v", err)
+	}
+	defer blinding.Wipe()
+	shared, err := d.recover(ctx, config.URL, msg.header.KeyID, blinding)
+	if err != nil {
+		return nil, &RecoveryError{URL: config.URL, KeyID: msg.header.KeyID, Err: err}
+	}
+
+	defer secret.WipeInt(shared.X, shared.Y)
+	z := shared.X.FillBytes(make([]byte, (shared.Curve.Params().BitSize+7)/8))
+	defer secret.Wipe(z)
+	if wrapSize == 0 {
+		return ConcatKDF(z, msg.header.Encryption, partyU, partyV, size), nil
+	}
+	kek := ConcatKDF(z, msg.header.Algorithm, partyU, partyV, wrapSize)
+	defer secret.Wipe(kek)
+	key, err = suite.UnwrapKey(kek, msg.encrypted)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return key, nil
+}
+
+func (d *Decrypter) recover(ctx context.Context, url string, kid string, blinding *mcr.Blinding) (shared *ecdsa.PublicKey, err error) {
+	defer err2.Return(&err)
+
+	request := try.To1(jwk.New(blinding.Request))
+	err2.Check(request.Set(jwk.AlgorithmKey, "ECMR"))
+
+	client := try.To1(d.client(url))
+	response := try.To1(client.Recover(ctx, kid, request))
+
+	var recovered ecdsa.PublicKey
+	err2.Check(response.Raw(&recovered))
+	return blinding.Unblind(&recovered)
+}
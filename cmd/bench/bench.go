@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/bench"
+	"github.com/flatheadmill/tang-encryption-provider/cache"
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	gojose "github.com/flatheadmill/tang-encryption-provider/go-jose"
+	"github.com/flatheadmill/tang-encryption-provider/logger"
+	"github.com/flatheadmill/tang-encryption-provider/plugin"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+var backends = map[string]func(url string, thumbprint string) (bench.Crypter, error){
+	"jwx": func(url string, thumbprint string) (bench.Crypter, error) {
+		return crypter.NewCrypter(nil, url, thumbprint, suite.Default, suite.Policy{})
+	},
+	"go-jose": func(url string, thumbprint string) (bench.Crypter, error) {
+		return gojose.NewCrypter(nil, url, thumbprint, suite.Default, suite.Policy{})
+	},
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+type options struct {
+	operations  []string
+	sizes       []int
+	concurrency []int
+	requests    int
+	direct      bool
+	cacheSize   int
+}
+
+func list(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func numbers(value string) (numbers []int, err error) {
+	for _, item := range list(value) {
+		number, err := strconv.Atoi(item)
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("expected a positive number, got %q", item)
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, nil
+}
+
+func socket(path string, backend string, tang bench.Counter, opts options) (results []bench.Result, err error) {
+	defer err2.Return(&err)
+	conn := try.To1(bench.Dial(path))
+	defer conn.Close()
+	for _, operation := range opts.operations {
+		for _, size := range opts.sizes {
+			for _, concurrency := range opts.concurrency {
+				result := try.To1(bench.Socket(conn, operation, size, concurrency, opts.requests, tang))
+				result.Backend = backend
+				results = append(results, result)
+			}
+		}
+	}
+	return results, nil
+}
+
+// Each backend gets its own Tang stand-in, served over loopback HTTP, and its
+// own plugin on a socket in a temporary directory.
+func inProcess(backend string, curve elliptic.Curve, opts options) (results []bench.Result, err error) {
+	defer err2.Return(&err)
+
+	create, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+	server := try.To1(tangtest.New(curve))
+	listener := server.Start()
+	defer listener.Close()
+	tang := func() int64 {
+		advertisements, recoveries := server.Counts()
+		return advertisements + recoveries
+	}
+
+	crypt := try.To1(create(listener.URL, server.Thumbprint()))
+
+	if opts.direct {
+		for _, operation := range opts.operations {
+			for _, size := range opts.sizes {
+				result := try.To1(bench.Direct(crypt, operation, size, opts.requests, tang))
+				result.Backend = backend
+				results = append(results, result)
+			}
+		}
+	}
+
+	dir := try.To1(ioutil.TempDir("", "bench"))
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kms.sock")
+	var decryptCache *cache.Cache
+	if opts.cacheSize > 0 {
+		decryptCache = cache.New(opts.cacheSize, time.Hour)
+	}
+	plug := try.To1(plugin.New(logger.New(ioutil.Discard), crypt, path, decryptCache, plugin.Limits{}, plugin.Policy{}))
+	rpc, errs := plug.ServeKMSRequests()
+	if rpc == nil {
+		return nil, <-errs
+	}
+	defer rpc.Stop()
+
+	return append(results, try.To1(socket(path, backend, tang, opts))...), nil
+}
+
+func printResults(results []bench.Result) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(writer, "BACKEND\tMODE\tOP\tSIZE\tCONC\tREQUESTS\tERRORS\tOPS/S\tP50\tP99\tALLOCS/OP\tTANG/OP\t\n")
+	for _, r := range results {
+		tang := "-"
+		if r.TangPerOp >= 0 {
+			tang = fmt.Sprintf("%.2f", r.TangPerOp)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%.0f\t%v\t%v\t%.0f\t%s\t\n",
+			r.Backend, r.Mode, r.Operation, r.Size, r.Concurrency, r.Requests, r.Errors,
+			r.Throughput(), r.P50.Round(1000), r.P99.Round(1000), r.AllocsPerOp, tang)
+	}
+	writer.Flush()
+}
+
+func run(socketPath string, backendList string, curveName string, opts options, asJSON bool) (err error) {
+	defer err2.Return(&err)
+
+	var results []bench.Result
+	if socketPath != "" {
+		results = try.To1(socket(socketPath, "external", nil, opts))
+	} else {
+		curve, ok := curves[curveName]
+		if !ok {
+			return fmt.Errorf("unknown curve %q", curveName)
+		}
+		for _, backend := range list(backendList) {
+			results = append(results, try.To1(inProcess(backend, curve, opts))...)
+		}
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+	printResults(results)
+	return nil
+}
+
+func main() {
+	var (
+		socketPath  = flag.String("socket", "", "KMS plugin socket to drive instead of starting one per backend")
+		backendList = flag.String("backend", "jwx,go-jose", "comma separated backends to start")
+		curve       = flag.String("curve", "P-521", "curve of the Tang stand-in's exchange key")
+		operations  = flag.String("op", "encrypt,decrypt", "comma separated operations")
+		sizes       = flag.String("size", "32,4096", "comma separated plain text sizes in bytes")
+		concurrency = flag.String("concurrency", "1,8", "comma separated numbers of concurrent clients")
+		requests    = flag.Int("requests", 200, "requests for each operation, size and concurrency")
+		direct      = flag.Bool("direct", true, "also benchmark each backend's crypter directly, without gRPC")
+		cacheSize   = flag.Int("decrypt-cache", 0, "size of the plugin's decrypt cache, 0 for none")
+		asJSON      = flag.Bool("json", false, "print the results as JSON")
+	)
+	flag.Parse()
+
+	opts := options{operations: list(*operations), requests: *requests, direct: *direct, cacheSize: *cacheSize}
+	var err error
+	if opts.sizes, err = numbers(*sizes); err == nil {
+		if opts.concurrency, err = numbers(*concurrency); err == nil {
+			err = run(*socketPath, *backendList, *curve, opts, *asJSON)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
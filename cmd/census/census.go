@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/census"
+	"github.com/flatheadmill/tang-encryption-provider/corpus"
+)
+
+func open(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+func gather(etcd string, jsonl string, dirs []string) (items []corpus.Item, err error) {
+	defer err2.Return(&err)
+	if etcd != "" {
+		file := try.To1(open(etcd))
+		defer file.Close()
+		items = append(items, try.To1(corpus.Etcd(file))...)
+	}
+	if jsonl != "" {
+		file := try.To1(open(jsonl))
+		defer file.Close()
+		items = append(items, try.To1(corpus.JSONL(file, jsonl))...)
+	}
+	for _, dir := range dirs {
+		items = append(items, try.To1(corpus.Directory(dir))...)
+	}
+	return items, nil
+}
+
+func printEntries(entries []census.Entry) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "KID\tURL\tSIGNERS\tCOUNT\tADVERTISED\n")
+	for _, entry := range entries {
+		advertised := "unchecked"
+		if entry.Advertised != nil {
+			advertised = "yes"
+			if !*entry.Advertised {
+				advertised = "NO"
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\n", entry.KeyID, entry.URL, strings.Join(entry.Signers, ","), entry.Count, advertised)
+	}
+	writer.Flush()
+}
+
+func count(etcd string, jsonl string, dirs []string, tang string, thumbprint string, check bool, asJSON bool) (err error) {
+	defer err2.Return(&err)
+
+	items := try.To1(gather(etcd, jsonl, dirs))
+
+	tally := census.New()
+	for _, item := range items {
+		tally.Add(item)
+	}
+	if check {
+		err2.Check(tally.Check(tang, thumbprint))
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err2.Check(encoder.Encode(map[string]interface{}{"keys": tally.Entries(), "failures": tally.Failures}))
+	} else {
+		printEntries(tally.Entries())
+		for _, failure := range tally.Failures {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", failure.Source, failure.Error)
+		}
+		if len(tally.Failures) != 0 {
+			fmt.Fprintf(os.Stderr, "%d values could not be counted\n", len(tally.Failures))
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	var (
+		etcd       = flag.String("etcd", "", "output of `etcdctl get --prefix / -w json`, - for stdin")
+		jsonl      = flag.String("jsonl", "", "JSON lines file whose string values are ciphertexts, - for stdin")
+		tang       = flag.String("tang", "", "url of tang server to check kids against, defaults to the url in each ciphertext")
+		thumbprint = flag.String("thumbprint", os.Getenv("TANG_KMS_THUMBPRINT"), "thumbprint of the advertisement signing key trusted by -check")
+		check      = flag.Bool("check", false, "check whether each kid is still advertised by the tang server")
+		asJSON     = flag.Bool("json", false, "print the census as JSON")
+	)
+	flag.Parse()
+	err := count(*etcd, *jsonl, flag.Args(), *tang, *thumbprint, *check, *asJSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
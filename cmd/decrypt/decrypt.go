@@ -15,6 +15,7 @@ import (
 	pb "k8s.io/apiserver/pkg/storage/value/encrypt/envelope/v1beta1"
 
 	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/envelope"
 )
 
 func decryptWithKMS(socket string) (err error) {
@@ -34,11 +35,11 @@ func decryptWithKMS(socket string) (err error) {
 
 	ctx := context.Background()
 
-	version := try.To1(client.Version(ctx, &pb.VersionRequest{}))
+	version := try.To1(client.Version(ctx, &pb.VersionRequest{Version: "v1beta1"}))
 
 	fmt.Fprintf(os.Stderr, "%v\n", version)
 
-	plain := try.To1(client.Decrypt(ctx, &pb.DecryptRequest{Cipher: input}))
+	plain := try.To1(client.Decrypt(ctx, &pb.DecryptRequest{Version: "v1beta1", Cipher: input}))
 
 	fmt.Print(string(plain.Plain))
 
@@ -53,14 +54,37 @@ func decryptWithTang() (err error) {
 	return nil
 }
 
+// Decrypts a raw etcd value written by the apiserver through this plugin,
+// without the apiserver, by recovering the DEK directly from Tang.
+func decryptEnvelope(input []byte, mode envelope.Mode, key string) (err error) {
+	defer err2.Return(&err)
+	value := try.To1(envelope.Parse(input))
+	plain := try.To1(value.Decrypt(crypter.Decrypt, mode, []byte(key)))
+	try.To1(os.Stdout.Write(plain))
+	return nil
+}
+
 func main() {
 	var (
 		grpc = flag.String("grpc", "", "url of gRPC server")
+		file = flag.String("envelope", "", "path of a raw KMS v1 etcd value to decrypt, - for stdin")
+		mode = flag.String("mode", string(envelope.CBC), "AES mode of the envelope data, cbc or gcm")
+		key  = flag.String("etcd-key", "", "etcd key of the envelope value, authenticated data for gcm")
 	)
 	flag.Parse()
 	var err error
 	if *grpc != "" {
 		err = decryptWithKMS(*grpc)
+	} else if *file != "" {
+		var input []byte
+		if *file == "-" {
+			input, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			input, err = ioutil.ReadFile(*file)
+		}
+		if err == nil {
+			err = decryptEnvelope(input, envelope.Mode(*mode), *key)
+		}
 	} else {
 		err = decryptWithTang()
 	}
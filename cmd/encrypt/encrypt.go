@@ -16,6 +16,7 @@ import (
 	pb "k8s.io/apiserver/pkg/storage/value/encrypt/envelope/v1beta1"
 
 	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
 )
 
 func encryptWithKMS(socket string) (err error) {
@@ -35,22 +36,22 @@ func encryptWithKMS(socket string) (err error) {
 
 	ctx := context.Background()
 
-	version := try.To1(client.Version(ctx, &pb.VersionRequest{}))
+	version := try.To1(client.Version(ctx, &pb.VersionRequest{Version: "v1beta1"}))
 
 	fmt.Fprintf(os.Stderr, "%v\n", version)
 
-	cipher := try.To1(client.Encrypt(ctx, &pb.EncryptRequest{Plain: input}))
+	cipher := try.To1(client.Encrypt(ctx, &pb.EncryptRequest{Version: "v1beta1", Plain: input}))
 
 	fmt.Printf("%s\n", cipher.Cipher)
 
 	return nil
 }
 
-func encryptWithTang(url string, thumbprint string) (err error) {
+func encryptWithTang(url string, thumbprint string, encryption suite.Suite) (err error) {
 	err2.Return(&err)
 	input := try.To1(ioutil.ReadAll(os.Stdin))
-	encrypter := try.To1(crypter.NewCrypter(url, thumbprint))
-	compact := try.To1(encrypter.Encrypt(input))
+	encrypter := try.To1(crypter.NewCrypter(nil, url, thumbprint, encryption, suite.Policy{}))
+	compact := try.To1(encrypter.Encrypt(context.Background(), input))
 	fmt.Printf("%s\n", compact)
 	return nil
 }
@@ -60,13 +61,15 @@ func main() {
 		grpc       = flag.String("grpc", "", "url of gRPC server")
 		tang       = flag.String("tang", "", "url of tang server")
 		thumbprint = flag.String("thumbprint", "", "thumbprint of advertisement signing key")
+		alg        = flag.String("alg", suite.Default.Alg, "JWE key management algorithm")
+		enc        = flag.String("enc", suite.Default.Enc, "JWE content encryption")
 	)
 	flag.Parse()
 	var err error
 	if *grpc != "" {
 		err = encryptWithKMS(*grpc)
 	} else {
-		err = encryptWithTang(*tang, *thumbprint)
+		err = encryptWithTang(*tang, *thumbprint, suite.Suite{Alg: *alg, Enc: *enc})
 	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, ">> %v\n", err)
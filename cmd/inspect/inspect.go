@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/inspect"
+)
+
+func printReport(report *inspect.Report, indent string) {
+	if report.Provider != "" {
+		fmt.Printf("%sprovider: %s\n", indent, report.Provider)
+	}
+	fmt.Printf("%salg: %s\n", indent, report.Algorithm)
+	fmt.Printf("%senc: %s\n", indent, report.Encryption)
+	fmt.Printf("%spin: %s\n", indent, report.Pin)
+	if report.Pin == "sss" {
+		fmt.Printf("%sthreshold: %d\n", indent, report.Threshold)
+		fmt.Printf("%spayload size: %d\n", indent, report.PayloadSize)
+		for i, share := range report.Shares {
+			fmt.Printf("%sshare %d:\n", indent, i)
+			printReport(share, indent+"  ")
+		}
+		return
+	}
+	fmt.Printf("%skid: %s\n", indent, report.KeyID)
+	fmt.Printf("%surl: %s\n", indent, report.URL)
+	fmt.Printf("%sepk crv: %s\n", indent, report.EphemeralCurve)
+	fmt.Printf("%spayload size: %d\n", indent, report.PayloadSize)
+	fmt.Printf("%skeys:\n", indent)
+	for _, key := range report.Keys {
+		fmt.Printf("%s  %s %s %s %s [%s]\n", indent, key.Thumbprint, key.Type, key.Curve, key.Algorithm, strings.Join(key.Operations, ","))
+	}
+	if report.Advertised != nil {
+		fmt.Printf("%sadvertised: %v\n", indent, *report.Advertised)
+	}
+}
+
+func inspectCipher(path string, tang string, thumbprint string, check bool, asJSON bool) (err error) {
+	defer err2.Return(&err)
+
+	var input []byte
+	if path == "" || path == "-" {
+		input = try.To1(ioutil.ReadAll(os.Stdin))
+	} else {
+		input = try.To1(ioutil.ReadFile(path))
+	}
+
+	report := try.To1(inspect.Inspect(input))
+
+	if check {
+		err2.Check(report.Check(tang, thumbprint))
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err2.Check(encoder.Encode(report))
+	} else {
+		printReport(report, "")
+	}
+
+	return nil
+}
+
+func main() {
+	var (
+		tang       = flag.String("tang", os.Getenv("TANG_KMS_SERVER_URL"), "url of tang server to check the kid against, defaults to the url in the header")
+		thumbprint = flag.String("thumbprint", os.Getenv("TANG_KMS_THUMBPRINT"), "thumbprint of the advertisement signing key trusted by -check")
+		check      = flag.Bool("check", false, "check whether the kid is advertised by the tang server")
+		asJSON     = flag.Bool("json", false, "print the report as JSON")
+	)
+	flag.Parse()
+	err := inspectCipher(flag.Arg(0), *tang, *thumbprint, *check, *asJSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/corpus"
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/rewrap"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+)
+
+// Write to a temporary file in the same directory and rename so that a
+// failure never leaves a half written value behind.
+func writeFile(path string, value []byte) (err error) {
+	defer err2.Return(&err)
+	info := try.To1(os.Stat(path))
+	temp := try.To1(ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)))
+	defer os.Remove(temp.Name())
+	try.To1(temp.Write(value))
+	err2.Check(temp.Chmod(info.Mode()))
+	err2.Check(temp.Close())
+	err2.Check(os.Rename(temp.Name(), path))
+	return nil
+}
+
+func rewrapAll(url string, thumbprint string, encryption suite.Suite, paths []string, concurrency int, dryRun bool) (err error) {
+	defer err2.Return(&err)
+
+	var items []corpus.Item
+	if len(paths) == 0 {
+		items = try.To1(corpus.Lines(os.Stdin, "stdin"))
+	} else {
+		items = corpus.Files(paths)
+	}
+
+	var current rewrap.Crypter
+	if !dryRun {
+		current = try.To1(crypter.NewCrypter(nil, url, thumbprint, encryption, suite.Policy{}))
+	}
+	results := rewrap.New(current, dryRun).All(context.Background(), items, concurrency)
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %v\n", result.Item.Source, result.Err)
+		}
+		if dryRun {
+			continue
+		}
+		// Every line in is a line out, a value that failed is passed through
+		// as it was.
+		if len(paths) == 0 {
+			value := result.Value
+			if result.Err != nil {
+				value = result.Item.Value
+			}
+			fmt.Printf("%s\n", result.Item.Encode(value))
+		} else if result.Status == rewrap.Rewrapped {
+			err2.Check(writeFile(result.Item.Source, result.Item.Encode(result.Value)))
+		}
+	}
+
+	for _, count := range rewrap.Summarize(results) {
+		fmt.Fprintf(os.Stderr, "%s\t%s\t%d\n", count.KeyID, count.Status, count.Count)
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("failed to rewrap %d of %d values", failed, len(results))
+	}
+	return nil
+}
+
+func envOr(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	var (
+		tang        = flag.String("tang", os.Getenv("TANG_KMS_SERVER_URL"), "url of tang server")
+		thumbprint  = flag.String("thumbprint", os.Getenv("TANG_KMS_THUMBPRINT"), "thumbprint of advertisement signing key")
+		alg         = flag.String("alg", envOr("TANG_KMS_JWE_ALG", suite.Default.Alg), "JWE key management algorithm of the rewrapped values")
+		enc         = flag.String("enc", envOr("TANG_KMS_JWE_ENC", suite.Default.Enc), "JWE content encryption of the rewrapped values")
+		concurrency = flag.Int("concurrency", 4, "number of values to rewrap at once")
+		dryRun      = flag.Bool("dry-run", false, "only count the kids still in use")
+	)
+	flag.Parse()
+	err := rewrapAll(*tang, *thumbprint, suite.Suite{Alg: *alg, Enc: *enc}, flag.Args(), *concurrency, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/activation"
+	"github.com/flatheadmill/tang-encryption-provider/plugin"
+)
+
+// How long a replacement has to start serving before we give up on it.
+const handoffTimeout = 30 * time.Second
+
+func listenerFile(listener net.Listener) (*os.File, error) {
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can not hand off a %T", listener)
+	}
+	return filer.File()
+}
+
+// handoff starts a new copy of the server on our listeners. Once it is
+// serving, and systemd knows it as the service's main process, we stop
+// accepting and drain, connections that arrive meanwhile wait
+// in the socket's backlog for whichever process accepts first.
+func handoff(plug *plugin.Plugin, httpListener net.Listener, tcpListener net.Listener) (pid int, err error) {
+	defer err2.Return(&err)
+
+	files := map[string]*os.File{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	files[activation.KMS] = try.To1(plug.ListenerFile())
+	files[activation.HTTP] = try.To1(listenerFile(httpListener))
+	if tcpListener != nil {
+		files[activation.TCP] = try.To1(listenerFile(tcpListener))
+	}
+	process := try.To1(activation.Handoff(files, handoffTimeout))
+	plug.HandedOff()
+	return process.Pid, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/config"
+	"github.com/flatheadmill/tang-encryption-provider/logger"
+	"github.com/flatheadmill/tang-encryption-provider/plugin"
+	"github.com/flatheadmill/tang-encryption-provider/sandbox"
+)
+
+// The logger is decided by env, which only a restart changes.
+func newLogger(spec config.Specification) logger.Logger {
+	log := logger.New(os.Stdout)
+	if spec.Profile().Console {
+		log.Console()
+	}
+	return log
+}
+
+func logPayloads(spec config.Specification) bool {
+	return spec.LogPayloads && spec.Profile().PayloadLogging
+}
+
+type reloader struct {
+	path string
+	spec config.Specification
+	log  logger.Logger
+	plug *plugin.Plugin
+	// Applies the rate limits to the Tang requests of every crypter, fixed at
+	// startup.
+	limiter http.RoundTripper
+	// What the sandbox lets us connect to, nil when not restricted.
+	rules *sandbox.Rules
+}
+
+// reload reads and validates the configuration, builds a crypter from it and
+// checks it against Tang, and only then swaps it into the plugin. On any
+// error the running configuration is kept.
+func (r *reloader) reload() (err error) {
+	defer err2.Return(&err)
+
+	spec := try.To1(config.Load(r.path))
+	try.To(spec.Validate())
+	try.To(spec.Enforce())
+	try.To(r.spec.CheckReload(spec))
+	if r.rules != nil {
+		for _, location := range append([]string{spec.ServerUrl}, spec.DecryptAllowlist...) {
+			if !r.rules.Connects(location) {
+				return fmt.Errorf("%q is on a port the sandbox closed, it can only be reached after a restart", location)
+			}
+		}
+	}
+
+	crypt := try.To1(newCrypter(spec, newTangClient(r.limiter, spec.DecryptAllowlist)))
+	try.To(crypt.Health())
+
+	r.plug.Reload(r.log, crypt, logPayloads(spec))
+	r.spec = spec
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/sandbox"
+)
+
+// confine drops root and the sandbox closes everything but the files and
+// ports the server still needs, once its listeners are open.
+func (r *reloader) confine() (err error) {
+	defer err2.Return(&err)
+
+	if r.spec.RunAsUID != 0 || r.spec.RunAsGID != 0 || r.spec.Sandbox {
+		try.To(sandbox.DropPrivileges(r.spec.RunAsUID, r.spec.RunAsGID))
+		r.log.Msgf("dropped privileges, running as uid %d gid %d", os.Getuid(), os.Getgid())
+	}
+	if !r.spec.Sandbox {
+		return nil
+	}
+
+	rules := try.To1(sandbox.Server{
+		Files:      []string{r.path, r.spec.TLSCertFile, r.spec.TLSKeyFile, r.spec.TLSClientCAFile, os.Getenv("SSL_CERT_FILE"), os.Getenv("SSL_CERT_DIR")},
+		Executable: try.To1(os.Executable()),
+		UnixSocket: r.spec.UnixSocket,
+		TangURLs:   append([]string{r.spec.ServerUrl}, r.spec.DecryptAllowlist...),
+	}.Rules())
+
+	// Loaded once and kept, before the sandbox hides where they came from.
+	_, _ = x509.SystemCertPool()
+	restriction := try.To1(sandbox.Restrict(rules))
+	if restriction.Network {
+		r.rules = &rules
+	}
+	r.log.MsgWithFields(map[string]interface{}{"landlock_abi": restriction.ABI, "network": restriction.Network, "read_only": rules.ReadOnly, "read_write": rules.ReadWrite, "connect_ports": rules.ConnectPorts}, "sandboxed")
+	return nil
+}
@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"github.com/flatheadmill/tang-encryption-provider/activation"
+	"github.com/flatheadmill/tang-encryption-provider/allow"
 	"github.com/flatheadmill/tang-encryption-provider/api"
+	"github.com/flatheadmill/tang-encryption-provider/buildinfo"
+	"github.com/flatheadmill/tang-encryption-provider/cache"
+	"github.com/flatheadmill/tang-encryption-provider/config"
 	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	gojose "github.com/flatheadmill/tang-encryption-provider/go-jose"
+	"github.com/flatheadmill/tang-encryption-provider/limit"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,65 +23,211 @@ import (
 	"time"
 
 	"github.com/flatheadmill/tang-encryption-provider/logger"
+	"github.com/flatheadmill/tang-encryption-provider/metrics"
+	"github.com/flatheadmill/tang-encryption-provider/mtls"
 	"github.com/flatheadmill/tang-encryption-provider/plugin"
-	"github.com/kelseyhightower/envconfig"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/selftest"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
 	"github.com/lainio/err2/try"
+	"google.golang.org/grpc"
 )
 
-type Specification struct {
-	ServerUrl  string `envconfig:"server_url"`
-	Thumbprint string
-	UnixSocket string `envconfig:"unix_socket" default:"/var/run/kmsplugin/socket.sock"`
-	HttpPort   string `envconfig:"http_port" default:"8081"`
-	Env        string `default:"local"`
+type Crypter interface {
+	plugin.Crypter
+	api.Healther
 }
 
-const (
-	EnvLocal = "local"
-	EnvDev   = "dev"
-	EnvProd  = "prod"
-)
+// newTangClient returns a function creating Tang clients that all send their
+// requests through the one HTTP client, which applies the allowlist and then
+// the rate limits of limiter.
+func newTangClient(limiter http.RoundTripper, list allow.List) func(url string) (*tang.Client, error) {
+	httpClient := &http.Client{Transport: allow.NewTransport(limiter, list)}
+	return func(url string) (*tang.Client, error) {
+		client, err := tang.NewClient(url)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+		return client, nil
+	}
+}
+
+// The jwx backend encrypts with lestrrat-go/jwx and decrypts with the clevis package,
+// the go-jose backend does both natively with go-jose.
+func newCrypter(spec config.Specification, newClient func(url string) (*tang.Client, error)) (Crypter, error) {
+	switch spec.Backend {
+	case config.BackendJwx:
+		return crypter.NewCrypter(newClient, spec.ServerUrl, spec.Thumbprint, spec.Suite(), spec.DecryptPolicy())
+	case config.BackendGoJose:
+		return gojose.NewCrypter(newClient, spec.ServerUrl, spec.Thumbprint, spec.Suite(), spec.DecryptPolicy())
+	}
+	return nil, fmt.Errorf("unknown crypto backend %q", spec.Backend)
+}
 
 func main() {
-	var spec Specification
-	try.To(envconfig.Process("tang_kms", &spec))
-	log := logger.New(os.Stdout)
-	if spec.Env == EnvLocal {
-		log.Console()
+	var (
+		configPath  = flag.String("config", os.Getenv("TANG_KMS_CONFIG"), "YAML or JSON configuration file, overridden by TANG_KMS_* environment variables")
+		checkConfig = flag.Bool("check-config", false, "validate the configuration and exit without serving")
+	)
+	flag.Parse()
+
+	spec, err := config.Load(*configPath)
+	if err == nil {
+		err = spec.Validate()
+	}
+	if err == nil {
+		err = spec.Enforce()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if *checkConfig {
+		fmt.Println("configuration ok")
+		return
 	}
 
-	log.MsgWithFields(map[string]interface{}{"thumbprint": spec.Thumbprint, "unix_socket": spec.UnixSocket}, "")
-	crypt := try.To1(crypter.NewCrypter(spec.ServerUrl, spec.Thumbprint))
+	log := newLogger(spec)
+	// Before there is anything in memory to dump or swap.
+	if !spec.AllowCoreDumps {
+		try.To(secret.DisableCoreDumps())
+	}
+	if spec.LockMemory {
+		try.To(secret.LockMemory())
+	}
+	if spec.FIPS {
+		if err := selftest.Run(); err != nil {
+			log.Err(err)
+			os.Exit(1)
+		}
+		log.Msgf("fips mode, %d self-tests passed", len(selftest.Tests()))
+	}
+	listeners := try.To1(activation.Listeners())
+	for name := range listeners {
+		if name != activation.KMS && name != activation.HTTP && !(name == activation.TCP && spec.TcpAddress != "") {
+			fmt.Fprintf(os.Stderr, "socket activation passed an unexpected listener %q\n", name)
+			os.Exit(1)
+		}
+	}
+
+	log.MsgWithFields(map[string]interface{}{"version": buildinfo.Read().RuntimeVersion(), "env": spec.Env, "thumbprint": spec.Thumbprint, "unix_socket": spec.UnixSocket, "backend": spec.Backend, "decrypt_cache_size": spec.DecryptCacheSize, "lock_memory": spec.LockMemory, "core_dumps": spec.AllowCoreDumps, "fips": spec.FIPS}, "")
+	// Every Tang client shares the limits, reloaded crypters included.
+	limiter := limit.NewTransport(nil, spec.TangRate, spec.TangBurst)
+	crypt := try.To1(newCrypter(spec, newTangClient(limiter, spec.DecryptAllowlist)))
+
+	var decryptCache *cache.Cache
+	if spec.DecryptCacheSize > 0 {
+		decryptCache = cache.New(spec.DecryptCacheSize, time.Duration(spec.DecryptCacheTTL))
+		try.To(metrics.RegisterDecryptCache(decryptCache))
+	}
+
+	limits := plugin.Limits{
+		MaxConcurrentEncrypts: spec.MaxConcurrentEncrypts,
+		MaxConcurrentDecrypts: spec.MaxConcurrentDecrypts,
+		MaxQueued:             spec.MaxQueued,
+		MaxRecvMsgSize:        spec.MaxRecvMsgSize,
+		MaxSendMsgSize:        spec.MaxSendMsgSize,
+	}
+	policy := plugin.Policy{
+		LogPayloads: logPayloads(spec),
+		PeerUIDs:    spec.PeerUIDs,
+	}
+	plug := try.To1(plugin.New(log, crypt, spec.UnixSocket, decryptCache, limits, policy))
 
-	httpSvr := setupHttpServer(log, []HealthComponent{NewHealthComponent(crypt, "tang_crypter")}, spec.HttpPort)
+	// The health checks go through the plugin to whichever crypter is current.
+	httpSvr := setupHttpServer(log, []HealthComponent{NewHealthComponent(plug, "tang_crypter")}, spec.HttpPort)
 
-	err := run(log, try.To1(plugin.New(log, crypt, spec.UnixSocket)), httpSvr)
+	err = run(&reloader{path: *configPath, spec: spec, log: log, plug: plug, limiter: limiter}, httpSvr, listeners)
 	if err != nil {
 		fmt.Printf("exited with error: %T %v\n", err, err)
 	}
 }
 
-func run(l logger.Logger, plug *plugin.Plugin, api *http.Server) error {
+// Listeners passed by systemd socket activation, or by the process we replace,
+// are used in place of the configured addresses.
+func run(r *reloader, api *http.Server, listeners map[string]net.Listener) error {
 	signalsCh := make(chan os.Signal, 1)
-	signal.Notify(signalsCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalsCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	changed := config.Watch(r.path, time.Duration(r.spec.ReloadInterval))
 
-	rpc, rpcErrorChannel := plug.ServeKMSRequests()
+	if listener, ok := listeners[activation.KMS]; ok {
+		r.plug.Listener = listener
+	}
+	rpc, rpcErrorChannel := r.plug.ServeKMSRequests()
 	if rpc != nil {
 		defer rpc.GracefulStop()
 	}
 
-	httpErrCh := startHttpServer(api)
+	tcpErrCh := make(chan error)
+	var tcpListener net.Listener
+	if r.spec.TcpAddress != "" {
+		config, err := mtls.ServerConfig(r.spec.TLSCertFile, r.spec.TLSKeyFile, r.spec.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		listener, ok := listeners[activation.TCP]
+		if !ok {
+			if listener, err = net.Listen("tcp", r.spec.TcpAddress); err != nil {
+				return err
+			}
+		}
+		var tcp *grpc.Server
+		tcp, tcpErrCh = r.plug.ServeTCP(listener, config, r.spec.TLSAllowedSubjects)
+		defer tcp.GracefulStop()
+		tcpListener = listener
+	}
+
+	httpListener, ok := listeners[activation.HTTP]
+	if !ok {
+		var err error
+		if httpListener, err = net.Listen("tcp", api.Addr); err != nil {
+			return err
+		}
+	}
+	httpErrCh := startHttpServer(api, httpListener)
 	defer stopHttpServer(api)
 
-	var err error
-	select {
-	case sig := <-signalsCh:
-		l.Msgf("captured %v, shutting down kms-plugin", sig)
-	case err = <-rpcErrorChannel:
-	case err = <-httpErrCh:
+	if err := r.confine(); err != nil {
+		return err
+	}
+	if rpc != nil {
+		r.log.Err(activation.Ready())
 	}
 
-	return err
+	for {
+		var reason string
+		select {
+		case sig := <-signalsCh:
+			if sig == syscall.SIGUSR2 {
+				pid, err := handoff(r.plug, httpListener, tcpListener)
+				if err != nil {
+					r.log.Err(fmt.Errorf("captured %v, keeping on serving: %w", sig, err))
+					continue
+				}
+				r.log.Msgf("captured %v, handed off to process %d, draining kms-plugin", sig, pid)
+				return nil
+			}
+			if sig != syscall.SIGHUP {
+				r.log.Msgf("captured %v, shutting down kms-plugin", sig)
+				return nil
+			}
+			reason = sig.String()
+		case <-changed:
+			reason = "config file changed"
+		case err := <-rpcErrorChannel:
+			return err
+		case err := <-httpErrCh:
+			return err
+		case err := <-tcpErrCh:
+			return err
+		}
+		if err := r.reload(); err != nil {
+			r.log.Err(fmt.Errorf("%s, keeping the running configuration: %w", reason, err))
+		} else {
+			r.log.MsgWithFields(map[string]interface{}{"thumbprint": r.spec.Thumbprint, "server_url": r.spec.ServerUrl, "backend": r.spec.Backend}, reason+", reloaded configuration")
+		}
+	}
 }
 
 func setupHttpServer(l logger.Logger, components []HealthComponent, httpPort string) *http.Server {
@@ -85,15 +240,17 @@ func setupHttpServer(l logger.Logger, components []HealthComponent, httpPort str
 	r := mux.NewRouter()
 	r.HandleFunc("/livez", healthAPI.Health)
 	r.HandleFunc("/readyz", healthAPI.Health)
+	r.Handle("/metrics", metrics.Handler())
+	r.HandleFunc("/version", api.Version(buildinfo.Read()))
 
 	return &http.Server{Addr: ":" + httpPort, Handler: r}
 }
 
-func startHttpServer(httpSvr *http.Server) chan error {
+func startHttpServer(httpSvr *http.Server, listener net.Listener) chan error {
 	httpErrCh := make(chan error, 1)
 	go func() {
-		if err := httpSvr.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			httpErrCh <- errors.Wrap(err, "http.ListenAndServe erred unexpectedly")
+		if err := httpSvr.Serve(listener); err != nil && err != http.ErrServerClosed {
+			httpErrCh <- errors.Wrap(err, "http.Serve erred unexpectedly")
 		}
 	}()
 	return httpErrCh
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/elliptic"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+func writeVector(dir string, name string, cipher []byte, plain []byte) (err error) {
+	defer err2.Return(&err)
+	err2.Check(ioutil.WriteFile(filepath.Join(dir, name+".jwe"), append(cipher, '\n'), 0644))
+	err2.Check(ioutil.WriteFile(filepath.Join(dir, name+".txt"), plain, 0644))
+	return nil
+}
+
+// Vectors from this project are encrypted by crypter.Crypter. The vectors
+// named clevis.go were encrypted by github.com/anatol/clevis.go before we
+// replaced it with our own decrypter. Vectors from `clevis encrypt` and
+// node/encrypt.js are made by generate.sh against a real tangd serving the
+// same key database.
+func generate(server *tangtest.Server, dir string, count int) (err error) {
+	defer err2.Return(&err)
+
+	encrypter := try.To1(crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.Policy{}))
+
+	existing := try.To1(filepath.Glob(filepath.Join(dir, "provider-*.jwe")))
+	for i := len(existing); i < len(existing)+count; i++ {
+		plain := append(tangtest.Plain(32+i), '\n')
+		err2.Check(writeVector(dir, fmt.Sprintf("provider-%03d", i), try.To1(encrypter.Encrypt(context.Background(), plain)), plain))
+	}
+	return nil
+}
+
+func run(dir string, create bool, rotate bool, count int, serve string) (err error) {
+	defer err2.Return(&err)
+
+	db := filepath.Join(dir, "db")
+	if create {
+		err2.Check(try.To1(tangtest.New(elliptic.P521())).Save(db))
+	}
+	server := try.To1(tangtest.Load(db))
+	if rotate {
+		err2.Check(server.Rotate(elliptic.P521()))
+		err2.Check(server.Save(db))
+	}
+	if serve != "" {
+		return http.ListenAndServe(serve, server)
+	}
+	return generate(server, dir, count)
+}
+
+func main() {
+	var (
+		dir      = flag.String("dir", "testdata/vectors", "directory of golden vectors with the tang key database in db")
+		create   = flag.Bool("create-db", false, "create a new tang key database")
+		rotate   = flag.Bool("rotate", false, "rotate the keys in the tang key database")
+		generate = flag.Int("generate", 0, "number of new vectors to generate from each source")
+		serve    = flag.String("serve", "", "serve the tang key database on this address, for generate.sh")
+	)
+	flag.Parse()
+	if err := run(*dir, *create, *rotate, *generate, *serve); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
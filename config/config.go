@@ -0,0 +1,348 @@
+// Package config loads the server's Specification from an optional YAML or
+// JSON file and the TANG_KMS_* environment variables, which override the file,
+// and validates all of it at once.
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"sigs.k8s.io/yaml"
+
+	"github.com/flatheadmill/tang-encryption-provider/allow"
+	"github.com/flatheadmill/tang-encryption-provider/mtls"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+)
+
+// Prefix of the environment variables, TANG_KMS_SERVER_URL and so on.
+const Prefix = "tang_kms"
+
+const (
+	EnvLocal = "local"
+	EnvDev   = "dev"
+	EnvProd  = "prod"
+)
+
+const (
+	BackendJwx    = "jwx"
+	BackendGoJose = "go-jose"
+)
+
+// Duration is a time.Duration written as in `5m` in files and the environment
+// alike.
+type Duration time.Duration
+
+func (d *Duration) Decode(value string) error {
+	duration, err := time.ParseDuration(value)
+	*d = Duration(duration)
+	return err
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	value, err := strconv.Unquote(string(data))
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"5m\", got %s", data)
+	}
+	return d.Decode(value)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(time.Duration(d).String())), nil
+}
+
+// Specification is the server's configuration. The keys of the file are the
+// names of the environment variables without the prefix, in lower case.
+type Specification struct {
+	ServerUrl  string `envconfig:"server_url" json:"server_url"`
+	Thumbprint string `json:"thumbprint"`
+	UnixSocket string `envconfig:"unix_socket" json:"unix_socket" default:"/var/run/kmsplugin/socket.sock"`
+	HttpPort   string `envconfig:"http_port" json:"http_port" default:"8081"`
+	Env        string `json:"env" default:"local"`
+	Backend    string `json:"backend" default:"jwx"`
+	// Decrypts are cached only when the size is greater than zero.
+	DecryptCacheSize int      `envconfig:"decrypt_cache_size" json:"decrypt_cache_size" default:"0"`
+	DecryptCacheTTL  Duration `envconfig:"decrypt_cache_ttl" json:"decrypt_cache_ttl" default:"5m"`
+	// Zero is unlimited, or gRPC's default for the message sizes.
+	MaxConcurrentEncrypts int `envconfig:"max_concurrent_encrypts" json:"max_concurrent_encrypts" default:"0"`
+	MaxConcurrentDecrypts int `envconfig:"max_concurrent_decrypts" json:"max_concurrent_decrypts" default:"0"`
+	MaxQueued             int `envconfig:"max_queued" json:"max_queued" default:"64"`
+	MaxRecvMsgSize        int `envconfig:"max_recv_msg_size" json:"max_recv_msg_size" default:"0"`
+	MaxSendMsgSize        int `envconfig:"max_send_msg_size" json:"max_send_msg_size" default:"0"`
+	// Requests a second to each Tang server, zero is unlimited.
+	TangRate  float64 `envconfig:"tang_rate" json:"tang_rate" default:"0"`
+	TangBurst int     `envconfig:"tang_burst" json:"tang_burst" default:"10"`
+	// How often the file is checked for changes to reload, zero to reload
+	// only on SIGHUP.
+	ReloadInterval Duration `envconfig:"reload_interval" json:"reload_interval" default:"10s"`
+	// Tang servers whose ciphertexts may be decrypted, any when empty. In
+	// the environment a comma separated list.
+	DecryptAllowlist []string `envconfig:"decrypt_allowlist" json:"decrypt_allowlist"`
+	// Users whose processes may connect to the socket, any when empty.
+	PeerUIDs []uint32 `envconfig:"peer_uids" json:"peer_uids"`
+	// Log the JWE of every call, for debugging.
+	LogPayloads bool `envconfig:"log_payloads" json:"log_payloads" default:"false"`
+	// Let the prod profile talk to Tang over plain HTTP.
+	AllowInsecureTang bool `envconfig:"allow_insecure_tang" json:"allow_insecure_tang" default:"false"`
+	// An optional TCP listener with mutual TLS, as in `:8443`, for clients
+	// other than the apiserver.
+	TcpAddress      string `envconfig:"tcp_address" json:"tcp_address"`
+	TLSCertFile     string `envconfig:"tls_cert_file" json:"tls_cert_file"`
+	TLSKeyFile      string `envconfig:"tls_key_file" json:"tls_key_file"`
+	TLSClientCAFile string `envconfig:"tls_client_ca_file" json:"tls_client_ca_file"`
+	// Common names or distinguished names of the clients allowed over TCP, any
+	// client with a certificate from the CA when empty.
+	TLSAllowedSubjects []string `envconfig:"tls_allowed_subjects" json:"tls_allowed_subjects"`
+	// Once the listeners are open switch to this user and group, zero stays,
+	// and drop every capability.
+	RunAsUID int `envconfig:"run_as_uid" json:"run_as_uid" default:"0"`
+	RunAsGID int `envconfig:"run_as_gid" json:"run_as_gid" default:"0"`
+	// Once the listeners are open restrict files to the socket directory and
+	// the connections to the ports of the Tang servers with Landlock.
+	Sandbox bool `envconfig:"sandbox" json:"sandbox" default:"false"`
+	// Lock all memory out of swap, and keep core dumps, which are disabled
+	// otherwise, for debugging.
+	LockMemory     bool `envconfig:"lock_memory" json:"lock_memory" default:"false"`
+	AllowCoreDumps bool `envconfig:"allow_core_dumps" json:"allow_core_dumps" default:"false"`
+	// The key management algorithm and content encryption of the JWEs we
+	// encrypt.
+	JWEAlg string `envconfig:"jwe_alg" json:"jwe_alg" default:"ECDH-ES"`
+	JWEEnc string `envconfig:"jwe_enc" json:"jwe_enc" default:"A256GCM"`
+	// The algorithms and encryptions of the JWEs we decrypt, any clevis
+	// produces when empty.
+	DecryptAlgs []string `envconfig:"decrypt_algs" json:"decrypt_algs"`
+	DecryptEncs []string `envconfig:"decrypt_encs" json:"decrypt_encs"`
+	// Use only FIPS approved cryptography: the NIST curves, AES-GCM and
+	// SHA-256 thumbprints, and refuse to start unless the known-answer
+	// self-tests pass.
+	FIPS bool `envconfig:"fips" json:"fips" default:"false"`
+}
+
+// Suite is what we encrypt with.
+func (s Specification) Suite() suite.Suite {
+	return suite.Suite{Alg: s.JWEAlg, Enc: s.JWEEnc}
+}
+
+// DecryptPolicy is what we decrypt, in FIPS mode only what suite.FIPS
+// accepts, which Validate checks decrypt_encs against.
+func (s Specification) DecryptPolicy() suite.Policy {
+	policy := suite.Policy{Algorithms: s.DecryptAlgs, Encryptions: s.DecryptEncs}
+	if s.FIPS {
+		if len(policy.Encryptions) == 0 {
+			policy.Encryptions = suite.FIPS.Encryptions
+		}
+		policy.Curves = suite.FIPS.Curves
+	}
+	return policy
+}
+
+// The name of the environment variable of a field, as envconfig names it.
+func envName(field reflect.StructField) string {
+	name := field.Tag.Get("envconfig")
+	if name == "" {
+		name = field.Name
+	}
+	return strings.ToUpper(Prefix + "_" + name)
+}
+
+// Load reads the defaults, then the file if path is not empty, then the
+// environment variables that are set. It does not validate.
+func Load(path string) (spec Specification, err error) {
+	// envconfig applies a default to every field whose variable is unset, so
+	// the file can not be read first. We read defaults and environment, let
+	// the file override them, then put back the variables that are set.
+	var env Specification
+	if err := envconfig.Process(Prefix, &env); err != nil {
+		return spec, err
+	}
+	spec = env
+	if path == "" {
+		return spec, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return spec, err
+	}
+	if err := yaml.UnmarshalStrict(data, &spec); err != nil {
+		return spec, fmt.Errorf("config file %s: %w", path, err)
+	}
+	fields, values := reflect.TypeOf(spec), reflect.ValueOf(&spec).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		if _, ok := os.LookupEnv(envName(fields.Field(i))); ok {
+			values.Field(i).Set(reflect.ValueOf(env).Field(i))
+		}
+	}
+	return spec, nil
+}
+
+// Changed returns the keys of the settings that differ between s and other.
+func (s Specification) Changed(other Specification) (keys []string) {
+	fields := reflect.TypeOf(s)
+	before, after := reflect.ValueOf(s), reflect.ValueOf(other)
+	for i := 0; i < fields.NumField(); i++ {
+		if !reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			keys = append(keys, strings.Split(fields.Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+	return keys
+}
+
+// ValidationError lists every problem found in a Specification.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate checks every setting and reports all the problems at once, as a
+// *ValidationError.
+func (s Specification) Validate() error {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if s.ServerUrl == "" {
+		problem("server_url is required")
+	} else if location, err := url.Parse(s.ServerUrl); err != nil {
+		problem("server_url %q: %v", s.ServerUrl, err)
+	} else if location.Scheme != "http" && location.Scheme != "https" || location.Host == "" {
+		problem("server_url %q must be an http or https URL with a host", s.ServerUrl)
+	}
+
+	// Tang thumbprints are SHA-256 by default, clevis also accepts the others.
+	if s.Thumbprint == "" {
+		problem("thumbprint is required")
+	} else if digest, err := base64.RawURLEncoding.DecodeString(s.Thumbprint); err != nil {
+		problem("thumbprint %q is not unpadded base64url: %v", s.Thumbprint, err)
+	} else if n := len(digest); n != 20 && n != 28 && n != 32 && n != 48 && n != 64 {
+		problem("thumbprint %q is %d bytes, not the length of a SHA digest", s.Thumbprint, n)
+	}
+
+	// @ names a socket in the Linux abstract namespace, there is no file.
+	switch {
+	case s.UnixSocket == "":
+		problem("unix_socket is required")
+	case len(s.UnixSocket) > 107:
+		problem("unix_socket %q is longer than the 107 bytes of a socket address", s.UnixSocket)
+	case strings.HasPrefix(s.UnixSocket, "@"):
+	case !filepath.IsAbs(s.UnixSocket):
+		problem("unix_socket %q must be an absolute path", s.UnixSocket)
+	default:
+		if info, err := os.Stat(filepath.Dir(s.UnixSocket)); err != nil {
+			problem("unix_socket directory: %v", err)
+		} else if !info.IsDir() {
+			problem("unix_socket directory %s is not a directory", filepath.Dir(s.UnixSocket))
+		}
+	}
+
+	if port, err := strconv.Atoi(s.HttpPort); err != nil || port < 1 || port > 65535 {
+		problem("http_port %q must be a port number", s.HttpPort)
+	}
+	if s.Env != EnvLocal && s.Env != EnvDev && s.Env != EnvProd {
+		problem("env %q must be one of %s, %s or %s", s.Env, EnvLocal, EnvDev, EnvProd)
+	}
+	if s.Backend != BackendJwx && s.Backend != BackendGoJose {
+		problem("backend %q must be %s or %s", s.Backend, BackendJwx, BackendGoJose)
+	}
+
+	if s.DecryptCacheSize < 0 {
+		problem("decrypt_cache_size %d must not be negative", s.DecryptCacheSize)
+	}
+	if s.DecryptCacheSize > 0 && s.DecryptCacheTTL <= 0 {
+		problem("decrypt_cache_ttl %v must be positive", time.Duration(s.DecryptCacheTTL))
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"max_concurrent_encrypts", s.MaxConcurrentEncrypts},
+		{"max_concurrent_decrypts", s.MaxConcurrentDecrypts},
+		{"max_queued", s.MaxQueued},
+		{"max_recv_msg_size", s.MaxRecvMsgSize},
+		{"max_send_msg_size", s.MaxSendMsgSize},
+	} {
+		if limit.value < 0 {
+			problem("%s %d must not be negative", limit.name, limit.value)
+		}
+	}
+	if s.TangRate < 0 {
+		problem("tang_rate %v must not be negative", s.TangRate)
+	}
+	if s.TangRate > 0 && s.TangBurst < 1 {
+		problem("tang_burst %d must be at least one", s.TangBurst)
+	}
+	if s.ReloadInterval < 0 {
+		problem("reload_interval %v must not be negative", time.Duration(s.ReloadInterval))
+	}
+	for _, allowed := range s.DecryptAllowlist {
+		if location, err := url.Parse(allowed); err != nil || location.Scheme != "http" && location.Scheme != "https" || location.Host == "" {
+			problem("decrypt_allowlist entry %q must be an http or https URL with a host", allowed)
+		}
+	}
+	if len(s.DecryptAllowlist) != 0 && !allow.List(s.DecryptAllowlist).Allows(s.ServerUrl) {
+		problem("server_url %q must be in decrypt_allowlist", s.ServerUrl)
+	}
+
+	if s.TcpAddress != "" {
+		if _, port, err := net.SplitHostPort(s.TcpAddress); err != nil {
+			problem("tcp_address %q: %v", s.TcpAddress, err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			problem("tcp_address %q must end with a port number", s.TcpAddress)
+		}
+		if s.TLSCertFile == "" || s.TLSKeyFile == "" || s.TLSClientCAFile == "" {
+			problem("tcp_address requires tls_cert_file, tls_key_file and tls_client_ca_file")
+		} else if _, err := mtls.ServerConfig(s.TLSCertFile, s.TLSKeyFile, s.TLSClientCAFile); err != nil {
+			problem("tcp_address: %v", err)
+		}
+	}
+
+	if err := s.Suite().Validate(); err != nil {
+		problem("jwe_alg and jwe_enc: %v", err)
+	}
+	if err := (suite.Policy{Algorithms: s.DecryptAlgs}).Validate(); err != nil {
+		problem("decrypt_algs: %v", err)
+	}
+	if err := (suite.Policy{Encryptions: s.DecryptEncs}).Validate(); err != nil {
+		problem("decrypt_encs: %v", err)
+	}
+	if s.FIPS {
+		if !suite.FIPS.Accepts(s.Suite()) {
+			problem("jwe_enc %q must be one of %v with fips", s.JWEEnc, suite.FIPS.Encryptions)
+		}
+		for _, enc := range s.DecryptEncs {
+			if suite.FIPS.CheckEnc(enc) != nil {
+				problem("decrypt_encs entry %q must be one of %v with fips", enc, suite.FIPS.Encryptions)
+			}
+		}
+		if digest, err := base64.RawURLEncoding.DecodeString(s.Thumbprint); err == nil && len(digest) != 0 && len(digest) != 32 {
+			problem("thumbprint %q must be a SHA-256 thumbprint with fips", s.Thumbprint)
+		}
+	}
+	if !s.DecryptPolicy().Accepts(s.Suite()) {
+		problem("decrypt_algs and decrypt_encs must accept jwe_alg %q with jwe_enc %q", s.JWEAlg, s.JWEEnc)
+	}
+
+	if s.RunAsUID < 0 {
+		problem("run_as_uid %d must not be negative", s.RunAsUID)
+	}
+	if s.RunAsGID < 0 {
+		problem("run_as_gid %d must not be negative", s.RunAsGID)
+	}
+
+	if len(problems) != 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+)
+
+// The file overrides the defaults and the environment variables that are set
+// override the file.
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		env      map[string]string
+		check    func(spec Specification) bool
+		err      string
+	}{{
+		name: "defaults",
+		check: func(spec Specification) bool {
+			return spec.HttpPort == "8081" && spec.Env == EnvLocal && spec.DecryptCacheTTL == Duration(5*time.Minute)
+		},
+	}, {
+		name:     "yaml",
+		file:     "config.yaml",
+		contents: "server_url: http://tang.file\nhttp_port: \"9000\"\ndecrypt_cache_ttl: 1m\n",
+		check: func(spec Specification) bool {
+			return spec.ServerUrl == "http://tang.file" && spec.HttpPort == "9000" && spec.DecryptCacheTTL == Duration(time.Minute) && spec.Env == EnvLocal
+		},
+	}, {
+		name:     "json",
+		file:     "config.json",
+		contents: `{"server_url": "http://tang.file", "max_queued": 8}`,
+		check: func(spec Specification) bool {
+			return spec.ServerUrl == "http://tang.file" && spec.MaxQueued == 8
+		},
+	}, {
+		name:     "environment over file",
+		file:     "config.yaml",
+		contents: "server_url: http://tang.file\nhttp_port: \"9000\"\n",
+		env:      map[string]string{"TANG_KMS_HTTP_PORT": "9100", "TANG_KMS_DECRYPT_CACHE_TTL": "2m"},
+		check: func(spec Specification) bool {
+			return spec.ServerUrl == "http://tang.file" && spec.HttpPort == "9100" && spec.DecryptCacheTTL == Duration(2*time.Minute)
+		},
+	}, {
+		name: "environment over defaults",
+		env:  map[string]string{"TANG_KMS_SERVER_URL": "http://tang.env"},
+		check: func(spec Specification) bool {
+			return spec.ServerUrl == "http://tang.env" && spec.HttpPort == "8081"
+		},
+	}, {
+		name:     "unknown key",
+		file:     "config.yaml",
+		contents: "server_uri: http://tang.file\n",
+		err:      `unknown field "server_uri"`,
+	}, {
+		name:     "bad duration",
+		file:     "config.yaml",
+		contents: "decrypt_cache_ttl: 300\n",
+		err:      "duration must be a string",
+	}, {
+		name: "missing file",
+		file: "missing.yaml",
+		err:  "no such file",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			path := ""
+			if test.file != "" {
+				path = filepath.Join(t.TempDir(), test.file)
+				if test.contents != "" {
+					if err := ioutil.WriteFile(path, []byte(test.contents), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			spec, err := Load(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(spec) {
+				t.Errorf("got %+v", spec)
+			}
+		})
+	}
+}
+
+func validSpecification() Specification {
+	spec, _ := Load("")
+	spec.ServerUrl = "http://tang.test"
+	spec.Thumbprint = base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+	spec.UnixSocket = "@kmsplugin"
+	return spec
+}
+
+// Every problem is reported at once.
+func TestValidate(t *testing.T) {
+	if err := validSpecification().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	spec := validSpecification()
+	spec.ServerUrl = "tang.test"
+	spec.Thumbprint = "not base64!"
+	spec.UnixSocket = "relative.sock"
+	spec.HttpPort = "http"
+	spec.Env = "staging"
+	spec.DecryptCacheSize = 8
+	spec.DecryptCacheTTL = 0
+	var invalid *ValidationError
+	if err := spec.Validate(); !errors.As(err, &invalid) {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+	settings := []string{"server_url", "thumbprint", "unix_socket", "http_port", "env", "decrypt_cache_ttl"}
+	if len(invalid.Problems) != len(settings) {
+		t.Errorf("got %d problems, want %d: %q", len(invalid.Problems), len(settings), invalid.Problems)
+	}
+	for i, setting := range settings {
+		if i < len(invalid.Problems) && !strings.HasPrefix(invalid.Problems[i], setting+" ") {
+			t.Errorf("problem %d is %q, want one with %s", i, invalid.Problems[i], setting)
+		}
+	}
+}
+
+func fipsSpecification() Specification {
+	return Specification{
+		ServerUrl:  "http://tang.test",
+		Thumbprint: base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+		UnixSocket: "@kmsplugin",
+		HttpPort:   "8081",
+		Env:        EnvLocal,
+		Backend:    BackendJwx,
+		FIPS:       true,
+		JWEAlg:     suite.ECDHES,
+		JWEEnc:     suite.A256GCM,
+	}
+}
+
+func TestValidateFIPS(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Specification)
+		setting string
+	}{{
+		name:   "valid",
+		modify: func(*Specification) {},
+	}, {
+		name:    "jwe_enc",
+		modify:  func(s *Specification) { s.JWEEnc = suite.A256CBCHS512 },
+		setting: "jwe_enc",
+	}, {
+		name:    "decrypt_encs",
+		modify:  func(s *Specification) { s.DecryptEncs = []string{suite.A256GCM, suite.A128CBCHS256} },
+		setting: "decrypt_encs",
+	}, {
+		name:    "SHA-1 thumbprint",
+		modify:  func(s *Specification) { s.Thumbprint = base64.RawURLEncoding.EncodeToString(make([]byte, 20)) },
+		setting: "thumbprint",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := fipsSpecification()
+			test.modify(&spec)
+			err := spec.Validate()
+			if test.setting == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("expected a *ValidationError, got %v", err)
+			}
+			found := false
+			for _, problem := range invalid.Problems {
+				found = found || strings.HasPrefix(problem, test.setting) && strings.HasSuffix(problem, "with fips")
+			}
+			if !found {
+				t.Errorf("%s is not refused with fips in %q", test.setting, invalid.Problems)
+			}
+			spec.FIPS = false
+			if err := spec.Validate(); err != nil {
+				t.Errorf("refused without fips: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecryptPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		fips   bool
+		encs   []string
+		policy suite.Policy
+	}{{
+		name:   "all",
+		policy: suite.Policy{},
+	}, {
+		name:   "fips",
+		fips:   true,
+		policy: suite.FIPS,
+	}, {
+		name:   "fips narrowed",
+		fips:   true,
+		encs:   []string{suite.A256GCM},
+		policy: suite.Policy{Encryptions: []string{suite.A256GCM}, Curves: suite.FIPS.Curves},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := Specification{FIPS: test.fips, DecryptEncs: test.encs}
+			if policy := spec.DecryptPolicy(); !reflect.DeepEqual(policy, test.policy) {
+				t.Fatalf("got %+v, want %+v", policy, test.policy)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Profile is the policy that comes with an env.
+type Profile struct {
+	Name string
+	// Log to the console in color rather than as JSON.
+	Console bool
+	// Talk to Tang over plain HTTP.
+	PlainHTTP bool
+	// Log the JWE of every call when log_payloads is set.
+	PayloadLogging bool
+	// Refuse to start without a decrypt_allowlist and peer_uids.
+	RequireAllowlist bool
+	RequirePeerUIDs  bool
+	// Refuse a TCP listener open to every client of the CA.
+	RequireSubjects bool
+	// Let allow_core_dumps write plain texts and keys to disk.
+	CoreDumps bool
+}
+
+var profiles = map[string]Profile{
+	EnvLocal: {Name: EnvLocal, Console: true, PlainHTTP: true, PayloadLogging: true, CoreDumps: true},
+	EnvDev:   {Name: EnvDev, PlainHTTP: true, PayloadLogging: true, CoreDumps: true},
+	EnvProd:  {Name: EnvProd, RequireAllowlist: true, RequirePeerUIDs: true, RequireSubjects: true},
+}
+
+// Profile returns the profile of the env, prod when the env is unknown, which
+// Validate reports.
+func (s Specification) Profile() Profile {
+	if profile, ok := profiles[s.Env]; ok {
+		return profile
+	}
+	return profiles[EnvProd]
+}
+
+// PolicyError lists the rules of a profile that a Specification violates.
+type PolicyError struct {
+	Profile    string
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("configuration violates the %s profile:\n  %s", e.Profile, strings.Join(e.Violations, "\n  "))
+}
+
+// Enforce checks the Specification against the rules of its profile and
+// reports every violation at once, as a *PolicyError.
+func (s Specification) Enforce() error {
+	profile := s.Profile()
+	var violations []string
+	violation := func(format string, a ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, a...))
+	}
+
+	if !profile.PlainHTTP && !s.AllowInsecureTang {
+		for _, location := range append([]string{s.ServerUrl}, s.DecryptAllowlist...) {
+			if parsed, err := url.Parse(location); err == nil && parsed.Scheme == "http" {
+				violation("plain HTTP Tang URL %q, use https or set allow_insecure_tang", location)
+			}
+		}
+	}
+	if !profile.PayloadLogging && s.LogPayloads {
+		violation("log_payloads must not be set")
+	}
+	if !profile.CoreDumps && s.AllowCoreDumps {
+		violation("allow_core_dumps must not be set")
+	}
+	if profile.RequireAllowlist && len(s.DecryptAllowlist) == 0 {
+		violation("decrypt_allowlist is required")
+	}
+	if profile.RequirePeerUIDs && len(s.PeerUIDs) == 0 {
+		violation("peer_uids is required")
+	}
+	if profile.RequireSubjects && s.TcpAddress != "" && len(s.TLSAllowedSubjects) == 0 {
+		violation("tls_allowed_subjects is required with tcp_address")
+	}
+
+	if len(violations) != 0 {
+		return &PolicyError{Profile: profile.Name, Violations: violations}
+	}
+	return nil
+}
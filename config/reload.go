@@ -0,0 +1,69 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// The settings a reload can change, the others are bound to listeners, the
+// profile, limits and caches that live as long as the process.
+var reloadable = map[string]bool{
+	"server_url":        true,
+	"thumbprint":        true,
+	"backend":           true,
+	"jwe_alg":           true,
+	"jwe_enc":           true,
+	"decrypt_algs":      true,
+	"decrypt_encs":      true,
+	"decrypt_allowlist": true,
+	"log_payloads":      true,
+}
+
+// CheckReload returns an error naming the settings that differ in next that
+// only a restart can change.
+func (s Specification) CheckReload(next Specification) error {
+	var fixed []string
+	for _, key := range s.Changed(next) {
+		if !reloadable[key] {
+			fixed = append(fixed, key)
+		}
+	}
+	if len(fixed) != 0 {
+		return fmt.Errorf("%s can only be changed by a restart", strings.Join(fixed, ", "))
+	}
+	return nil
+}
+
+// Watch signals changes to the contents of the file at path, checking every
+// interval. A file that can not be read is left for the reload to report.
+func Watch(path string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	if path == "" || interval <= 0 {
+		return changed
+	}
+	digest := func() []byte {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+	go func() {
+		last := digest()
+		for range time.Tick(interval) {
+			if current := digest(); !bytes.Equal(current, last) {
+				last = current
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckReload(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(spec *Specification)
+		err    string
+	}{{
+		name:   "unchanged",
+		change: func(spec *Specification) {},
+	}, {
+		name: "reloadable",
+		change: func(spec *Specification) {
+			spec.ServerUrl = "http://other.test"
+			spec.Backend = "go-jose"
+			spec.DecryptAllowlist = []string{"http://other.test"}
+			spec.LogPayloads = true
+		},
+	}, {
+		name:   "env",
+		change: func(spec *Specification) { spec.Env = "prod" },
+		err:    "env can only be changed by a restart",
+	}, {
+		name: "several",
+		change: func(spec *Specification) {
+			spec.Thumbprint = "other"
+			spec.HttpPort = "9090"
+			spec.DecryptCacheSize = 8
+		},
+		err: "http_port, decrypt_cache_size can only be changed by a restart",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := validSpecification()
+			test.change(&next)
+			err := validSpecification().CheckReload(next)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signaled := func(changed <-chan struct{}) bool {
+		select {
+		case <-changed:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+	write("env: dev\n")
+	changed := Watch(path, 5*time.Millisecond)
+	if signaled(changed) {
+		t.Fatal("signaled without a change")
+	}
+	write("env: prod\n")
+	if !signaled(changed) {
+		t.Fatal("no signal after a change")
+	}
+	write("env: prod\n")
+	if signaled(changed) {
+		t.Fatal("signaled when the contents are the same")
+	}
+	if signaled(Watch(path, 0)) {
+		t.Fatal("signaled with an interval of zero")
+	}
+}
@@ -0,0 +1,214 @@
+package corpus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/flatheadmill/tang-encryption-provider/envelope"
+)
+
+// Encoding records how a value was found so that a rewritten value can be
+// written back the same way.
+type Encoding int
+
+const (
+	// Raw values are compact JWEs or binary KMS envelope values as stored.
+	Raw Encoding = iota
+	// Base64 values are KMS envelope values in standard base64, the only way
+	// to put binary values on a line.
+	Base64
+)
+
+type Item struct {
+	Source   string
+	Value    []byte
+	Encoding Encoding
+	// Err is set when the value could not be read or decoded, Value is then
+	// what was read, if anything, as is.
+	Err error
+}
+
+func (i Item) Encode(value []byte) []byte {
+	if i.Encoding == Base64 {
+		return []byte(base64.StdEncoding.EncodeToString(value))
+	}
+	return value
+}
+
+// A compact JWE has five base64url parts and the protected header, a JSON
+// object, always encodes to a string beginning with `eyJ`.
+func isCompact(value []byte) bool {
+	if !bytes.HasPrefix(value, []byte("eyJ")) || bytes.Count(value, []byte(".")) != 4 {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Every base64 encoded KMS envelope value begins with the base64 of the
+// prefix, which is a multiple of three bytes long.
+var base64Prefix = []byte(base64.StdEncoding.EncodeToString([]byte(envelope.Prefix)))
+
+// looksLike reports whether a value is meant to be a ciphertext, decodable or
+// not: it has a JWE protected header and five parts, or the envelope prefix.
+func looksLike(value []byte) bool {
+	trimmed := bytes.TrimSpace(value)
+	return envelope.IsEnvelope(value) || bytes.HasPrefix(trimmed, base64Prefix) ||
+		bytes.HasPrefix(trimmed, []byte("eyJ")) && bytes.Count(trimmed, []byte(".")) == 4
+}
+
+// Decode accepts a compact JWE, a KMS envelope value or a base64 encoded KMS
+// envelope value.
+func Decode(source string, value []byte) (Item, error) {
+	trimmed := bytes.TrimSpace(value)
+	if envelope.IsEnvelope(value) {
+		return Item{Source: source, Value: value, Encoding: Raw}, nil
+	}
+	if isCompact(trimmed) {
+		return Item{Source: source, Value: trimmed, Encoding: Raw}, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil && envelope.IsEnvelope(decoded) {
+		return Item{Source: source, Value: decoded, Encoding: Base64}, nil
+	}
+	return Item{}, fmt.Errorf("not a compact JWE or KMS envelope value")
+}
+
+// Lines reads one value per line, skipping blank lines. A line that is not a
+// value is an item with an error, so there is an item for every line.
+func Lines(reader io.Reader, name string) (items []Item, err error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", name, number)
+		value := append([]byte(nil), line...)
+		item, err := Decode(source, value)
+		if err != nil {
+			item = Item{Source: source, Value: value, Err: err}
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// Files reads one value per file. A file that can not be read or is not a
+// value is an item with an error.
+func Files(paths []string) (items []Item) {
+	for _, path := range paths {
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			items = append(items, Item{Source: path, Err: err})
+			continue
+		}
+		item, err := Decode(path, value)
+		if err != nil {
+			item = Item{Source: path, Value: value, Err: err}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Directory reads every regular file below root as a single value, skipping
+// files that are not meant to be a compact JWE or a KMS envelope value. A
+// file that can not be read, or is meant to be a value and does not decode, is
+// an item with an error.
+func Directory(root string) (items []Item, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			items = append(items, Item{Source: path, Err: err})
+			return nil
+		}
+		if item, err := Decode(path, value); err == nil {
+			items = append(items, item)
+		} else if looksLike(value) {
+			items = append(items, Item{Source: path, Value: value, Err: err})
+		}
+		return nil
+	})
+	return items, err
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdExport struct {
+	KeyValues []etcdKeyValue `json:"kvs"`
+}
+
+// Etcd reads the output of `etcdctl get --prefix / -w json`, where keys and
+// values are base64 encoded, skipping values that are not KMS envelope values.
+func Etcd(reader io.Reader) (items []Item, err error) {
+	var export etcdExport
+	if err := json.NewDecoder(reader).Decode(&export); err != nil {
+		return nil, err
+	}
+	for _, kv := range export.KeyValues {
+		if envelope.IsEnvelope(kv.Value) {
+			items = append(items, Item{Source: string(kv.Key), Value: kv.Value, Encoding: Raw})
+		}
+	}
+	return items, nil
+}
+
+func collect(source string, value interface{}, items *[]Item) {
+	switch value := value.(type) {
+	case string:
+		if item, err := Decode(source, []byte(value)); err == nil {
+			*items = append(*items, item)
+		} else if looksLike([]byte(value)) {
+			*items = append(*items, Item{Source: source, Value: []byte(value), Err: err})
+		}
+	case []interface{}:
+		for _, element := range value {
+			collect(source, element, items)
+		}
+	case map[string]interface{}:
+		for _, element := range value {
+			collect(source, element, items)
+		}
+	}
+}
+
+// JSONL reads one JSON document per line and collects every string anywhere
+// in the document that is a compact JWE or a base64 encoded KMS envelope
+// value. A line that is not JSON, or a string that is meant to be a value and
+// does not decode, is an item with an error.
+func JSONL(reader io.Reader, name string) (items []Item, err error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var document interface{}
+		source := fmt.Sprintf("%s:%d", name, number)
+		if err := json.Unmarshal(line, &document); err != nil {
+			items = append(items, Item{Source: source, Value: append([]byte(nil), line...), Err: err})
+			continue
+		}
+		collect(source, document, &items)
+	}
+	return items, scanner.Err()
+}
@@ -0,0 +1,129 @@
+package corpus
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	jwe  = "eyJhbGciOiJFQ0RILUVTIn0..aXY.Y2lwaGVy.dGFn"
+	kms  = "k8s:enc:kms:v1:tang:\x00\x03jwedata"
+	junk = "not a ciphertext"
+)
+
+// Every line is an item, in order, so that output can follow input line for
+// line, and a line that is not a value is an item with an error.
+func TestLines(t *testing.T) {
+	input := strings.Join([]string{jwe, "", junk, base64.StdEncoding.EncodeToString([]byte(kms))}, "\n")
+	items, err := Lines(strings.NewReader(input), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source   string
+		value    string
+		encoding Encoding
+		failed   bool
+	}{
+		{"stdin:1", jwe, Raw, false},
+		{"stdin:3", junk, Raw, true},
+		{"stdin:4", kms, Base64, false},
+	}
+	if len(items) != len(tests) {
+		t.Fatalf("got %d items, want %d", len(items), len(tests))
+	}
+	for i, test := range tests {
+		item := items[i]
+		if item.Source != test.source || string(item.Value) != test.value || item.Encoding != test.encoding || (item.Err != nil) != test.failed {
+			t.Errorf("item %d is %s %q %d %v", i, item.Source, item.Value, item.Encoding, item.Err)
+		}
+	}
+}
+
+// A file that can not be read or decoded does not stop the others.
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, value string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	paths := []string{write("jwe", jwe+"\n"), write("junk", junk), filepath.Join(dir, "missing"), write("kms", kms)}
+	items := Files(paths)
+	failed := []bool{false, true, true, false}
+	if len(items) != len(paths) {
+		t.Fatalf("got %d items, want %d", len(items), len(paths))
+	}
+	for i, item := range items {
+		if item.Source != paths[i] || (item.Err != nil) != failed[i] {
+			t.Errorf("item %d is %s %v", i, item.Source, item.Err)
+		}
+	}
+}
+
+// Files that are not meant to be values are skipped, those that are and do
+// not decode are items with an error.
+func TestDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{
+		"jwe":       jwe,
+		"README":    junk,
+		"truncated": jwe[:strings.LastIndex(jwe, ".")] + ".dGFn!",
+		"kms":       base64.StdEncoding.EncodeToString([]byte(kms))[:30] + "!",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := Directory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := map[string]bool{}
+	for _, item := range items {
+		failed[filepath.Base(item.Source)] = item.Err != nil
+	}
+	want := map[string]bool{"jwe": false, "truncated": true, "kms": true}
+	if len(failed) != len(want) {
+		t.Fatalf("got items %v, want %v", failed, want)
+	}
+	for name, err := range want {
+		if got, ok := failed[name]; !ok || got != err {
+			t.Errorf("got items %v, want %v", failed, want)
+		}
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	input := strings.Join([]string{
+		`{"kind":"Secret","data":{"token":"` + jwe + `"}}`,
+		`{"kind":"Secret",`,
+		`{"values":["` + base64.StdEncoding.EncodeToString([]byte(kms)) + `","` + jwe + `!"]}`,
+	}, "\n")
+	items, err := JSONL(strings.NewReader(input), "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source string
+		failed bool
+	}{
+		{"export:1", false},
+		{"export:2", true},
+		{"export:3", false},
+		{"export:3", true},
+	}
+	if len(items) != len(tests) {
+		t.Fatalf("got %d items, want %d", len(items), len(tests))
+	}
+	for i, test := range tests {
+		if items[i].Source != test.source || (items[i].Err != nil) != test.failed {
+			t.Errorf("item %d is %s %v", i, items[i].Source, items[i].Err)
+		}
+	}
+}
@@ -2,37 +2,29 @@ package crypter
 
 import (
 	"context"
-	"crypto"
 	cryptoRand "crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"github.com/pkg/errors"
 	"math/rand"
-	"strings"
 	"time"
 
 	"encoding/base64"
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
 
-	"github.com/goware/urlx"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/try"
 
-	"github.com/anatol/clevis.go"
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwe"
 	"github.com/lestrrat-go/jwx/jwk"
-	"github.com/lestrrat-go/jwx/jws"
 
+	"github.com/flatheadmill/tang-encryption-provider/clevis"
 	"github.com/flatheadmill/tang-encryption-provider/handler"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
 )
 
-func encode64(buffer []byte) string {
-	return base64.RawURLEncoding.EncodeToString(buffer)
-}
-
 func decode64(encoded string) ([]byte, error) {
 	return base64.RawURLEncoding.DecodeString(encoded)
 }
@@ -49,77 +41,84 @@ type jsonClevis struct {
 
 type Crypter struct {
 	keyID       string
+	suite       suite.Suite
 	headers     jwe.Headers
 	exchangeKey jwk.Key
+	template    *template
+	decrypter   *clevis.Decrypter
 }
 
-func findKey(keySet jwk.Set, sought jwk.KeyOperation) (key jwk.Key, err error) {
-	defer err2.Handle(&err, handler.Handler(&err))
-	ctx := context.Background()
-	for iterator := keySet.Iterate(ctx); iterator.Next(ctx); {
-		key := iterator.Pair().Value.(jwk.Key)
-		for _, op := range key.KeyOps() {
-			if op == sought {
-				return key, nil
-			}
-		}
-	}
-	return nil, fmt.Errorf("key for operation %s not found", sought)
-}
-
-func NewCrypter(url string, thumbprint string) (crypter *Crypter, err error) {
+// NewCrypter encrypts with the suite to the exchange key of the thumbprint and
+// decrypts the JWEs the policy accepts, which must include its own. It talks to
+// Tang through the clients newClient creates, tang.NewClient when nil.
+func NewCrypter(newClient func(url string) (*tang.Client, error), url string, thumbprint string, encryption suite.Suite, policy suite.Policy) (crypter *Crypter, err error) {
 	defer err2.Handle(&err, handler.Handler(&err))
 
 	try.To1(decode64(thumbprint))
+	err2.Check(encryption.Validate())
+	err2.Check(policy.Validate())
+	if !policy.Accepts(encryption) {
+		return nil, fmt.Errorf("decrypt policy rejects %s with %s", encryption.Alg, encryption.Enc)
+	}
 
-	url = try.To1(urlx.Normalize(try.To1(urlx.Parse(strings.TrimSuffix(url, "/")))))
-	advGet := try.To1(http.Get(fmt.Sprintf("%s/adv/%s", url, thumbprint)))
-	defer advGet.Body.Close()
-
-	advJSON := try.To1(ioutil.ReadAll(advGet.Body))
-	//fmt.Printf("JSON: %s\n", advJSON)
-
-	message := try.To1(jws.Parse(advJSON))
-	keySet := try.To1(jwk.Parse(message.Payload()))
-	verifyKey := try.To1(findKey(keySet, jwk.KeyOpVerify))
-	if thumbprint != encode64(try.To1(verifyKey.Thumbprint(crypto.SHA256))) {
-		return nil, fmt.Errorf("unable to find key matching %v\n", thumbprint)
+	if newClient == nil {
+		newClient = tang.NewClient
 	}
-	try.To1(jws.Verify(advJSON, jwa.ES512, verifyKey))
+	client := try.To1(newClient(url))
+	advertisement := try.To1(client.Advertisement(context.Background(), thumbprint))
 
-	exchangeKey := try.To1(findKey(keySet, jwk.KeyOpDeriveKey))
-	err2.Check(exchangeKey.Set(jwk.KeyOpsKey, jwk.KeyOperationList{}))
-	err2.Check(exchangeKey.Set(jwk.AlgorithmKey, ""))
+	exchangeKey := try.To1(advertisement.ExchangeKey())
 
 	headers := jwe.NewHeaders()
 
-	err2.Check(headers.Set(jwe.KeyIDKey, encode64(try.To1(exchangeKey.Thumbprint(crypto.SHA256)))))
-	err2.Check(headers.Set(jwe.ContentEncryptionKey, jwa.A256GCM))
-	err2.Check(headers.Set(jwe.AlgorithmKey, jwa.ECDH_ES))
+	err2.Check(headers.Set(jwe.KeyIDKey, try.To1(tang.Thumbprint(exchangeKey))))
+	err2.Check(headers.Set(jwe.ContentEncryptionKey, jwa.ContentEncryptionAlgorithm(encryption.Enc)))
+	err2.Check(headers.Set(jwe.AlgorithmKey, jwa.KeyEncryptionAlgorithm(encryption.Alg)))
 
-	clevis := try.To1(json.Marshal(&jsonClevis{
+	pin := try.To1(json.Marshal(&jsonClevis{
 		Plugin: "tang",
 		Tang: jsonTang{
-			Location:      url,
-			Advertisement: message.Payload(),
+			Location:      client.URL,
+			Advertisement: advertisement.Payload,
 		},
 	}))
-	err2.Check(headers.Set("clevis", json.RawMessage(clevis)))
+	err2.Check(headers.Set("clevis", json.RawMessage(pin)))
+
+	template := try.To1(newTemplate(headers, exchangeKey, encryption))
+	err2.Check(policy.CheckCurve(template.crv))
 
 	return &Crypter{
 		keyID:       thumbprint,
+		suite:       encryption,
 		headers:     headers,
 		exchangeKey: exchangeKey,
+		template:    template,
+		decrypter:   &clevis.Decrypter{NewClient: newClient, Policy: policy},
 	}, nil
 }
 
-func (c *Crypter) Encrypt(plain []byte) (cipher []byte, err error) {
+// KeyID is the thumbprint of the Tang exchange key used by Encrypt, the kid of
+// every JWE we produce.
+func (c *Crypter) KeyID() string {
+	return c.headers.KeyID()
+}
+
+func (c *Crypter) Encrypt(ctx context.Context, plain []byte) (cipher []byte, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+	return try.To1(c.template.encrypt(plain)), nil
+}
+
+// EncryptJWE encrypts with jwe.Encrypt, serializing the whole header every
+// time. It is the reference Encrypt is checked against.
+func (c *Crypter) EncryptJWE(plain []byte) (cipher []byte, err error) {
 	defer err2.Handle(&err, handler.Handler(&err))
-	return try.To1(jwe.Encrypt(plain, jwa.ECDH_ES, c.exchangeKey, jwa.A256GCM, jwa.NoCompress, jwe.WithProtectedHeaders(c.headers))), nil
+	return try.To1(jwe.Encrypt(plain, jwa.KeyEncryptionAlgorithm(c.suite.Alg), c.exchangeKey, jwa.ContentEncryptionAlgorithm(c.suite.Enc), jwa.NoCompress, jwe.WithProtectedHeaders(c.headers))), nil
 }
 
-func (c *Crypter) Decrypt(cipher []byte) (plain []byte, err error) {
-	return Decrypt(cipher)
+func (c *Crypter) Decrypt(ctx context.Context, cipher []byte) (plain []byte, err error) {
+	plain, err = c.decrypter.Decrypt(ctx, cipher)
+	err = errors.Wrap(err, "failed to decrypt cipher")
+	return
 }
 
 func Decrypt(cipher []byte) (plain []byte, err error) {
@@ -130,12 +129,12 @@ func Decrypt(cipher []byte) (plain []byte, err error) {
 
 func (c Crypter) Health() error {
 	randomPlaintext := RandomHex(8)
-	cipher, err := c.Encrypt([]byte(randomPlaintext))
+	cipher, err := c.Encrypt(context.Background(), []byte(randomPlaintext))
 	if err != nil {
 		return errors.Wrap(err, "failed to encrypt random text")
 	}
 
-	decryptedText, err := c.Decrypt(cipher)
+	decryptedText, err := c.Decrypt(context.Background(), cipher)
 	if err != nil {
 		return errors.Wrap(err, "failed to decrypt random cipher text")
 	}
@@ -0,0 +1,134 @@
+package crypter
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"github.com/flatheadmill/tang-encryption-provider/clevis"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+)
+
+// Every JWE we encrypt has the same protected header but for the ephemeral
+// key, and most of the header is the advertisement in the `clevis` member.
+// The template holds the header split around the `epk` with as much of it
+// base64url encoded up front as ends on a whole encoding block, so each call
+// encodes only the tail of the prefix, the `epk` and the `kid`.
+//
+// The header is serialized by jwx, with the members sorted, `epk` sorting
+// before `kid`, exactly as jwe.Encrypt would serialize it. Decrypters that
+// re-serialize the header to compute the AAD rely on that.
+type template struct {
+	suite     suite.Suite
+	keySize   int
+	wrapSize  int
+	exchange  *ecdsa.PublicKey
+	crv       string
+	size      int
+	encoded   string
+	remainder []byte
+	suffix    []byte
+}
+
+func newTemplate(headers jwe.Headers, exchangeKey jwk.Key, encryption suite.Suite) (t *template, err error) {
+	defer err2.Return(&err)
+
+	exchange := &ecdsa.PublicKey{}
+	err2.Check(exchangeKey.Raw(exchange))
+
+	serialized := try.To1(headers.MarshalJSON())
+	split := bytes.LastIndex(serialized, []byte(`,"kid":`))
+	if split == -1 || bytes.Contains(serialized, []byte(`"epk":`)) {
+		return nil, fmt.Errorf("unexpected protected header %s", serialized)
+	}
+	prefix := append(append([]byte{}, serialized[:split]...), `,"epk":`...)
+	whole := len(prefix) - len(prefix)%3
+
+	return &template{
+		suite:     encryption,
+		keySize:   try.To1(suite.KeySize(encryption.Enc)),
+		wrapSize:  try.To1(suite.WrapSize(encryption.Alg)),
+		exchange:  exchange,
+		crv:       exchange.Curve.Params().Name,
+		size:      (exchange.Curve.Params().BitSize + 7) / 8,
+		encoded:   base64.RawURLEncoding.EncodeToString(prefix[:whole]),
+		remainder: prefix[whole:],
+		suffix:    serialized[split:],
+	}, nil
+}
+
+func (t *template) coordinate(buffer *bytes.Buffer, name string, value []byte) {
+	buffer.WriteString(`,"` + name + `":"`)
+	buffer.WriteString(base64.RawURLEncoding.EncodeToString(value))
+	buffer.WriteString(`"`)
+}
+
+// The protected header for an ephemeral key, base64url encoded.
+func (t *template) protected(ephemeral *ecdsa.PublicKey) string {
+	var tail bytes.Buffer
+	tail.Write(t.remainder)
+	tail.WriteString(`{"crv":"` + t.crv + `","kty":"EC"`)
+	t.coordinate(&tail, "x", ephemeral.X.FillBytes(make([]byte, t.size)))
+	t.coordinate(&tail, "y", ephemeral.Y.FillBytes(make([]byte, t.size)))
+	tail.WriteString(`}`)
+	tail.Write(t.suffix)
+	return t.encoded + base64.RawURLEncoding.EncodeToString(tail.Bytes())
+}
+
+// ECDH-ES with the exchange key and the Concat KDF, wrapping a random content
+// encryption key for ECDH-ES+A256KW, then the content encryption of the suite,
+// as jwe.Encrypt would do with the same header.
+func (t *template) encrypt(plain []byte) (compact []byte, err error) {
+	defer err2.Return(&err)
+
+	ephemeral := try.To1(ecdsa.GenerateKey(t.exchange.Curve, rand.Reader))
+	// The standard library's implementations of the NIST curves are constant
+	// time and faster than the generic ones in mcr.
+	scalar := ephemeral.D.Bytes()
+	z, _ := t.exchange.Curve.ScalarMult(t.exchange.X, t.exchange.Y, scalar)
+	shared := z.FillBytes(make([]byte, t.size))
+	defer secret.Wipe(scalar, shared)
+	defer secret.WipeInt(ephemeral.D, z)
+
+	var key, encrypted []byte
+	if t.wrapSize == 0 {
+		key = clevis.ConcatKDF(shared, t.suite.Enc, nil, nil, t.keySize)
+	} else {
+		kek := clevis.ConcatKDF(shared, t.suite.Alg, nil, nil, t.wrapSize)
+		defer secret.Wipe(kek)
+		key = make([]byte, t.keySize)
+		try.To1(rand.Read(key))
+		encrypted = try.To1(suite.WrapKey(kek, key))
+	}
+	defer secret.Wipe(key)
+
+	protected := t.protected(&ephemeral.PublicKey)
+
+	aead, tagSize := try.To2(suite.NewContentCipher(t.suite.Enc, key))
+	iv := make([]byte, aead.NonceSize())
+	try.To1(rand.Read(iv))
+	sealed := aead.Seal(nil, iv, plain, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-tagSize], sealed[len(sealed)-tagSize:]
+
+	var builder strings.Builder
+	builder.Grow(len(protected) + 4 + base64.RawURLEncoding.EncodedLen(len(encrypted)+len(iv)+len(sealed)) + 3)
+	builder.WriteString(protected)
+	builder.WriteString(".")
+	builder.WriteString(base64.RawURLEncoding.EncodeToString(encrypted))
+	builder.WriteString(".")
+	builder.WriteString(base64.RawURLEncoding.EncodeToString(iv))
+	builder.WriteString(".")
+	builder.WriteString(base64.RawURLEncoding.EncodeToString(ciphertext))
+	builder.WriteString(".")
+	builder.WriteString(base64.RawURLEncoding.EncodeToString(tag))
+	return []byte(builder.String()), nil
+}
@@ -0,0 +1,97 @@
+package crypter_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"encoding/base64"
+	"regexp"
+	"testing"
+
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+var epk = regexp.MustCompile(`"epk":\{[^}]*\}`)
+
+// The protected header without the ephemeral key, the only member that
+// differs from one JWE to the next.
+func header(t testing.TB, compact []byte) []byte {
+	t.Helper()
+	header, err := base64.RawURLEncoding.DecodeString(string(compact[:bytes.IndexByte(compact, '.')]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return epk.ReplaceAll(header, nil)
+}
+
+func newTemplateCrypter(t testing.TB, encryption suite.Suite) (*crypter.Crypter, *tangtest.Server) {
+	t.Helper()
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), encryption, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypter, server
+}
+
+// checkTemplate checks that Encrypt, which builds the protected header from a
+// template, produces the header jwe.Encrypt would have serialized but for
+// the ephemeral key, and that the JWE decrypts.
+func checkTemplate(t testing.TB, encrypter *crypter.Crypter, server *tangtest.Server, plain []byte) {
+	t.Helper()
+	fast, err := encrypter.Encrypt(context.Background(), plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// jwx can not encrypt or decrypt an empty plain text, the header does not
+	// depend on the plain text. The same goes for tangtest, which decrypts
+	// with jwx.
+	reference, err := encrypter.EncryptJWE(append(plain, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header(t, fast), header(t, reference); !bytes.Equal(got, want) {
+		t.Errorf("got header %s, want %s", got, want)
+	}
+	decrypters := map[string]func([]byte) ([]byte, error){
+		"crypter": func(cipher []byte) ([]byte, error) { return encrypter.Decrypt(context.Background(), cipher) },
+	}
+	if len(plain) != 0 {
+		decrypters["tangtest"] = server.Decrypt
+	}
+	for name, decrypt := range decrypters {
+		decrypted, err := decrypt(fast)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("%s: got %x, want %x", name, decrypted, plain)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	for _, encryption := range tangtest.Suites() {
+		t.Run(encryption.Alg+"/"+encryption.Enc, func(t *testing.T) {
+			encrypter, server := newTemplateCrypter(t, encryption)
+			for _, size := range []int{0, 1, 15, 16, 17, 4096} {
+				checkTemplate(t, encrypter, server, tangtest.Plain(size))
+			}
+		})
+	}
+}
+
+func FuzzTemplate(f *testing.F) {
+	encrypter, server := newTemplateCrypter(f, suite.Default)
+	for _, seed := range []string{"", "a", "0123456789abcdef", string(tangtest.Plain(64))} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, plain []byte) {
+		checkTemplate(t, encrypter, server, plain)
+	})
+}
@@ -0,0 +1,129 @@
+package crypter_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	gojose "github.com/flatheadmill/tang-encryption-provider/go-jose"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+const vectors = "../testdata/vectors"
+
+type vector struct {
+	name   string
+	cipher []byte
+	plain  []byte
+}
+
+func readVectors(t *testing.T, dir string) (vectors []vector) {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jwe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".jwe")
+		cipher, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := ioutil.ReadFile(filepath.Join(dir, name+".txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vectors = append(vectors, vector{name: name, cipher: bytes.TrimSpace(cipher), plain: plain})
+	}
+	return vectors
+}
+
+// Every golden vector, whoever encrypted it, and fresh ciphertexts from both
+// backends decrypt with both backends and with the private keys of the key
+// database.
+func TestVectors(t *testing.T) {
+	server, err := tangtest.Load(filepath.Join(vectors, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwx, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := gojose.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := readVectors(t, vectors)
+	found := func(source string) bool {
+		for _, vector := range golden {
+			if strings.HasPrefix(vector.name, source) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, source := range []string{"provider-", "clevis.go-", "clevis.go-sss-", "webcrypto-", "webcrypto-sss-", "webcrypto-apu-"} {
+		if !found(source) {
+			t.Errorf("no %s vectors in %s", source, vectors)
+		}
+	}
+	// Made by generate.sh where clevis and tangd are installed.
+	for _, source := range []string{"clevis-", "clevis-sss-", "node-"} {
+		if !found(source) {
+			t.Run(source, func(t *testing.T) {
+				t.Skipf("no %s vectors in %s", source, vectors)
+			})
+		}
+	}
+
+	fresh := golden
+	for name, encrypter := range map[string]interface {
+		Encrypt(ctx context.Context, plain []byte) ([]byte, error)
+	}{"jwx": jwx, "go-jose": native} {
+		for i := 0; i < 4; i++ {
+			plain := tangtest.Plain(16 << i)
+			cipher, err := encrypter.Encrypt(context.Background(), plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fresh = append(fresh, vector{name: fmt.Sprintf("fresh-%s-%d", name, i), cipher: cipher, plain: plain})
+		}
+	}
+
+	decrypters := []struct {
+		name    string
+		decrypt func(cipher []byte) ([]byte, error)
+		// Only the tang pin, not sss.
+		tangOnly bool
+	}{
+		{"jwx", func(cipher []byte) ([]byte, error) { return jwx.Decrypt(context.Background(), cipher) }, false},
+		{"go-jose", func(cipher []byte) ([]byte, error) { return native.Decrypt(context.Background(), cipher) }, false},
+		{"tangtest", server.Decrypt, true},
+	}
+	for _, vector := range fresh {
+		for _, decrypter := range decrypters {
+			if decrypter.tangOnly && strings.Contains(vector.name, "sss") {
+				continue
+			}
+			t.Run(vector.name+"/"+decrypter.name, func(t *testing.T) {
+				plain, err := decrypter.decrypt(vector.cipher)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plain, vector.plain) {
+					t.Errorf("got %q, want %q", plain, vector.plain)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+
+	"k8s.io/apiserver/pkg/storage/value"
+	aestransformer "k8s.io/apiserver/pkg/storage/value/encrypt/aes"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+// Prefix is prepended by the Kubernetes API server to every value it stores
+// in etcd through a KMS v1 provider. It is followed by the provider name and
+// a colon.
+const Prefix = "k8s:enc:kms:v1:"
+
+// Mode is the AES mode the apiserver used to encrypt the resource with the
+// DEK. KMS v1 has always used CBC, GCM is accepted for newer apiservers.
+type Mode string
+
+const (
+	CBC Mode = "cbc"
+	GCM Mode = "gcm"
+)
+
+// Envelope is a KMS v1 value as stored in etcd. Key is the encrypted DEK as
+// returned by the KMS plugin, in our case a compact clevis JWE, and Data is the
+// resource encrypted with the DEK.
+type Envelope struct {
+	Provider string
+	Key      []byte
+	Data     []byte
+}
+
+func IsEnvelope(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(Prefix))
+}
+
+func Parse(value []byte) (*Envelope, error) {
+	if !IsEnvelope(value) {
+		return nil, fmt.Errorf("value does not begin with %q", Prefix)
+	}
+	rest := value[len(Prefix):]
+	colon := bytes.IndexByte(rest, ':')
+	if colon == -1 {
+		return nil, fmt.Errorf("value is missing the KMS provider name")
+	}
+	provider, rest := string(rest[:colon]), rest[colon+1:]
+	// The apiserver writes the length of the encrypted DEK as a 16 bit
+	// big-endian integer before the DEK itself.
+	if len(rest) < 2 {
+		return nil, fmt.Errorf("value is missing the encrypted DEK length")
+	}
+	length := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < length {
+		return nil, fmt.Errorf("encrypted DEK length %d exceeds remaining %d bytes", length, len(rest))
+	}
+	return &Envelope{Provider: provider, Key: rest[:length], Data: rest[length:]}, nil
+}
+
+func (e *Envelope) Bytes() []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(Prefix)
+	buffer.WriteString(e.Provider)
+	buffer.WriteByte(':')
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(e.Key)))
+	buffer.Write(length)
+	buffer.Write(e.Key)
+	buffer.Write(e.Data)
+	return buffer.Bytes()
+}
+
+// Decrypt recovers the DEK with decrypt, usually crypter.Decrypt, and uses it to
+// decrypt the stored resource. The authenticated data is the etcd key of the
+// value and is only used by GCM. `etcdctl get --print-value-only` appends a
+// newline to the value, data that does not decrypt as is is decrypted again
+// without a trailing newline, in either mode. The DEK decrypt returns is wiped
+// once used.
+func (e *Envelope) Decrypt(decrypt func(cipher []byte) ([]byte, error), mode Mode, authenticatedData []byte) ([]byte, error) {
+	key, err := decrypt(e.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt DEK: %w", err)
+	}
+	// The AES key schedule is beyond our reach, the key is not.
+	defer secret.Wipe(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var transformer value.Transformer
+	switch mode {
+	case CBC:
+		transformer = aestransformer.NewCBCTransformer(block)
+	case GCM:
+		transformer = aestransformer.NewGCMTransformer(block)
+	default:
+		return nil, fmt.Errorf("unknown envelope mode %q", mode)
+	}
+	plain, _, err := transformer.TransformFromStorage(e.Data, value.DefaultContext(authenticatedData))
+	if err != nil && bytes.HasSuffix(e.Data, []byte("\n")) {
+		plain, _, err = transformer.TransformFromStorage(e.Data[:len(e.Data)-1], value.DefaultContext(authenticatedData))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt envelope data: %w", err)
+	}
+	return plain, nil
+}
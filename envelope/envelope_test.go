@@ -0,0 +1,111 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"testing"
+
+	"k8s.io/apiserver/pkg/storage/value"
+	aestransformer "k8s.io/apiserver/pkg/storage/value/encrypt/aes"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+var dek = bytes.Repeat([]byte{7}, 32)
+
+// seal encrypts plain as the apiserver would store it in etcd under etcdKey.
+func seal(t *testing.T, mode Mode, plain []byte, etcdKey string) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformer := aestransformer.NewCBCTransformer(block)
+	if mode == GCM {
+		transformer = aestransformer.NewGCMTransformer(block)
+	}
+	data, err := transformer.TransformToStorage(plain, value.DefaultContext([]byte(etcdKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return (&Envelope{Provider: "tang", Key: []byte("jwe"), Data: data}).Bytes()
+}
+
+// recoverDEK returns a copy of the DEK, which Decrypt wipes, in recovered.
+func recoverDEK(recovered *[]byte) func(cipher []byte) ([]byte, error) {
+	return func(cipher []byte) ([]byte, error) {
+		if string(cipher) != "jwe" {
+			return nil, fmt.Errorf("unexpected DEK ciphertext %q", cipher)
+		}
+		*recovered = append([]byte(nil), dek...)
+		return *recovered, nil
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	const etcdKey = "/registry/secrets/default/tang"
+	plain := []byte(`{"kind":"Secret"}`)
+	tests := []struct {
+		name    string
+		sealed  Mode
+		mode    Mode
+		suffix  string
+		etcdKey string
+		ok      bool
+	}{
+		{"cbc", CBC, CBC, "", etcdKey, true},
+		{"cbc etcdctl newline", CBC, CBC, "\n", etcdKey, true},
+		{"gcm", GCM, GCM, "", etcdKey, true},
+		{"gcm etcdctl newline", GCM, GCM, "\n", etcdKey, true},
+		{"gcm other etcd key", GCM, GCM, "", "/registry/secrets/default/other", false},
+		{"gcm two newlines", GCM, GCM, "\n\n", etcdKey, false},
+		{"gcm as cbc", GCM, CBC, "", etcdKey, false},
+		{"unknown mode", CBC, Mode("ctr"), "", etcdKey, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored := append(seal(t, test.sealed, plain, etcdKey), test.suffix...)
+			if !IsEnvelope(stored) {
+				t.Fatal("not an envelope")
+			}
+			parsed, err := Parse(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Provider != "tang" || string(parsed.Key) != "jwe" {
+				t.Fatalf("parsed provider %q and key %q", parsed.Provider, parsed.Key)
+			}
+			var recovered []byte
+			decrypted, err := parsed.Decrypt(recoverDEK(&recovered), test.mode, []byte(test.etcdKey))
+			if test.ok != (err == nil) {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if !secret.Wiped(recovered) {
+				t.Errorf("DEK %x was not wiped", recovered)
+			}
+			if test.ok && !bytes.Equal(decrypted, plain) {
+				t.Errorf("got %q, want %q", decrypted, plain)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"prefix", "k8s:enc:aescbc:v1:key1:data"},
+		{"provider", Prefix + "tang"},
+		{"length", Prefix + "tang:\x00"},
+		{"short key", Prefix + "tang:\x00\x05jwe"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse([]byte(test.value)); err == nil {
+				t.Errorf("parsed %q", test.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Package flight coalesces concurrent calls for the same ciphertext, so that
+// when the apiserver starts and decrypts the same DEK from many goroutines at
+// once only one of them costs a Tang recovery.
+package flight
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+type key [sha256.Size]byte
+
+type call struct {
+	digest key
+	ctx    *detached
+	done   chan struct{}
+	value  []byte
+	err    error
+	// Callers that joined the first, guarded by the group's mutex until the
+	// call is removed from the group.
+	joined int
+	// Callers that have not yet taken their copy of the value, and whether
+	// fn has returned, guarded by the group's mutex.
+	waiting  int
+	finished bool
+}
+
+// detached is the context of a call. It is done only once every caller has
+// given up and its deadline is the latest of the callers', none when a caller
+// has none, so that a call waiting on their behalf, for a token to send a Tang
+// request say, knows how long it has.
+type detached struct {
+	mutex     sync.Mutex
+	deadline  time.Time
+	unbounded bool
+	done      chan struct{}
+	err       error
+}
+
+func (d *detached) join(ctx context.Context) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		d.unbounded = true
+	} else if deadline.After(d.deadline) {
+		d.deadline = deadline
+	}
+}
+
+func (d *detached) cancel() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.err == nil {
+		d.err = context.Canceled
+		close(d.done)
+	}
+}
+
+func (d *detached) Deadline() (time.Time, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.unbounded {
+		return time.Time{}, false
+	}
+	return d.deadline, true
+}
+
+func (d *detached) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *detached) Err() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.err
+}
+
+func (d *detached) Value(key interface{}) interface{} {
+	return nil
+}
+
+// Group runs at most one call per ciphertext at a time. The zero Group is
+// ready to use.
+type Group struct {
+	mutex sync.Mutex
+	calls map[key]*call
+}
+
+// Do runs fn for the ciphertext unless a call for the same ciphertext is
+// already in flight, in which case it waits for that call's result. shared
+// reports whether the result was given to more than one caller. Each caller
+// gets a copy of the value, which is zeroed once the last caller has its copy,
+// so the caller owns the plain text and can zero it in turn.
+//
+// The call runs apart from any one caller, when the context of a caller is
+// done Do returns the context's error to that caller while the call carries on
+// for the others. fn is given a context with the latest deadline of the
+// callers, which is done when every caller has given up, and a caller that
+// comes after that starts a call of its own.
+func (g *Group) Do(ctx context.Context, cipher []byte, fn func(ctx context.Context) ([]byte, error)) (value []byte, shared bool, err error) {
+	digest := key(sha256.Sum256(cipher))
+
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = map[key]*call{}
+	}
+	c, ok := g.calls[digest]
+	if ok {
+		c.joined++
+		c.ctx.join(ctx)
+	} else {
+		c = &call{digest: digest, ctx: &detached{done: make(chan struct{})}, done: make(chan struct{})}
+		c.ctx.join(ctx)
+		g.calls[digest] = c
+		go g.run(c, fn)
+	}
+	c.waiting++
+	g.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		// The call was removed from the group before done was closed, no
+		// one joins it any more.
+		if c.err != nil {
+			g.leave(c)
+			return nil, c.joined != 0, c.err
+		}
+		value = append([]byte{}, c.value...)
+		g.leave(c)
+		return value, c.joined != 0, nil
+	case <-ctx.Done():
+		g.leave(c)
+		return nil, ok, ctx.Err()
+	}
+}
+
+// The last caller to leave a finished call zeroes its value, the last to leave
+// a call in flight cancels it.
+func (g *Group) leave(c *call) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	c.waiting--
+	if c.waiting != 0 {
+		return
+	}
+	if c.finished {
+		secret.Wipe(c.value)
+		return
+	}
+	if g.calls[c.digest] == c {
+		delete(g.calls, c.digest)
+	}
+	c.ctx.cancel()
+}
+
+func (g *Group) run(c *call, fn func(ctx context.Context) ([]byte, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("panic in coalesced call: %v", r)
+		}
+		g.mutex.Lock()
+		if g.calls[c.digest] == c {
+			delete(g.calls, c.digest)
+		}
+		c.finished = true
+		// Every caller gave up before fn returned.
+		if c.waiting == 0 {
+			secret.Wipe(c.value)
+		}
+		g.mutex.Unlock()
+		c.ctx.cancel()
+		close(c.done)
+	}()
+	c.value, c.err = fn(c.ctx)
+}
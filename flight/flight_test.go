@@ -0,0 +1,177 @@
+package flight
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+// The call has until the latest deadline of its callers, none if one of them
+// has none, and is canceled once they have all given up.
+func TestDoDeadline(t *testing.T) {
+	soon := time.Now().Add(time.Minute)
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		deadlines []time.Time
+		want      time.Time
+		bounded   bool
+	}{
+		{"leader", []time.Time{later, soon}, later, true},
+		{"joiner", []time.Time{soon, later}, later, true},
+		{"unbounded", []time.Time{soon, {}}, time.Time{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var group Group
+			started, release := make(chan struct{}), make(chan struct{})
+			deadlines := make(chan context.Context, 1)
+			fn := func(ctx context.Context) ([]byte, error) {
+				close(started)
+				<-release
+				deadlines <- ctx
+				return []byte("plain"), nil
+			}
+			done := make(chan error, len(test.deadlines))
+			for i, deadline := range test.deadlines {
+				ctx, cancel := context.Background(), context.CancelFunc(func() {})
+				if !deadline.IsZero() {
+					ctx, cancel = context.WithDeadline(ctx, deadline)
+				}
+				defer cancel()
+				go func() {
+					_, _, err := group.Do(ctx, []byte("cipher"), fn)
+					done <- err
+				}()
+				if i == 0 {
+					<-started
+				}
+			}
+			// Wait for the joiner to join.
+			for {
+				group.mutex.Lock()
+				waiting := 0
+				for _, c := range group.calls {
+					waiting = c.waiting
+				}
+				group.mutex.Unlock()
+				if waiting == len(test.deadlines) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+			ctx := <-deadlines
+			deadline, bounded := ctx.Deadline()
+			if bounded != test.bounded || !deadline.Equal(test.want) {
+				t.Errorf("got deadline %v %v, want %v %v", deadline, bounded, test.want, test.bounded)
+			}
+			for range test.deadlines {
+				if err := <-done; err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	var group Group
+	canceled := make(chan error, 1)
+	fn := func(ctx context.Context) ([]byte, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := group.Do(ctx, []byte("cipher"), fn); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("call got %v, want %v", err, context.Canceled)
+	}
+	value, _, err := group.Do(context.Background(), []byte("cipher"), func(ctx context.Context) ([]byte, error) {
+		return []byte("fresh"), ctx.Err()
+	})
+	if err != nil || string(value) != "fresh" {
+		t.Errorf("a caller after the cancel got %q %v", value, err)
+	}
+}
+
+// Each caller gets its own copy of the value, which is zeroed once the last
+// caller has its copy or, if every caller gave up, once fn returns.
+func TestDoWipe(t *testing.T) {
+	t.Run("shared", func(t *testing.T) {
+		var group Group
+		value := []byte("plain")
+		release := make(chan struct{})
+		fn := func(ctx context.Context) ([]byte, error) {
+			<-release
+			return value, nil
+		}
+		results := make(chan []byte, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				plain, _, err := group.Do(context.Background(), []byte("cipher"), fn)
+				if err != nil {
+					t.Error(err)
+				}
+				results <- plain
+			}()
+		}
+		for {
+			group.mutex.Lock()
+			waiting := 0
+			for _, c := range group.calls {
+				waiting = c.waiting
+			}
+			group.mutex.Unlock()
+			if waiting == 2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		first, second := <-results, <-results
+		if string(first) != "plain" || string(second) != "plain" {
+			t.Errorf("got %q and %q", first, second)
+		}
+		if &first[0] == &second[0] {
+			t.Errorf("callers share a copy")
+		}
+		if !secret.Wiped(value) {
+			t.Errorf("value left in memory: %q", value)
+		}
+	})
+	t.Run("abandoned", func(t *testing.T) {
+		var group Group
+		value := []byte("plain")
+		returned := make(chan struct{})
+		fn := func(ctx context.Context) ([]byte, error) {
+			<-ctx.Done()
+			defer close(returned)
+			return value, nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := group.Do(ctx, []byte("cipher"), fn); err != context.Canceled {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+		<-returned
+		// run zeroes the value after fn returns.
+		for wait := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			group.mutex.Lock()
+			wiped := len(group.calls) == 0 && secret.Wiped(value)
+			group.mutex.Unlock()
+			if wiped {
+				break
+			}
+			if time.Now().After(wait) {
+				t.Fatalf("value left in memory: %q", value)
+			}
+		}
+	})
+}
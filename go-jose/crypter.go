@@ -2,28 +2,31 @@ package crypter
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"fmt"
 	"strings"
 
 	"crypto/aes"
-	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
-	"io/ioutil"
-	"math/big"
-	"net/http"
 
-	"github.com/goware/urlx"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/try"
 
+	"github.com/lestrrat-go/jwx/jwk"
+
 	jose "github.com/flatheadmill/go-jose/v3"
 	jcipher "github.com/flatheadmill/go-jose/v3/cipher"
+
+	"github.com/flatheadmill/tang-encryption-provider/mcr"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
 )
 
 func encode64(buffer []byte) string {
@@ -42,79 +45,158 @@ type jsonTang struct {
 type jsonClevis struct {
 	Plugin string   `json:"pin"`
 	Tang   jsonTang `json:"tang"`
+	SSS    *jsonSSS `json:"sss,omitempty"`
 }
 
 type Crypter struct {
-	recipient        jose.Recipient
-	crypter          *Crypter2
-	encrypterOptions jose.EncrypterOptions
+	// newClient creates the client for the Tang server named in a JWE.
+	newClient func(url string) (*tang.Client, error)
+	keyID     string
+	suite     suite.Suite
+	policy    suite.Policy
+	exchange  *ecdsa.PublicKey
+	clevis    json.RawMessage
 }
 
-func NewCrypter(url string, fingerprint string) (crypter Crypter, err error) {
+func findKey(keySet jose.JSONWebKeySet, sought string) (*jose.JSONWebKey, error) {
+	for i := range keySet.Keys {
+		for _, op := range keySet.Keys[i].KeyOps {
+			if op == sought {
+				return &keySet.Keys[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("key for operation %s not found", sought)
+}
+
+// NewCrypter encrypts with the suite to the exchange key of the fingerprint
+// and decrypts the JWEs the policy accepts, which must include its own. It
+// talks to Tang through the clients newClient creates, tang.NewClient when nil.
+func NewCrypter(newClient func(url string) (*tang.Client, error), url string, fingerprint string, encryption suite.Suite, policy suite.Policy) (crypter *Crypter, err error) {
 	defer err2.Return(&err)
 
 	try.To1(base64Decode(fingerprint))
+	err2.Check(encryption.Validate())
+	err2.Check(policy.Validate())
+	if !policy.Accepts(encryption) {
+		return nil, fmt.Errorf("decrypt policy rejects %s with %s", encryption.Alg, encryption.Enc)
+	}
 
-	url = try.To1(urlx.Normalize(try.To1(urlx.Parse(strings.TrimSuffix(url, "/")))))
-	advGet := try.To1(http.Get(fmt.Sprintf("%s/adv/%s", url, fingerprint)))
-	defer advGet.Body.Close()
-
-	advJSON := try.To1(ioutil.ReadAll(advGet.Body))
-
-	crypter2 := try.To1(NewCrypter2(advJSON, fingerprint))
-
-	var adv map[string]interface{}
-	err2.Check(json.Unmarshal(advJSON, &adv))
-
-	payload, err := base64.RawURLEncoding.DecodeString(adv["payload"].(string))
-	err2.Check(err)
-
-	// TODO Missing verification. Just want to get it into an object for now.
+	if newClient == nil {
+		newClient = tang.NewClient
+	}
+	client := try.To1(newClient(url))
+	advertisement := try.To1(client.Advertisement(context.Background(), fingerprint))
 
 	var keySet jose.JSONWebKeySet
-	err = json.Unmarshal(payload, &keySet)
-	err2.Check(err)
-
-	var deriver *jose.JSONWebKey
-Keys:
-	for _, key := range keySet.Keys {
-		for _, op := range key.KeyOps {
-			if op == "deriveKey" {
-				deriver = &key
-				break Keys
-			}
-		}
-	}
+	err2.Check(json.Unmarshal(advertisement.Payload, &keySet))
+
+	deriver := *try.To1(findKey(keySet, "deriveKey"))
 	deriver.Algorithm = ""
 	deriver.KeyOps = nil
+	exchange, ok := deriver.Key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("exchange key is not an EC key")
+	}
 
-	extraHeaders := make(map[jose.HeaderKey]interface{})
+	err2.Check(policy.CheckCurve(exchange.Curve.Params().Name))
 
-	extraHeaders["clevis"] = jsonClevis{
+	clevis := try.To1(json.Marshal(jsonClevis{
 		Plugin: "tang",
 		Tang: jsonTang{
-			Location:      url,
+			Location:      client.URL,
 			Advertisement: keySet,
 		},
+	}))
+
+	return &Crypter{
+		newClient: newClient,
+		keyID:     encode64(try.To1(deriver.Thumbprint(crypto.SHA256))),
+		suite:     encryption,
+		policy:    policy,
+		exchange:  exchange,
+		clevis:    clevis,
+	}, nil
+}
+
+// Decrypters that re-serialize the protected header to compute the AAD, as
+// clevis.go does through jwx, fail unless our header is serialized exactly as
+// they would, with sorted keys, so we build it ourselves rather than letting
+// jose.NewEncrypter put the epk members in struct order.
+func sorted(value interface{}) (sorted json.RawMessage, err error) {
+	defer err2.Return(&err)
+	var tree map[string]interface{}
+	err2.Check(json.Unmarshal(try.To1(json.Marshal(value)), &tree))
+	return json.Marshal(tree)
+}
+
+func (c *Crypter) Encrypt(ctx context.Context, plain []byte) (compact []byte, err error) {
+	defer err2.Return(&err)
+
+	ephemeral := try.To1(ecdsa.GenerateKey(c.exchange.Curve, rand.Reader))
+
+	header := try.To1(json.Marshal(map[string]interface{}{
+		"alg":    c.suite.Alg,
+		"enc":    c.suite.Enc,
+		"kid":    c.keyID,
+		"clevis": c.clevis,
+		"epk":    try.To1(sorted(&jose.JSONWebKey{Key: &ephemeral.PublicKey})),
+	}))
+	protected := encode64(header)
+
+	// DeriveECDHES of go-jose leaves the shared secret in memory, ours wipes
+	// it, the shared point we wipe here.
+	scalar := ephemeral.D.Bytes()
+	x, y := c.exchange.Curve.ScalarMult(c.exchange.X, c.exchange.Y, scalar)
+	defer secret.Wipe(scalar)
+	defer secret.WipeInt(ephemeral.D, x, y)
+	shared := &ecdsa.PublicKey{Curve: c.exchange.Curve, X: x, Y: y}
+
+	size := try.To1(suite.KeySize(c.suite.Enc))
+	wrapSize := try.To1(suite.WrapSize(c.suite.Alg))
+	var key, encrypted []byte
+	if wrapSize == 0 {
+		key = DeriveECDHES(c.suite.Enc, []byte{}, []byte{}, shared, size)
+	} else {
+		kek := DeriveECDHES(c.suite.Alg, []byte{}, []byte{}, shared, wrapSize)
+		defer secret.Wipe(kek)
+		key = make([]byte, size)
+		try.To1(rand.Read(key))
+		encrypted = try.To1(jcipher.KeyWrap(try.To1(aes.NewCipher(kek)), key))
 	}
+	defer secret.Wipe(key)
+	aead, tagSize := try.To2(suite.NewContentCipher(c.suite.Enc, key))
 
-	thumbprint, err := deriver.Thumbprint(crypto.SHA256)
-	err2.Check(err)
-	extraHeaders["kid"] = base64.RawURLEncoding.EncodeToString(thumbprint)
+	iv := make([]byte, aead.NonceSize())
+	try.To1(rand.Read(iv))
 
-	return Crypter{
-		encrypterOptions: jose.EncrypterOptions{ExtraHeaders: extraHeaders},
-		recipient:        jose.Recipient{Algorithm: jose.ECDH_ES, Key: deriver.Key},
-		crypter:          crypter2,
-	}, nil
+	sealed := aead.Seal(nil, iv, plain, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-tagSize], sealed[len(sealed)-tagSize:]
+
+	return []byte(strings.Join([]string{protected, encode64(encrypted), encode64(iv), encode64(ciphertext), encode64(tag)}, ".")), nil
 }
 
-func (c *Crypter) Encrypt(plain []byte) (compact string, err error) {
-	defer err2.Return(&err)
-	encrypter := try.To1(jose.NewEncrypter(jose.A256GCM, c.recipient, &c.encrypterOptions))
-	cipher := try.To1(encrypter.Encrypt(plain))
-	compact = try.To1(cipher.CompactSerialize())
-	return compact, nil
+func (c *Crypter) Decrypt(ctx context.Context, cipher []byte) (plain []byte, err error) {
+	return decrypt(ctx, cipher, c.newClient, c.policy, 0)
+}
+
+func (c *Crypter) Health() error {
+	randomPlaintext := make([]byte, 8)
+	if _, err := rand.Read(randomPlaintext); err != nil {
+		return err
+	}
+	cipher, err := c.Encrypt(context.Background(), randomPlaintext)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt random text: %w", err)
+	}
+	decrypted, err := c.Decrypt(context.Background(), cipher)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt random cipher text: %w", err)
+	}
+	if !bytes.Equal(randomPlaintext, decrypted) {
+		return fmt.Errorf("decrypted text does not equal input random text")
+	}
+	return nil
 }
 
 func dSize(curve elliptic.Curve) int {
@@ -152,16 +234,13 @@ func DeriveECDHES(alg string, apuData, apvData []byte, pub *ecdsa.PublicKey, siz
 	supPubInfo := make([]byte, 4)
 	binary.BigEndian.PutUint32(supPubInfo, uint32(size)*8)
 
-	zBytes := pub.X.Bytes()
-
 	// Note that calling z.Bytes() on a big.Int may strip leading zero bytes from
 	// the returned byte array. This can lead to a problem where zBytes will be
 	// shorter than expected which breaks the key derivation. Therefore we must pad
 	// to the full length of the expected coordinate here before calling the KDF.
-	octSize := dSize(pub.Curve)
-	if len(zBytes) != octSize {
-		zBytes = append(bytes.Repeat([]byte{0}, octSize-len(zBytes)), zBytes...)
-	}
+	// FillBytes pads in place, so there is only the one copy to wipe.
+	zBytes := pub.X.FillBytes(make([]byte, dSize(pub.Curve)))
+	defer secret.Wipe(zBytes)
 
 	reader := jcipher.NewConcatKDF(crypto.SHA256, zBytes, algID, ptyUInfo, ptyVInfo, supPubInfo, []byte{})
 	key := make([]byte, size)
@@ -176,96 +255,126 @@ type jsonProtected struct {
 	KeyIdentifier      string          `json:"kid"`
 	Algorithm          string          `json:"alg"`
 	Encryption         string          `json:"enc"`
+	PartyU             string          `json:"apu"`
+	PartyV             string          `json:"apv"`
 	Clevis             jsonClevis      `json:"clevis"`
 	EphemeralPublicKey jose.JSONWebKey `json:"epk"`
 }
 
-func Decrypt(jwe []byte) ([]byte, error) {
+// Decrypt decrypts a JWE of the tang pin, or of sss pins over tang pins, of
+// any alg and enc we support.
+func Decrypt(jwe []byte) (plain []byte, err error) {
+	return decrypt(context.Background(), jwe, tang.NewClient, suite.Policy{}, 0)
+}
+
+func decrypt(ctx context.Context, jwe []byte, newClient func(url string) (*tang.Client, error), policy suite.Policy, depth int) (plain []byte, err error) {
+	defer err2.Return(&err)
+
+	if depth > maxDepth {
+		return nil, fmt.Errorf("sss pins nested deeper than %d", maxDepth)
+	}
+
 	// Had a go at using jose.ParseEncryption but it returns the `ExtraHeaders`
 	// as a tree of interfaces so you have to conert them either by serializing
 	// and deserialing the JSON or using something like `mapstructure`.
 	//
 	// https://github.com/mitchellh/mapstructure
+	parts := strings.Split(string(bytes.TrimSpace(jwe)), ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("compact JWE format must have five parts")
+	}
 
-	//
-	dot := bytes.IndexByte(jwe, byte('.'))
-	header, err := base64.RawURLEncoding.DecodeString(string(jwe[0:dot]))
 	protected := jsonProtected{}
-
-	err = json.Unmarshal(header, &protected)
-	err2.Check(err)
-
-	var remote *ecdsa.PublicKey
-	for _, key := range protected.Clevis.Tang.Advertisement.Keys {
-		thumbprint, err := key.Thumbprint(crypto.SHA256)
-		if err != nil {
-			panic(err)
-		}
-		if protected.KeyIdentifier == base64.RawURLEncoding.EncodeToString(thumbprint) {
-			remote = key.Key.(*ecdsa.PublicKey)
-			break
+	err2.Check(json.Unmarshal(try.To1(base64Decode(parts[0])), &protected))
+	size := try.To1(suite.KeySize(protected.Encryption))
+	err2.Check(policy.CheckEnc(protected.Encryption))
+	encrypted := try.To1(base64Decode(parts[1]))
+
+	var key []byte
+	switch protected.Clevis.Plugin {
+	case "tang":
+		key = try.To1(recoverTang(ctx, &protected, encrypted, newClient, policy, size))
+	case "sss":
+		if protected.Algorithm != "dir" || len(encrypted) != 0 {
+			return nil, fmt.Errorf("sss pin with %s and an encrypted key of %d bytes", protected.Algorithm, len(encrypted))
 		}
+		key = try.To1(combine(ctx, protected.Clevis.SSS, func(ctx context.Context, share []byte) ([]byte, error) {
+			return decrypt(ctx, share, newClient, policy, depth+1)
+		}))
+	default:
+		return nil, fmt.Errorf("unsupported pin %q", protected.Clevis.Plugin)
+	}
+	defer secret.Wipe(key)
+	if len(key) != size {
+		return nil, fmt.Errorf("recovered key is %d bytes, %s needs %d", len(key), protected.Encryption, size)
 	}
 
-	ephemeral, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
-	err2.Check(err)
-
-	client := protected.EphemeralPublicKey.Key.(*ecdsa.PublicKey)
-	x, y := elliptic.P521().Add(client.X, client.Y, ephemeral.X, ephemeral.Y)
-	ecmr := jose.JSONWebKey{Key: &ecdsa.PublicKey{Curve: elliptic.P521(), X: x, Y: y}}
-	ecmrJSON, err := json.Marshal(&ecmr)
-	err2.Check(err)
-
-	url := protected.Clevis.Tang.Location + "/rec/" + protected.KeyIdentifier
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(ecmrJSON))
-	req.Header.Set("Content-Type", "application/jwk+json")
-
-	agent := &http.Client{}
-	post, err := agent.Do(req)
-	err2.Check(err)
-	defer post.Body.Close()
-
-	body, err := ioutil.ReadAll(post.Body)
-	err2.Check(err)
+	iv := try.To1(base64Decode(parts[2]))
+	ciphertext := try.To1(base64Decode(parts[3]))
+	tag := try.To1(base64Decode(parts[4]))
 
-	var response jose.JSONWebKey
-	err = json.Unmarshal(body, &response)
-	err2.Check(err)
+	aead, tagSize := try.To2(suite.NewContentCipher(protected.Encryption, key))
+	if len(iv) != aead.NonceSize() || len(tag) != tagSize {
+		return nil, fmt.Errorf("iv or tag has the wrong length")
+	}
 
-	// Calling big.Int.Bytes() strips leading zeros, so this could be a problem,
-	// but the `D` value of `spec521r1` does not have any leading zeros.
-	x, y = elliptic.P521().ScalarMult(remote.X, remote.Y, ephemeral.D.Bytes())
+	return try.To1(aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))), nil
+}
 
-	negY := new(big.Int)
-	negY.Sub(elliptic.P521().Params().P, y)
-	x, y = elliptic.P521().Add(response.Key.(*ecdsa.PublicKey).X, response.Key.(*ecdsa.PublicKey).Y, x, negY)
+// The tang pin encrypts with ECDH-ES to the exchange key named by the kid, we
+// recover the shared secret with the McCallum-Relyea exchange and derive the
+// content encryption key, or the key that unwraps it, from it.
+func recoverTang(ctx context.Context, protected *jsonProtected, encrypted []byte, newClient func(url string) (*tang.Client, error), policy suite.Policy, size int) (key []byte, err error) {
+	defer err2.Return(&err)
 
-	recovered := jose.JSONWebKey{Key: &ecdsa.PublicKey{Curve: elliptic.P521(), X: x, Y: y}}
+	wrapSize := try.To1(suite.WrapSize(protected.Algorithm))
+	err2.Check(policy.CheckAlg(protected.Algorithm))
+	if (wrapSize == 0) != (len(encrypted) == 0) {
+		return nil, fmt.Errorf("%s with an encrypted key of %d bytes", protected.Algorithm, len(encrypted))
+	}
 
-	key := DeriveECDHES(protected.Encryption, []byte{}, []byte{}, recovered.Key.(*ecdsa.PublicKey), 32)
+	var remote *ecdsa.PublicKey
+	for _, key := range protected.Clevis.Tang.Advertisement.Keys {
+		thumbprint := try.To1(key.Thumbprint(crypto.SHA256))
+		if protected.KeyIdentifier == encode64(thumbprint) {
+			remote, _ = key.Key.(*ecdsa.PublicKey)
+			break
+		}
+	}
+	if remote == nil {
+		return nil, fmt.Errorf("exchange key %s not found in advertisement", protected.KeyIdentifier)
+	}
 
-	parts := strings.Split(string(jwe), ".")
-	if len(parts) != 5 {
-		err2.Check(fmt.Errorf("compact JWE format must have five parts"))
+	client, ok := protected.EphemeralPublicKey.Key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("ephemeral public key is not an EC key")
 	}
 
-	iv, err := base64Decode(parts[2])
-	err2.Check(err)
+	err2.Check(policy.CheckCurve(remote.Curve.Params().Name))
+	err2.Check(policy.CheckCurve(client.Curve.Params().Name))
 
-	ciphertext, err := base64Decode(parts[3])
-	err2.Check(err)
+	// Clevis sends no party info but honors it, as does jwx.
+	partyU := try.To1(base64Decode(protected.PartyU))
+	partyV := try.To1(base64Decode(protected.PartyV))
 
-	tag, err := base64Decode(parts[4])
-	err2.Check(err)
+	blinding := try.To1(mcr.Blind(remote, client))
+	defer blinding.Wipe()
+	ecmr := try.To1(jwk.New(blinding.Request))
+	err2.Check(ecmr.Set(jwk.AlgorithmKey, "ECMR"))
 
-	aeadCipher, err := aes.NewCipher(key)
-	err2.Check(err)
+	agent := try.To1(newClient(protected.Clevis.Tang.Location))
+	response := try.To1(agent.Recover(ctx, protected.KeyIdentifier, ecmr))
 
-	aead, err := cipher.NewGCM(aeadCipher)
-	err2.Check(err)
+	var exchanged ecdsa.PublicKey
+	err2.Check(response.Raw(&exchanged))
 
-	plaintext, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
-	err2.Check(err)
+	recovered := try.To1(blinding.Unblind(&exchanged))
+	defer secret.WipeInt(recovered.X, recovered.Y)
 
-	return plaintext, nil
+	if wrapSize == 0 {
+		return DeriveECDHES(protected.Encryption, partyU, partyV, recovered, size), nil
+	}
+	kek := DeriveECDHES(protected.Algorithm, partyU, partyV, recovered, wrapSize)
+	defer secret.Wipe(kek)
+	return jcipher.KeyUnwrap(try.To1(aes.NewCipher(kek)), encrypted)
 }
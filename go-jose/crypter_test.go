@@ -0,0 +1,383 @@
+package crypter_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	gojose "github.com/flatheadmill/tang-encryption-provider/go-jose"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+type backend interface {
+	Encrypt(ctx context.Context, plain []byte) ([]byte, error)
+	Decrypt(ctx context.Context, cipher []byte) ([]byte, error)
+}
+
+// newBackends returns both backends, encrypting to server with the default
+// suite.
+func newBackends(t testing.TB, server *tangtest.Server) map[string]backend {
+	t.Helper()
+	jwx, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := gojose.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]backend{"jwx": jwx, "go-jose": native}
+}
+
+// Each backend decrypts what the other encrypts to the same byte, as does the
+// tangtest reference, with a Tang exchange key on each of the NIST curves.
+func TestInterop(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		server, err := tangtest.New(curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends := newBackends(t, server)
+		decrypters := map[string]func(cipher []byte) ([]byte, error){
+			"tangtest": server.Decrypt,
+		}
+		for name, backend := range backends {
+			backend := backend
+			decrypters[name] = func(cipher []byte) ([]byte, error) { return backend.Decrypt(context.Background(), cipher) }
+		}
+		for encrypterName, encrypter := range backends {
+			for decrypterName, decrypt := range decrypters {
+				t.Run(curve.Params().Name+"/"+encrypterName+"/"+decrypterName, func(t *testing.T) {
+					for _, plain := range [][]byte{{0}, tangtest.Plain(32), bytes.Repeat([]byte{0xff}, 4096)} {
+						cipher, err := encrypter.Encrypt(context.Background(), plain)
+						if err != nil {
+							t.Fatal(err)
+						}
+						decrypted, err := decrypt(cipher)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if !bytes.Equal(decrypted, plain) {
+							t.Errorf("got %x, want %x", decrypted, plain)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	plain := tangtest.Plain(32)
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		server, err := tangtest.New(curve)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for name, backend := range newBackends(b, server) {
+			b.Run(curve.Params().Name+"/"+name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := backend.Encrypt(context.Background(), plain); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		server, err := tangtest.New(curve)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for name, backend := range newBackends(b, server) {
+			cipher, err := backend.Encrypt(context.Background(), tangtest.Plain(32))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(curve.Params().Name+"/"+name, func(b *testing.B) {
+				b.ReportAllocs()
+				_, before := server.Counts()
+				for i := 0; i < b.N; i++ {
+					if _, err := backend.Decrypt(context.Background(), cipher); err != nil {
+						b.Fatal(err)
+					}
+				}
+				_, after := server.Counts()
+				b.ReportMetric(float64(after-before)/float64(b.N), "recoveries/op")
+			})
+		}
+	}
+}
+
+// clevisEncrypt encrypts with jwe.Encrypt under the clevis member and to the
+// exchange key of a JWE we encrypted, as `clevis encrypt` would with any alg
+// and enc it supports, the ones we only decrypt included.
+func clevisEncrypt(t *testing.T, like []byte, alg string, enc string, plain []byte) []byte {
+	t.Helper()
+	encoded, err := base64.RawURLEncoding.DecodeString(string(like[:bytes.IndexByte(like, '.')]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var protected struct {
+		KeyID  string `json:"kid"`
+		Clevis struct {
+			Tang struct {
+				Advertisement json.RawMessage `json:"adv"`
+			} `json:"tang"`
+		} `json:"clevis"`
+	}
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &protected); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &header); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwk.Parse(protected.Clevis.Tang.Advertisement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertisement := &tang.Advertisement{Payload: protected.Clevis.Tang.Advertisement, Keys: keys}
+	exchange, err := advertisement.Find(protected.KeyID)
+	if err != nil || exchange == nil {
+		t.Fatalf("exchange key %s is not in the advertisement: %v", protected.KeyID, err)
+	}
+
+	headers := jwe.NewHeaders()
+	if err := headers.Set(jwe.KeyIDKey, protected.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := headers.Set("clevis", header["clevis"]); err != nil {
+		t.Fatal(err)
+	}
+	compact, err := jwe.Encrypt(plain, jwa.KeyEncryptionAlgorithm(alg), exchange, jwa.ContentEncryptionAlgorithm(enc), jwa.NoCompress, jwe.WithProtectedHeaders(headers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compact
+}
+
+// Both backends encrypt with every alg and enc they offer and both decrypt
+// every alg and enc clevis does.
+func TestSuites(t *testing.T) {
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypters := map[string]func(cipher []byte) ([]byte, error){"tangtest": server.Decrypt}
+	for name, backend := range newBackends(t, server) {
+		backend := backend
+		decrypters[name] = func(cipher []byte) ([]byte, error) { return backend.Decrypt(context.Background(), cipher) }
+	}
+	roundTrip := func(t *testing.T, cipher []byte, plain []byte) {
+		for name, decrypt := range decrypters {
+			decrypted, err := decrypt(cipher)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			} else if !bytes.Equal(decrypted, plain) {
+				t.Errorf("%s: got %q, want %q", name, decrypted, plain)
+			}
+		}
+	}
+
+	var like []byte
+	for _, encryption := range tangtest.Suites() {
+		jwx, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), encryption, suite.Policy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		native, err := gojose.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), encryption, suite.Policy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, encrypter := range map[string]backend{"jwx": jwx, "go-jose": native} {
+			t.Run("encrypt/"+encryption.Alg+"/"+encryption.Enc+"/"+name, func(t *testing.T) {
+				plain := tangtest.Plain(48)
+				cipher, err := encrypter.Encrypt(context.Background(), plain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				roundTrip(t, cipher, plain)
+				like = cipher
+			})
+		}
+	}
+	if like == nil {
+		t.Fatal("no JWE to encrypt like")
+	}
+	for _, alg := range suite.DecryptAlgorithms {
+		for _, enc := range suite.DecryptEncryptions {
+			t.Run("clevis/"+alg+"/"+enc, func(t *testing.T) {
+				plain := tangtest.Plain(48)
+				roundTrip(t, clevisEncrypt(t, like, alg, enc, plain), plain)
+			})
+		}
+	}
+}
+
+// Both backends reject the JWEs their policy does not accept before Tang is
+// asked, and refuse to encrypt with a suite their policy rejects.
+func TestPolicy(t *testing.T) {
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Suite{Alg: suite.ECDHES, Enc: suite.A128GCM}, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := weak.Encrypt(context.Background(), []byte("weak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gcm := suite.Policy{Encryptions: []string{suite.A256GCM}}
+	jwx, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, gcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := gojose.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, gcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, before := server.Counts()
+	for name, decrypter := range map[string]backend{"jwx": jwx, "go-jose": native} {
+		if _, err := decrypter.Decrypt(context.Background(), cipher); !errors.Is(err, suite.ErrRejected) {
+			t.Errorf("%s: got %v, want %v", name, err, suite.ErrRejected)
+		}
+	}
+	if _, after := server.Counts(); after != before {
+		t.Errorf("%d recoveries of rejected JWEs", after-before)
+	}
+
+	rejected := suite.Suite{Alg: suite.ECDHES, Enc: suite.A128GCM}
+	if _, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), rejected, gcm); err == nil {
+		t.Errorf("jwx crypter created with a suite its policy rejects")
+	}
+	if _, err := gojose.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), rejected, gcm); err == nil {
+		t.Errorf("go-jose crypter created with a suite its policy rejects")
+	}
+}
+
+// Under the FIPS policy both backends decrypt AES-GCM with ECDH-ES or AES Key
+// Wrap, reject the CBC encryptions before Tang is asked and refuse to encrypt
+// with them.
+func TestFIPS(t *testing.T) {
+	server, err := tangtest.New(elliptic.P384())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwx, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.FIPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := gojose.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.FIPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	like, err := jwx.Encrypt(context.Background(), []byte("fips"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alg := range suite.DecryptAlgorithms {
+		for _, enc := range suite.DecryptEncryptions {
+			t.Run(alg+"/"+enc, func(t *testing.T) {
+				plain := tangtest.Plain(16)
+				cipher := clevisEncrypt(t, like, alg, enc, plain)
+				approved := suite.FIPS.CheckEnc(enc) == nil
+				for name, decrypter := range map[string]backend{"jwx": jwx, "go-jose": native} {
+					_, before := server.Counts()
+					decrypted, err := decrypter.Decrypt(context.Background(), cipher)
+					_, after := server.Counts()
+					switch {
+					case approved && err != nil:
+						t.Errorf("%s: %v", name, err)
+					case approved && !bytes.Equal(decrypted, plain):
+						t.Errorf("%s: got %q, want %q", name, decrypted, plain)
+					case !approved && !errors.Is(err, suite.ErrRejected):
+						t.Errorf("%s: got %v, want %v", name, err, suite.ErrRejected)
+					case !approved && after != before:
+						t.Errorf("%s: %d recoveries of a rejected JWE", name, after-before)
+					}
+				}
+			})
+		}
+	}
+
+	cbc := suite.Suite{Alg: suite.ECDHES, Enc: suite.A256CBCHS512}
+	if _, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), cbc, suite.FIPS); err == nil {
+		t.Errorf("jwx crypter created with %s under fips", cbc.Enc)
+	}
+	if _, err := gojose.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), cbc, suite.FIPS); err == nil {
+		t.Errorf("go-jose crypter created with %s under fips", cbc.Enc)
+	}
+}
+
+// sss wraps shares in an sss pin, the decrypter fails before it needs a key.
+func sss(threshold int, shares ...[]byte) []byte {
+	jwes := make([]string, len(shares))
+	for i, share := range shares {
+		jwes[i] = string(share)
+	}
+	header, _ := json.Marshal(map[string]interface{}{
+		"alg":    "dir",
+		"enc":    "A256GCM",
+		"clevis": map[string]interface{}{"pin": "sss", "sss": map[string]interface{}{"p": base64.RawURLEncoding.EncodeToString([]byte{251}), "t": threshold, "jwe": jwes}},
+	})
+	return []byte(base64.RawURLEncoding.EncodeToString(header) + "....")
+}
+
+// The sss pins the golden vectors do not cover.
+func TestSSS(t *testing.T) {
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	native := newBackends(t, server)["go-jose"]
+	share, err := native.Encrypt(context.Background(), []byte{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := native.Encrypt(context.Background(), []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := share
+	for i := 0; i < 9; i++ {
+		nested = sss(1, nested)
+	}
+	tests := []struct {
+		name   string
+		cipher []byte
+		err    string
+	}{
+		{"below threshold", sss(2, share, []byte("share")), "sss recovered 1 of 2 required shares: share 1: compact JWE"},
+		{"wrong point size", sss(1, long), "share 0: point is 3 bytes, expected 2"},
+		{"prime too small", sss(1, share), "recovered key is 1 bytes, A256GCM needs 32"},
+		{"nested too deep", nested, "sss pins nested deeper than 8"},
+		{"no threshold", sss(0, share), "sss threshold 0 with 1 shares"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := native.Decrypt(context.Background(), test.cipher); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
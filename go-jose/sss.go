@@ -0,0 +1,91 @@
+package crypter
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+type jsonSSS struct {
+	Prime     string   `json:"p"`
+	Threshold int      `json:"t"`
+	Shares    []string `json:"jwe"`
+}
+
+// maxDepth is how deep sss pins may be nested in sss pins, as with clevis.
+const maxDepth = 8
+
+// The sss pin encrypts directly with the constant term of a random polynomial
+// over the prime field, each nested JWE encrypts a point of it, x and y each
+// the size of the prime. Any threshold of the points recover the constant
+// term by Lagrange interpolation at zero.
+func combine(ctx context.Context, config *jsonSSS, decrypt func(ctx context.Context, share []byte) ([]byte, error)) (key []byte, err error) {
+	defer err2.Return(&err)
+
+	if config == nil {
+		return nil, fmt.Errorf("sss pin without an sss member")
+	}
+	encoded := try.To1(base64Decode(config.Prime))
+	size := len(encoded)
+	prime := new(big.Int).SetBytes(encoded)
+	if size == 0 || !prime.ProbablyPrime(64) {
+		return nil, fmt.Errorf("sss p is not prime")
+	}
+	if config.Threshold < 1 || len(config.Shares) < config.Threshold {
+		return nil, fmt.Errorf("sss threshold %d with %d shares", config.Threshold, len(config.Shares))
+	}
+
+	var xs, ys []*big.Int
+	defer func() {
+		secret.WipeInt(xs...)
+		secret.WipeInt(ys...)
+	}()
+	var failures []string
+	for i := 0; i < len(config.Shares) && len(xs) < config.Threshold; i++ {
+		err2.Check(ctx.Err())
+		point, err := decrypt(ctx, []byte(config.Shares[i]))
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("share %d: %v", i, err))
+			continue
+		}
+		if len(point) == 2*size {
+			xs = append(xs, new(big.Int).SetBytes(point[:size]))
+			ys = append(ys, new(big.Int).SetBytes(point[size:]))
+		} else {
+			failures = append(failures, fmt.Sprintf("share %d: point is %d bytes, expected %d", i, len(point), 2*size))
+		}
+		secret.Wipe(point)
+	}
+	if len(xs) < config.Threshold {
+		return nil, fmt.Errorf("sss recovered %d of %d required shares: %s", len(xs), config.Threshold, strings.Join(failures, "; "))
+	}
+
+	constant := new(big.Int)
+	defer secret.WipeInt(constant)
+	for j := range xs {
+		term := new(big.Int).Set(ys[j])
+		for m := range xs {
+			if m == j {
+				continue
+			}
+			denominator := new(big.Int).Sub(xs[m], xs[j])
+			if denominator.ModInverse(denominator.Mod(denominator, prime), prime) == nil {
+				secret.WipeInt(term)
+				return nil, fmt.Errorf("sss shares have the same x")
+			}
+			term.Mul(term, xs[m])
+			term.Mul(term, denominator)
+			term.Mod(term, prime)
+		}
+		constant.Add(constant, term)
+		constant.Mod(constant, prime)
+		secret.WipeInt(term)
+	}
+	return constant.FillBytes(make([]byte, size)), nil
+}
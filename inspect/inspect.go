@@ -0,0 +1,228 @@
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"github.com/flatheadmill/tang-encryption-provider/envelope"
+	"github.com/flatheadmill/tang-encryption-provider/handler"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+)
+
+type jsonTang struct {
+	Location      string          `json:"url"`
+	Advertisement json.RawMessage `json:"adv"`
+}
+
+type jsonSSS struct {
+	Threshold int      `json:"t"`
+	Shares    []string `json:"jwe"`
+}
+
+type jsonClevis struct {
+	Plugin string   `json:"pin"`
+	Tang   jsonTang `json:"tang"`
+	SSS    jsonSSS  `json:"sss"`
+}
+
+type jsonProtected struct {
+	KeyIdentifier      string          `json:"kid"`
+	Algorithm          string          `json:"alg"`
+	Encryption         string          `json:"enc"`
+	Clevis             jsonClevis      `json:"clevis"`
+	EphemeralPublicKey json.RawMessage `json:"epk"`
+}
+
+type Key struct {
+	Thumbprint string   `json:"thumbprint"`
+	Type       string   `json:"kty"`
+	Curve      string   `json:"crv,omitempty"`
+	Algorithm  string   `json:"alg,omitempty"`
+	Operations []string `json:"key_ops,omitempty"`
+}
+
+type Report struct {
+	Provider       string `json:"provider,omitempty"`
+	Algorithm      string `json:"alg"`
+	Encryption     string `json:"enc"`
+	KeyID          string `json:"kid"`
+	Pin            string `json:"pin"`
+	URL            string `json:"url"`
+	Keys           []Key  `json:"keys"`
+	EphemeralCurve string `json:"epk_crv"`
+	PayloadSize    int    `json:"payload_size"`
+	// Threshold and Shares are only set for the sss pin, Shares has a report
+	// for each nested JWE.
+	Threshold int       `json:"threshold,omitempty"`
+	Shares    []*Report `json:"shares,omitempty"`
+	// Advertised is only set when the report was checked against a live Tang
+	// server with Check.
+	Advertised *bool `json:"advertised,omitempty"`
+}
+
+// clevis nests sss pins in sss pins, a JWE nested deeper than this is refused
+// rather than followed.
+const maxDepth = 8
+
+func decode64(encoded string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
+
+func describe(key jwk.Key) (described Key, err error) {
+	defer err2.Return(&err)
+	described = Key{
+		Thumbprint: try.To1(tang.Thumbprint(key)),
+		Type:       string(key.KeyType()),
+		Algorithm:  key.Algorithm(),
+	}
+	if ec, ok := key.(jwk.ECDSAPublicKey); ok {
+		described.Curve = ec.Crv().String()
+	}
+	for _, op := range key.KeyOps() {
+		described.Operations = append(described.Operations, string(op))
+	}
+	return described, nil
+}
+
+// Inspect decodes the protected header of a compact clevis JWE, or of the
+// encrypted DEK inside a Kubernetes KMS v1 envelope, without decrypting it.
+// The JWEs nested in an sss pin are inspected too.
+func Inspect(cipher []byte) (report *Report, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+
+	var provider string
+	if envelope.IsEnvelope(cipher) {
+		parsed := try.To1(envelope.Parse(cipher))
+		provider = parsed.Provider
+		cipher = parsed.Key
+	}
+	report = try.To1(inspect(cipher, 0))
+	report.Provider = provider
+	return report, nil
+}
+
+func inspect(cipher []byte, depth int) (report *Report, err error) {
+	defer err2.Return(&err)
+
+	if depth > maxDepth {
+		return nil, fmt.Errorf("sss pins nested deeper than %d", maxDepth)
+	}
+	report = &Report{}
+	parts := strings.Split(string(bytes.TrimSpace(cipher)), ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("compact JWE format must have five parts, found %d", len(parts))
+	}
+
+	var protected jsonProtected
+	err2.Check(json.Unmarshal(try.To1(decode64(parts[0])), &protected))
+
+	report.Algorithm = protected.Algorithm
+	report.Encryption = protected.Encryption
+	report.KeyID = protected.KeyIdentifier
+	report.Pin = protected.Clevis.Plugin
+	report.URL = protected.Clevis.Tang.Location
+	report.PayloadSize = len(try.To1(decode64(parts[3])))
+
+	if protected.EphemeralPublicKey != nil {
+		epk := try.To1(jwk.ParseKey(protected.EphemeralPublicKey))
+		if ec, ok := epk.(jwk.ECDSAPublicKey); ok {
+			report.EphemeralCurve = ec.Crv().String()
+		}
+	}
+
+	if protected.Clevis.Tang.Advertisement != nil {
+		keySet := try.To1(jwk.Parse(protected.Clevis.Tang.Advertisement))
+		ctx := context.Background()
+		for iterator := keySet.Iterate(ctx); iterator.Next(ctx); {
+			key := iterator.Pair().Value.(jwk.Key)
+			report.Keys = append(report.Keys, try.To1(describe(key)))
+		}
+	}
+
+	if protected.Clevis.Plugin == "sss" {
+		report.Threshold = protected.Clevis.SSS.Threshold
+		for i, share := range protected.Clevis.SSS.Shares {
+			nested, err := inspect([]byte(share), depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("sss share %d: %w", i, err)
+			}
+			report.Shares = append(report.Shares, nested)
+		}
+	}
+
+	return report, nil
+}
+
+// Walk calls visit with the report and every report nested in its sss shares.
+func (r *Report) Walk(visit func(*Report)) {
+	visit(r)
+	for _, share := range r.Shares {
+		share.Walk(visit)
+	}
+}
+
+// Advertised fetches the advertisement signed by the signing key with the
+// thumbprint from the Tang server at url and returns the thumbprints of the
+// advertised exchange keys. Rotated keys are no longer advertised but Tang can
+// still recover with them.
+func Advertised(url string, thumbprint string) (thumbprints map[string]bool, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+
+	client := try.To1(tang.NewClient(url))
+	advertisement := try.To1(client.Advertisement(context.Background(), thumbprint))
+
+	thumbprints = map[string]bool{}
+	for _, key := range advertisement.ExchangeKeys() {
+		thumbprints[try.To1(tang.Thumbprint(key))] = true
+	}
+
+	return thumbprints, nil
+}
+
+// Check records whether the key IDs of the report and of its sss shares are
+// still advertised, in an advertisement signed by the signing key with the
+// thumbprint. If url is not empty it is asked about every key ID instead of
+// the Tang server named in each JWE.
+func (r *Report) Check(url string, thumbprint string) (err error) {
+	advertised := map[string]map[string]bool{}
+	r.Walk(func(report *Report) {
+		if report.Pin != "tang" || err != nil {
+			return
+		}
+		server := url
+		if server == "" {
+			server = report.URL
+		}
+		thumbprints, ok := advertised[server]
+		if !ok {
+			if thumbprints, err = Advertised(server, thumbprint); err != nil {
+				return
+			}
+			advertised[server] = thumbprints
+		}
+		found := thumbprints[report.KeyID]
+		report.Advertised = &found
+	})
+	return err
+}
+
+// Signers returns the thumbprints of the advertisement signing keys.
+func (r *Report) Signers() []string {
+	signers := []string{}
+	for _, key := range r.Keys {
+		for _, op := range key.Operations {
+			if op == "verify" {
+				signers = append(signers, key.Thumbprint)
+			}
+		}
+	}
+	return signers
+}
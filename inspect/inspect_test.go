@@ -0,0 +1,217 @@
+package inspect_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"github.com/flatheadmill/tang-encryption-provider/envelope"
+	"github.com/flatheadmill/tang-encryption-provider/inspect"
+)
+
+func encode64(buffer []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+// Inspect never decrypts, so the JWEs only need a header, the rest is noise
+// of the right shape.
+func compact(t *testing.T, header interface{}, payload int) []byte {
+	protected, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(strings.Join([]string{encode64(protected), "", encode64(make([]byte, 12)), encode64(make([]byte, payload)), encode64(make([]byte, 16))}, "."))
+}
+
+func newKey(t *testing.T, curve elliptic.Curve, alg string, op jwk.KeyOperation) (jwk.Key, string) {
+	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.New(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Set(jwk.AlgorithmKey, alg); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Set(jwk.KeyOpsKey, jwk.KeyOperationList{op}); err != nil {
+		t.Fatal(err)
+	}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, encode64(thumbprint)
+}
+
+type server struct {
+	url      string
+	adv      map[string]interface{}
+	signer   string
+	exchange string
+}
+
+func newServer(t *testing.T, url string) server {
+	signing, signer := newKey(t, elliptic.P521(), "ES512", jwk.KeyOpVerify)
+	exchanging, exchange := newKey(t, elliptic.P521(), "ECMR", jwk.KeyOpDeriveKey)
+	return server{
+		url:      url,
+		adv:      map[string]interface{}{"keys": []jwk.Key{signing, exchanging}},
+		signer:   signer,
+		exchange: exchange,
+	}
+}
+
+func (s server) encrypt(t *testing.T, payload int) []byte {
+	epk, _ := newKey(t, elliptic.P521(), "", jwk.KeyOpDeriveKey)
+	epk.Remove(jwk.AlgorithmKey)
+	epk.Remove(jwk.KeyOpsKey)
+	return compact(t, map[string]interface{}{
+		"alg":    "ECDH-ES",
+		"enc":    "A256GCM",
+		"kid":    s.exchange,
+		"epk":    epk,
+		"clevis": map[string]interface{}{"pin": "tang", "tang": map[string]interface{}{"url": s.url, "adv": s.adv}},
+	}, payload)
+}
+
+func (s server) report(payload int) *inspect.Report {
+	return &inspect.Report{
+		Algorithm:      "ECDH-ES",
+		Encryption:     "A256GCM",
+		KeyID:          s.exchange,
+		Pin:            "tang",
+		URL:            s.url,
+		EphemeralCurve: "P-521",
+		PayloadSize:    payload,
+		Keys: []inspect.Key{
+			{Thumbprint: s.signer, Type: "EC", Curve: "P-521", Algorithm: "ES512", Operations: []string{"verify"}},
+			{Thumbprint: s.exchange, Type: "EC", Curve: "P-521", Algorithm: "ECMR", Operations: []string{"deriveKey"}},
+		},
+	}
+}
+
+func sss(t *testing.T, threshold int, shares ...[]byte) []byte {
+	jwes := make([]string, len(shares))
+	for i, share := range shares {
+		jwes[i] = string(share)
+	}
+	return compact(t, map[string]interface{}{
+		"alg":    "dir",
+		"enc":    "A256GCM",
+		"clevis": map[string]interface{}{"pin": "sss", "sss": map[string]interface{}{"p": encode64([]byte{251}), "t": threshold, "jwe": jwes}},
+	}, 32)
+}
+
+func TestInspect(t *testing.T) {
+	first, second := newServer(t, "http://tang.one"), newServer(t, "http://tang.two")
+	nested := sss(t, 1, first.encrypt(t, 64))
+	for i := 0; i < 8; i++ {
+		nested = sss(t, 1, nested)
+	}
+	tests := []struct {
+		name   string
+		cipher []byte
+		report *inspect.Report
+		err    string
+	}{{
+		name:   "tang",
+		cipher: first.encrypt(t, 32),
+		report: first.report(32),
+	}, {
+		name:   "tang with newline",
+		cipher: append(first.encrypt(t, 32), '\n'),
+		report: first.report(32),
+	}, {
+		name:   "envelope",
+		cipher: (&envelope.Envelope{Provider: "tang", Key: first.encrypt(t, 32), Data: []byte("data")}).Bytes(),
+		report: func() *inspect.Report {
+			report := first.report(32)
+			report.Provider = "tang"
+			return report
+		}(),
+	}, {
+		name:   "sss",
+		cipher: sss(t, 2, first.encrypt(t, 64), second.encrypt(t, 64)),
+		report: &inspect.Report{Algorithm: "dir", Encryption: "A256GCM", Pin: "sss", PayloadSize: 32, Threshold: 2, Shares: []*inspect.Report{first.report(64), second.report(64)}},
+	}, {
+		name:   "sss in sss",
+		cipher: sss(t, 1, sss(t, 1, second.encrypt(t, 64)), first.encrypt(t, 64)),
+		report: &inspect.Report{Algorithm: "dir", Encryption: "A256GCM", Pin: "sss", PayloadSize: 32, Threshold: 1, Shares: []*inspect.Report{
+			{Algorithm: "dir", Encryption: "A256GCM", Pin: "sss", PayloadSize: 32, Threshold: 1, Shares: []*inspect.Report{second.report(64)}},
+			first.report(64),
+		}},
+	}, {
+		name:   "not a JWE",
+		cipher: []byte("k8s:enc:aescbc:v1:key1:data"),
+		err:    "five parts",
+	}, {
+		name:   "header not base64",
+		cipher: []byte("!.a.b.c.d"),
+		err:    "illegal base64",
+	}, {
+		name:   "header not JSON",
+		cipher: []byte(encode64([]byte("tang")) + "...."),
+		err:    "invalid character",
+	}, {
+		name:   "envelope without a DEK",
+		cipher: []byte(envelope.Prefix + "tang"),
+		err:    "provider name",
+	}, {
+		name:   "malformed share",
+		cipher: sss(t, 1, []byte("share")),
+		err:    "sss share 0",
+	}, {
+		name:   "nested too deep",
+		cipher: sss(t, 1, nested),
+		err:    "nested deeper than 8",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := inspect.Inspect(test.cipher)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report, test.report) {
+				got, _ := json.Marshal(report)
+				want, _ := json.Marshal(test.report)
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestWalk(t *testing.T) {
+	first, second := newServer(t, "http://tang.one"), newServer(t, "http://tang.two")
+	report, err := inspect.Inspect(sss(t, 1, sss(t, 1, second.encrypt(t, 64)), first.encrypt(t, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kids []string
+	report.Walk(func(visited *inspect.Report) {
+		if visited.Pin == "tang" {
+			kids = append(kids, visited.KeyID)
+		}
+	})
+	if want := []string{second.exchange, first.exchange}; !reflect.DeepEqual(kids, want) {
+		t.Fatalf("got %v, want %v", kids, want)
+	}
+	if signers := first.report(64).Signers(); !reflect.DeepEqual(signers, []string{first.signer}) {
+		t.Fatalf("got signers %v, want %v", signers, []string{first.signer})
+	}
+}
@@ -0,0 +1,135 @@
+// Package limit bounds the work the plugin takes on: a semaphore with a
+// bounded queue for concurrent KMS calls and a token bucket for each Tang
+// server, so that a decrypt storm from the apiserver is turned away early
+// rather than passed on to Tang.
+package limit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSaturated is returned when a call can not be admitted, either because the
+// queue is full or because it would have to wait past its deadline.
+var ErrSaturated = errors.New("limit: saturated")
+
+// Semaphore admits at most a fixed number of concurrent calls and queues at
+// most a fixed number more. A nil Semaphore admits every call.
+type Semaphore struct {
+	slots   chan struct{}
+	queue   int64
+	waiting int64
+}
+
+// NewSemaphore returns a semaphore of concurrent slots with a queue of queued
+// callers, or nil when concurrent is less than one.
+func NewSemaphore(concurrent int, queued int) *Semaphore {
+	if concurrent < 1 {
+		return nil
+	}
+	return &Semaphore{slots: make(chan struct{}, concurrent), queue: int64(queued)}
+}
+
+// Acquire takes a slot, waiting in the queue until one is free or the context
+// is done. It returns ErrSaturated without waiting if the queue is full.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if atomic.AddInt64(&s.waiting, 1) > s.queue {
+		atomic.AddInt64(&s.waiting, -1)
+		return ErrSaturated
+	}
+	defer atomic.AddInt64(&s.waiting, -1)
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release returns a slot taken by Acquire.
+func (s *Semaphore) Release() {
+	if s != nil {
+		<-s.slots
+	}
+}
+
+// Bucket is a token bucket that refills at rate tokens a second up to burst
+// tokens. A nil Bucket never waits.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	now    func() time.Time
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket, or nil when rate is not positive.
+func NewBucket(rate float64, burst int) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+func (b *Bucket) take(now time.Time) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) giveBack() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens++
+}
+
+// Wait takes a token, waiting for one to accrue. If the context's deadline
+// comes before the token would, it returns ErrSaturated at once instead of
+// waiting in vain.
+func (b *Bucket) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	now := b.now()
+	delay := b.take(now)
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		b.giveBack()
+		return ErrSaturated
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.giveBack()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// One call runs, one waits in the queue, the next is turned away at once and
+// a queued call that gives up leaves the queue.
+func TestSemaphore(t *testing.T) {
+	semaphore := NewSemaphore(1, 1)
+	if err := semaphore.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error)
+	go func() { queued <- semaphore.Acquire(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := semaphore.Acquire(context.Background()); !errors.Is(err, ErrSaturated) {
+		t.Errorf("got %v, want %v", err, ErrSaturated)
+	}
+	semaphore.Release()
+	if err := <-queued; err != nil {
+		t.Errorf("queued call got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() { canceled <- semaphore.Acquire(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	semaphore.Release()
+	if err := semaphore.Acquire(context.Background()); err != nil {
+		t.Errorf("semaphore did not recover: %v", err)
+	}
+
+	var unlimited *Semaphore
+	if NewSemaphore(0, 0) != unlimited || unlimited.Acquire(context.Background()) != nil {
+		t.Errorf("nil semaphore is not unlimited")
+	}
+}
+
+// The bucket starts full, refills at its rate up to its burst, and refuses
+// at once a call whose deadline comes before the next token.
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	bucket := NewBucket(1, 2)
+	bucket.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		err     error
+	}{
+		{"burst", 0, nil},
+		{"burst", 0, nil},
+		{"empty", 0, ErrSaturated},
+		{"refusal gives the token back", 900 * time.Millisecond, nil},
+		{"still empty", 500 * time.Millisecond, ErrSaturated},
+		{"capped at burst", time.Hour, nil},
+		{"capped at burst", 0, nil},
+		{"capped at burst", 0, ErrSaturated},
+	}
+	for _, test := range tests {
+		now = now.Add(test.advance)
+		// The deadline is measured against the bucket's clock.
+		ctx, cancel := context.WithDeadline(context.Background(), now.Add(200*time.Millisecond))
+		if err := bucket.Wait(ctx); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		cancel()
+	}
+
+	var unlimited *Bucket
+	if NewBucket(0, 1) != unlimited || unlimited.Wait(context.Background()) != nil {
+		t.Errorf("nil bucket is not unlimited")
+	}
+}
+
+// Without a deadline the call waits for the token.
+func TestBucketWaits(t *testing.T) {
+	bucket := NewBucket(20, 1)
+	if err := bucket.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := bucket.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 25*time.Millisecond {
+		t.Errorf("waited %v, want about 50ms", waited)
+	}
+}
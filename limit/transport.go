@@ -0,0 +1,49 @@
+package limit
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Transport limits the requests to each host to a token bucket of its own.
+type Transport struct {
+	base    http.RoundTripper
+	rate    float64
+	burst   int
+	mutex   sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// NewTransport wraps base, which defaults to http.DefaultTransport, with a
+// rate of requests a second to each host and a burst. It returns base itself
+// when rate is not positive.
+func NewTransport(base http.RoundTripper, rate float64, burst int) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if rate <= 0 {
+		return base
+	}
+	return &Transport{base: base, rate: rate, burst: burst, buckets: map[string]*Bucket{}}
+}
+
+func (t *Transport) bucket(host string) *Bucket {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	bucket, ok := t.buckets[host]
+	if !ok {
+		bucket = NewBucket(t.rate, t.burst)
+		t.buckets[host] = bucket
+	}
+	return bucket
+}
+
+func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if err := t.bucket(request.URL.Host).Wait(request.Context()); err != nil {
+		if request.Body != nil {
+			request.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(request)
+}
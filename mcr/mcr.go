@@ -0,0 +1,213 @@
+// Package mcr implements the McCallum-Relyea exchange Tang uses to recover
+// the ECDH-ES key of a clevis JWE without either party learning the other's
+// secret.
+//
+// The client holds the ephemeral public key C = cG from the JWE header and
+// the server's public exchange key S = sG. It blinds C with a random scalar e
+// and sends X = C + eG. The server answers Y = sX = sC + eS and the client
+// unblinds K = Y - eS = sC, the ECDH shared point.
+//
+// Point arithmetic is done with the constant-time implementations in
+// filippo.io/nistec for P-256, P-384 and P-521.
+package mcr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"filippo.io/nistec"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+type point[P any] interface {
+	Bytes() []byte
+	SetBytes([]byte) (P, error)
+	Add(P, P) P
+	ScalarMult(P, []byte) (P, error)
+	ScalarBaseMult([]byte) (P, error)
+}
+
+// Operations on uncompressed SEC 1 encodings, so that the three nistec point
+// types can share one implementation.
+type curve struct {
+	elliptic       elliptic.Curve
+	params         *elliptic.CurveParams
+	size           int
+	add            func(a, b []byte) ([]byte, error)
+	scalarMult     func(encoded, scalar []byte) ([]byte, error)
+	scalarBaseMult func(scalar []byte) ([]byte, error)
+}
+
+func newCurve[P point[P]](c elliptic.Curve, newPoint func() P) *curve {
+	params := c.Params()
+	return &curve{
+		elliptic: c,
+		params:   params,
+		size:     (params.BitSize + 7) / 8,
+		add: func(a, b []byte) ([]byte, error) {
+			p, err := newPoint().SetBytes(a)
+			if err != nil {
+				return nil, err
+			}
+			q, err := newPoint().SetBytes(b)
+			if err != nil {
+				return nil, err
+			}
+			return newPoint().Add(p, q).Bytes(), nil
+		},
+		scalarMult: func(encoded, scalar []byte) ([]byte, error) {
+			p, err := newPoint().SetBytes(encoded)
+			if err != nil {
+				return nil, err
+			}
+			q, err := newPoint().ScalarMult(p, scalar)
+			if err != nil {
+				return nil, err
+			}
+			return q.Bytes(), nil
+		},
+		scalarBaseMult: func(scalar []byte) ([]byte, error) {
+			p, err := newPoint().ScalarBaseMult(scalar)
+			if err != nil {
+				return nil, err
+			}
+			return p.Bytes(), nil
+		},
+	}
+}
+
+var curves = map[elliptic.Curve]*curve{
+	elliptic.P256(): newCurve(elliptic.P256(), nistec.NewP256Point),
+	elliptic.P384(): newCurve(elliptic.P384(), nistec.NewP384Point),
+	elliptic.P521(): newCurve(elliptic.P521(), nistec.NewP521Point),
+}
+
+func lookup(c elliptic.Curve) (*curve, error) {
+	if c == nil {
+		return nil, fmt.Errorf("key has no curve")
+	}
+	found, ok := curves[c]
+	if !ok {
+		return nil, fmt.Errorf("curve %s is not supported", c.Params().Name)
+	}
+	return found, nil
+}
+
+// Points that are not on the curve are rejected by SetBytes when they are
+// used.
+func (c *curve) encode(key *ecdsa.PublicKey) []byte {
+	encoded := make([]byte, 1+2*c.size)
+	encoded[0] = 4
+	key.X.FillBytes(encoded[1 : 1+c.size])
+	key.Y.FillBytes(encoded[1+c.size:])
+	return encoded
+}
+
+func (c *curve) decode(encoded []byte) (*ecdsa.PublicKey, error) {
+	if len(encoded) != 1+2*c.size {
+		return nil, fmt.Errorf("result is the point at infinity")
+	}
+	return &ecdsa.PublicKey{
+		Curve: c.elliptic,
+		X:     new(big.Int).SetBytes(encoded[1 : 1+c.size]),
+		Y:     new(big.Int).SetBytes(encoded[1+c.size:]),
+	}, nil
+}
+
+func (c *curve) validate(key *ecdsa.PublicKey) error {
+	if key.X == nil || key.Y == nil || key.X.Sign() < 0 || key.Y.Sign() < 0 || key.X.Cmp(c.params.P) >= 0 || key.Y.Cmp(c.params.P) >= 0 {
+		return fmt.Errorf("point is not on curve %s", c.params.Name)
+	}
+	return nil
+}
+
+// The exact length big endian scalar nistec expects.
+func (c *curve) scalar(d *big.Int) ([]byte, error) {
+	if d.Sign() <= 0 || d.Cmp(c.params.N) >= 0 {
+		return nil, fmt.Errorf("scalar is out of range for curve %s", c.params.Name)
+	}
+	return d.FillBytes(make([]byte, c.size)), nil
+}
+
+// -S is (x, p - y). The exchange key is public so math/big is fine here.
+func (c *curve) negate(key *ecdsa.PublicKey) *ecdsa.PublicKey {
+	return &ecdsa.PublicKey{Curve: key.Curve, X: key.X, Y: new(big.Int).Sub(c.params.P, key.Y)}
+}
+
+// Blinding is the client's state between sending the blinded request to Tang
+// and unblinding the response.
+type Blinding struct {
+	curve *curve
+	// Request is the blinded ephemeral key X to send to `/rec`.
+	Request *ecdsa.PublicKey
+	// e·(-S), added to the response to unblind it.
+	unblind []byte
+}
+
+// Blind blinds the ephemeral public key from a JWE header for the exchange
+// key of the Tang server. Both keys must be on the same curve.
+func Blind(exchange *ecdsa.PublicKey, ephemeral *ecdsa.PublicKey) (blinding *Blinding, err error) {
+	defer err2.Return(&err)
+
+	c := try.To1(lookup(exchange.Curve))
+	if ephemeral.Curve != exchange.Curve {
+		return nil, fmt.Errorf("ephemeral key is not on curve %s", c.params.Name)
+	}
+	err2.Check(c.validate(exchange))
+	err2.Check(c.validate(ephemeral))
+
+	random := try.To1(ecdsa.GenerateKey(exchange.Curve, rand.Reader))
+	defer secret.WipeInt(random.D)
+	e := try.To1(c.scalar(random.D))
+	defer secret.Wipe(e)
+
+	blinder := try.To1(c.scalarBaseMult(e))
+	request := try.To1(c.add(c.encode(ephemeral), blinder))
+	unblind := try.To1(c.scalarMult(c.encode(c.negate(exchange)), e))
+
+	return &Blinding{
+		curve:   c,
+		Request: try.To1(c.decode(request)),
+		unblind: unblind,
+	}, nil
+}
+
+// Unblind removes the blinding from Tang's response and returns the ECDH
+// shared point, whose X coordinate is the input to the Concat KDF.
+func (b *Blinding) Unblind(response *ecdsa.PublicKey) (shared *ecdsa.PublicKey, err error) {
+	defer err2.Return(&err)
+	if response.Curve != b.Request.Curve {
+		return nil, fmt.Errorf("response is not on curve %s", b.curve.params.Name)
+	}
+	err2.Check(b.curve.validate(response))
+	sum := try.To1(b.curve.add(b.curve.encode(response), b.unblind))
+	defer secret.Wipe(sum)
+	return b.curve.decode(sum)
+}
+
+// Wipe zeroes the blinding once the response is unblinded.
+func (b *Blinding) Wipe() {
+	secret.Wipe(b.unblind)
+}
+
+// Exchange is the server side, it multiplies the blinded request by the
+// private exchange key.
+func Exchange(private *ecdsa.PrivateKey, request *ecdsa.PublicKey) (response *ecdsa.PublicKey, err error) {
+	defer err2.Return(&err)
+
+	c := try.To1(lookup(private.Curve))
+	if request.Curve != private.Curve {
+		return nil, fmt.Errorf("request key is not on curve %s", c.params.Name)
+	}
+	err2.Check(c.validate(request))
+
+	d := try.To1(c.scalar(private.D))
+	defer secret.Wipe(d)
+	return c.decode(try.To1(c.scalarMult(c.encode(request), d)))
+}
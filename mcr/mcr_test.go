@@ -0,0 +1,125 @@
+package mcr_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/flatheadmill/tang-encryption-provider/mcr"
+)
+
+var curves = []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()}
+
+func generate(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// The client and server sides of the exchange agree with each other and with
+// plain ECDH computed by crypto/elliptic, for random keys.
+func TestExchange(t *testing.T) {
+	for _, curve := range curves {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			for i := 0; i < 64; i++ {
+				server := generate(t, curve)
+				client := generate(t, curve)
+				blinding, err := mcr.Blind(&server.PublicKey, &client.PublicKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				response, err := mcr.Exchange(server, blinding.Request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				shared, err := blinding.Unblind(response)
+				if err != nil {
+					t.Fatal(err)
+				}
+				x, y := curve.ScalarMult(server.X, server.Y, client.D.Bytes())
+				if shared.X.Cmp(x) != 0 || shared.Y.Cmp(y) != 0 {
+					t.Fatalf("exchange %d does not agree with ECDH", i)
+				}
+			}
+		})
+	}
+}
+
+// The blinded request tells Tang nothing about the ephemeral key, blinding
+// the same key twice gives different requests.
+func TestBlind(t *testing.T) {
+	for _, curve := range curves {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			server := generate(t, curve)
+			client := generate(t, curve)
+			first, err := mcr.Blind(&server.PublicKey, &client.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := mcr.Blind(&server.PublicKey, &client.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.Request.X.Cmp(second.Request.X) == 0 || first.Request.X.Cmp(client.X) == 0 {
+				t.Errorf("request is not blinded")
+			}
+		})
+	}
+}
+
+// Keys on different curves or off their curve are refused by both sides.
+func TestInvalid(t *testing.T) {
+	p256, p384 := generate(t, elliptic.P256()), generate(t, elliptic.P384())
+	offCurve := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).Set(p256.X), Y: new(big.Int).Add(p256.Y, big.NewInt(1))}
+	blinding, err := mcr.Blind(&p256.PublicKey, &p256.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"blind mixed curves", func() error {
+			_, err := mcr.Blind(&p256.PublicKey, &p384.PublicKey)
+			return err
+		}},
+		{"blind off curve", func() error {
+			_, err := mcr.Blind(&p256.PublicKey, offCurve)
+			return err
+		}},
+		{"blind unsupported curve", func() error {
+			key := generate(t, elliptic.P224())
+			_, err := mcr.Blind(&key.PublicKey, &key.PublicKey)
+			return err
+		}},
+		{"exchange mixed curves", func() error {
+			_, err := mcr.Exchange(p384, blinding.Request)
+			return err
+		}},
+		{"exchange off curve", func() error {
+			_, err := mcr.Exchange(p256, offCurve)
+			return err
+		}},
+		{"unblind mixed curves", func() error {
+			_, err := blinding.Unblind(&p384.PublicKey)
+			return err
+		}},
+		{"unblind off curve", func() error {
+			_, err := blinding.Unblind(offCurve)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.call() == nil {
+				t.Errorf("no error")
+			}
+		})
+	}
+}
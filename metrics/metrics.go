@@ -0,0 +1,56 @@
+// Package metrics exports the plugin's Prometheus metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/flatheadmill/tang-encryption-provider/cache"
+)
+
+const namespace = "tang_kms"
+
+// Registry holds our metrics and the Go runtime and process collectors.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(prometheus.NewGoCollector())
+	Registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// Handler serves the registry for `/metrics`.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDecryptCache exports the hit, miss and eviction counts and the size
+// of the decrypt cache.
+func RegisterDecryptCache(c *cache.Cache) error {
+	counter := func(name string, help string, value func(cache.Stats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "decrypt_cache",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(c.Stats())) })
+	}
+	collectors := []prometheus.Collector{
+		counter("hits_total", "Decrypts answered from the cache.", func(s cache.Stats) uint64 { return s.Hits }),
+		counter("misses_total", "Decrypts not found in the cache.", func(s cache.Stats) uint64 { return s.Misses }),
+		counter("evictions_total", "Plain texts evicted from the cache and zeroed.", func(s cache.Stats) uint64 { return s.Evictions }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "decrypt_cache",
+			Name:      "entries",
+			Help:      "Plain texts in the cache.",
+		}, func() float64 { return float64(c.Stats().Entries) }),
+	}
+	for _, collector := range collectors {
+		if err := Registry.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Package mtls configures mutual TLS for the plugin's optional TCP listener
+// and authorizes clients by the subject of their certificate.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// ServerConfig loads the server's certificate and key and the CA that signs
+// client certificates, and requires every client to present one.
+func ServerConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS certificate: %w", err)
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("TLS client CA %s has no PEM certificates", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Authorized reports whether the certificate's subject is one of subjects,
+// each either a common name or a whole distinguished name as in
+// `CN=apiserver,O=example`. Any verified certificate is authorized when
+// subjects is empty.
+func Authorized(certificate *x509.Certificate, subjects []string) bool {
+	if len(subjects) == 0 {
+		return true
+	}
+	for _, subject := range subjects {
+		if subject == certificate.Subject.CommonName || subject == certificate.Subject.String() {
+			return true
+		}
+	}
+	return false
+}
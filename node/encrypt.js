@@ -2,9 +2,12 @@ const assert = require('assert')
 
 const axios = require('axios')
 const jose = require('jose')
+const getStdin = require('get-stdin')
 
-const thp = 'o6U9qKv0_XdugefJV3q_NknYTY4Xgw27kcUnErkrVCY'
-const url = 'http://tang:8080'
+const thp = process.env.TANG_THP || 'o6U9qKv0_XdugefJV3q_NknYTY4Xgw27kcUnErkrVCY'
+const url = process.env.TANG_URL || 'http://tang:8080'
+// The url recorded in the JWE, when it differs from the url we fetch from.
+const clevisURL = process.env.TANG_CLEVIS_URL || url
 
 async function main () {
     const response = await axios.get(`${url}/adv/${thp}`)
@@ -26,7 +29,7 @@ async function main () {
             clevis: {
                 pin: 'tang',
                 tang: {
-                    url: url,
+                    url: clevisURL,
                     adv: jwks
                 }
             },
@@ -34,7 +37,7 @@ async function main () {
         }
     }
     let ctxt = await new jose.CompactEncrypt(
-        new TextEncoder().encode('hi\n')
+        new TextEncoder().encode(await getStdin())
     ).setProtectedHeader(jwe.protected).encrypt(ejwk)
     console.log(ctxt)
 }
@@ -0,0 +1,164 @@
+// Encrypts stdin to a Tang server as `clevis encrypt tang` does, with nothing
+// but Node's WebCrypto, so that golden vectors from an implementation that
+// shares no code with ours can be made without `npm install`. With SSS_T and
+// SSS_N it encrypts as `clevis encrypt sss` does with a threshold of SSS_T of
+// SSS_N tang pins. TANG_APU and TANG_APV set the party info of the tang pins.
+
+const assert = require('assert')
+const { webcrypto, generatePrimeSync, randomBytes } = require('crypto')
+const { subtle } = webcrypto
+
+const thp = process.env.TANG_THP
+const url = process.env.TANG_URL || 'http://tang:8080'
+// The url recorded in the JWE, when it differs from the url we fetch from.
+const clevisURL = process.env.TANG_CLEVIS_URL || url
+const apu = Buffer.from(process.env.TANG_APU || '')
+const apv = Buffer.from(process.env.TANG_APV || '')
+
+const curves = {
+    'P-256': { hash: 'SHA-256', bits: 256 },
+    'P-384': { hash: 'SHA-384', bits: 384 },
+    'P-521': { hash: 'SHA-512', bits: 528 }
+}
+
+function encode64 (buffer) {
+    return Buffer.from(buffer).toString('base64url')
+}
+
+// The JSON serialization of `jose`, which clevis uses, has sorted keys.
+function sorted (value) {
+    if (Array.isArray(value)) {
+        return value.map(sorted)
+    }
+    if (value !== null && typeof value == 'object') {
+        const object = {}
+        for (const key of Object.keys(value).sort()) {
+            object[key] = sorted(value[key])
+        }
+        return object
+    }
+    return value
+}
+
+async function thumbprint (jwk) {
+    const required = { crv: jwk.crv, kty: jwk.kty, x: jwk.x, y: jwk.y }
+    return encode64(await subtle.digest('SHA-256', Buffer.from(JSON.stringify(required))))
+}
+
+function lengthPrefixed (buffer) {
+    const prefixed = Buffer.alloc(4 + buffer.length)
+    prefixed.writeUInt32BE(buffer.length)
+    Buffer.from(buffer).copy(prefixed, 4)
+    return prefixed
+}
+
+// The Concat KDF of RFC 7518 section 4.6.2, one round of SHA-256 is enough
+// for every key size we use.
+async function concatKDF (z, enc, bits) {
+    const supplied = Buffer.alloc(4)
+    supplied.writeUInt32BE(bits)
+    const input = Buffer.concat([
+        Buffer.from([ 0, 0, 0, 1 ]), Buffer.from(z),
+        lengthPrefixed(Buffer.from(enc)), lengthPrefixed(apu), lengthPrefixed(apv),
+        supplied
+    ])
+    return Buffer.from(await subtle.digest('SHA-256', input)).subarray(0, bits / 8)
+}
+
+async function seal (header, key, plain) {
+    const encoded = encode64(JSON.stringify(sorted(header)))
+    const iv = webcrypto.getRandomValues(new Uint8Array(12))
+    const sealed = Buffer.from(await subtle.encrypt({ name: 'AES-GCM', iv, additionalData: Buffer.from(encoded), tagLength: 128 }, key, plain))
+    const ciphertext = sealed.subarray(0, sealed.length - 16)
+    const tag = sealed.subarray(sealed.length - 16)
+    return [ encoded, '', encode64(iv), encode64(ciphertext), encode64(tag) ].join('.')
+}
+
+async function advertisement () {
+    const response = await fetch(`${url}/adv/${thp}`)
+    const jws = await response.json()
+    const jwks = JSON.parse(Buffer.from(jws.payload, 'base64url').toString())
+
+    const ver = jwks.keys.filter(key => key.key_ops.includes('verify')).shift()
+    assert.equal(await thumbprint(ver), thp)
+    const curve = curves[ver.crv]
+    const verifier = await subtle.importKey('jwk', { kty: ver.kty, crv: ver.crv, x: ver.x, y: ver.y }, { name: 'ECDSA', namedCurve: ver.crv }, false, [ 'verify' ])
+    // A single signature is flattened into the JWS.
+    const signatures = jws.signatures || [ { protected: jws.protected, signature: jws.signature } ]
+    let verified = false
+    for (const signature of signatures) {
+        verified = verified || await subtle.verify({ name: 'ECDSA', hash: curve.hash }, verifier,
+            Buffer.from(signature.signature, 'base64url'), Buffer.from(`${signature.protected}.${jws.payload}`))
+    }
+    assert(verified, 'advertisement is not signed by the verify key')
+    return jwks
+}
+
+async function tang (jwks, plain) {
+    const exchange = jwks.keys.filter(key => key.key_ops.includes('deriveKey')).shift()
+    const exchangeKey = await subtle.importKey('jwk', { kty: exchange.kty, crv: exchange.crv, x: exchange.x, y: exchange.y }, { name: 'ECDH', namedCurve: exchange.crv }, false, [])
+    const ephemeral = await subtle.generateKey({ name: 'ECDH', namedCurve: exchange.crv }, true, [ 'deriveBits' ])
+    const z = await subtle.deriveBits({ name: 'ECDH', public: exchangeKey }, ephemeral.privateKey, curves[exchange.crv].bits)
+    const epk = await subtle.exportKey('jwk', ephemeral.publicKey)
+
+    const header = {
+        alg: 'ECDH-ES',
+        enc: 'A256GCM',
+        clevis: { pin: 'tang', tang: { url: clevisURL, adv: jwks } },
+        epk: { crv: epk.crv, kty: epk.kty, x: epk.x, y: epk.y },
+        kid: await thumbprint(exchange)
+    }
+    if (apu.length != 0) {
+        header.apu = encode64(apu)
+    }
+    if (apv.length != 0) {
+        header.apv = encode64(apv)
+    }
+    const key = await subtle.importKey('raw', await concatKDF(z, 'A256GCM', 256), 'AES-GCM', false, [ 'encrypt' ])
+    return seal(header, key, plain)
+}
+
+function fixed (value) {
+    return Buffer.from(value.toString(16).padStart(64, '0'), 'hex')
+}
+
+// As clevis does, the key is the constant term of a random polynomial of
+// degree t - 1 over a 256 bit safe prime and each pin encrypts a point of it,
+// x and y of 32 bytes each.
+async function sss (jwks, t, n, plain) {
+    const p = generatePrimeSync(256, { safe: true, bigint: true })
+    const random = () => BigInt('0x' + randomBytes(32).toString('hex')) % p
+    const coefficients = Array.from({ length: t }, random)
+    const shares = []
+    for (let i = 0; i < n; i++) {
+        const x = random()
+        let y = 0n
+        for (const coefficient of coefficients.slice().reverse()) {
+            y = (y * x + coefficient) % p
+        }
+        shares.push(await tang(jwks, Buffer.concat([ fixed(x), fixed(y) ])))
+    }
+    const header = {
+        alg: 'dir',
+        enc: 'A256GCM',
+        clevis: { pin: 'sss', sss: { p: encode64(fixed(p)), t, jwe: shares } }
+    }
+    const key = await subtle.importKey('raw', fixed(coefficients[0]), 'AES-GCM', false, [ 'encrypt' ])
+    return seal(header, key, plain)
+}
+
+async function main () {
+    const jwks = await advertisement()
+    const chunks = []
+    for await (const chunk of process.stdin) {
+        chunks.push(chunk)
+    }
+    const plain = Buffer.concat(chunks)
+    if (process.env.SSS_T) {
+        console.log(await sss(jwks, +process.env.SSS_T, +process.env.SSS_N, plain))
+    } else {
+        console.log(await tang(jwks, plain))
+    }
+}
+
+main()
@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerListener accepts only connections from processes running as one of the
+// allowed users and closes the others.
+type peerListener struct {
+	net.Listener
+	uids   map[uint32]bool
+	plugin *Plugin
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err == nil && l.uids[uid] {
+			return conn, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("peer uid %d is not allowed", uid)
+		}
+		l.plugin.state().logger.Err(fmt.Errorf("refused connection: %w", err))
+		conn.Close()
+	}
+}
@@ -0,0 +1,31 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerUID is the user ID of the process at the other end of a unix domain
+// socket, as the kernel recorded it when the process connected.
+func peerUID(conn net.Conn) (uid uint32, err error) {
+	unix, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("peer credentials need a unix domain socket, got %T", conn)
+	}
+	raw, err := unix.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var ucred *syscall.Ucred
+	controlErr := raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if controlErr != nil {
+		return 0, controlErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ucred.Uid, nil
+}
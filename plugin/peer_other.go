@@ -0,0 +1,12 @@
+//go:build !linux
+
+package plugin
+
+import (
+	"errors"
+	"net"
+)
+
+func peerUID(conn net.Conn) (uint32, error) {
+	return 0, errors.New("peer credentials are only supported on Linux")
+}
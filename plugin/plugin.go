@@ -2,34 +2,81 @@ package plugin
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 
-	"github.com/flatheadmill/tang-encryption-provider/crypter"
 	"github.com/lainio/err2"
 	"github.com/lainio/err2/try"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/flatheadmill/tang-encryption-provider/allow"
+	"github.com/flatheadmill/tang-encryption-provider/buildinfo"
+	"github.com/flatheadmill/tang-encryption-provider/cache"
+	"github.com/flatheadmill/tang-encryption-provider/flight"
 	"github.com/flatheadmill/tang-encryption-provider/handler"
+	"github.com/flatheadmill/tang-encryption-provider/limit"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
 )
 
 const (
-	netProtocol    = "unix"
-	apiVersion     = "v1beta1"
-	runtimeName    = "TangKMS"
-	runtimeVersion = "0.0.1"
+	netProtocol = "unix"
+	apiVersion  = "v1beta1"
+	runtimeName = "TangKMS"
 )
 
+// Stamped by the toolchain from the module version and the VCS revision.
+var runtimeVersion = buildinfo.Read().RuntimeVersion()
+
 type Crypter interface {
-	Encrypt(plain []byte) (cipher []byte, err error)
-	Decrypt(cipher []byte) (plain []byte, err error)
+	Encrypt(ctx context.Context, plain []byte) (cipher []byte, err error)
+	Decrypt(ctx context.Context, cipher []byte) (plain []byte, err error)
+}
+
+// Limits bound the calls the plugin serves at once. Zero means no limit, or
+// gRPC's default for the message sizes.
+type Limits struct {
+	MaxConcurrentEncrypts int
+	MaxConcurrentDecrypts int
+	// Calls beyond the concurrent limits wait in a queue this long, or until
+	// their deadline, and are refused with ResourceExhausted when it is full.
+	MaxQueued      int
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+}
+
+// Policy is the part of the profile the plugin enforces itself.
+type Policy struct {
+	// Log the JWE of every call, for debugging, until a reload says otherwise.
+	LogPayloads bool
+	// When not empty only processes running as these users may connect.
+	PeerUIDs []uint32
+}
+
+// The crypter and the logging are replaced together when the configuration is
+// reloaded, calls in progress finish with the ones they started with.
+type state struct {
+	crypter     Crypter
+	logger      logger
+	logPayloads bool
 }
 
 type Plugin struct {
-	crypter Crypter
+	current atomic.Value
 	socket  string
-	logger  logger
+	limits  Limits
+	policy  Policy
+	// Optional, nil when decrypts are not cached.
+	decryptCache *cache.Cache
+	decrypts     flight.Group
+	encrypting   *limit.Semaphore
+	decrypting   *limit.Semaphore
 	net.Listener
 	*grpc.Server
 }
@@ -43,51 +90,186 @@ type logger interface {
 
 type LogFields map[string]interface{}
 
-func New(l logger, crypter Crypter, socket string) (plugin *Plugin, err error) {
+func New(l logger, crypter Crypter, socket string, decryptCache *cache.Cache, limits Limits, policy Policy) (plugin *Plugin, err error) {
 	defer err2.Handle(&err, handler.Handler(&err))
 
-	return &Plugin{crypter: crypter, socket: socket, logger: l}, nil
+	plugin = &Plugin{
+		socket:       socket,
+		limits:       limits,
+		policy:       policy,
+		decryptCache: decryptCache,
+		encrypting:   limit.NewSemaphore(limits.MaxConcurrentEncrypts, limits.MaxQueued),
+		decrypting:   limit.NewSemaphore(limits.MaxConcurrentDecrypts, limits.MaxQueued),
+	}
+	plugin.current.Store(&state{crypter: crypter, logger: l, logPayloads: policy.LogPayloads})
+	return plugin, nil
+}
+
+func (g *Plugin) state() *state {
+	return g.current.Load().(*state)
+}
+
+// Reload replaces the crypter, the logger and whether payloads are logged
+// without stopping the server and purges the decrypt cache, so nothing
+// decrypted under the old configuration is served under the new one.
+func (g *Plugin) Reload(l logger, crypter Crypter, logPayloads bool) {
+	g.current.Store(&state{crypter: crypter, logger: l, logPayloads: logPayloads})
+	if g.decryptCache != nil {
+		g.decryptCache.Purge()
+	}
+}
+
+// Health checks the current crypter if it can be checked.
+func (g *Plugin) Health() error {
+	if healther, ok := g.state().crypter.(interface{ Health() error }); ok {
+		return healther.Health()
+	}
+	return nil
+}
+
+// The err2 handler wraps errors, which hides a gRPC status from grpc, so the
+// limits are applied outside of it and errors are turned into a status here.
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, limit.ErrSaturated):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, allow.ErrNotAllowed), errors.Is(err, suite.ErrRejected):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
+
+// We speak only v1beta1, the apiserver sends it on every request.
+func checkVersion(version string) error {
+	if version != apiVersion {
+		return status.Errorf(codes.InvalidArgument, "unsupported KMS API version %q, expected %q", version, apiVersion)
+	}
+	return nil
+}
+
+func (s *state) payload(jwe []byte) LogFields {
+	if !s.logPayloads {
+		return LogFields{}
+	}
+	return LogFields{"jwe": string(jwe)}
 }
 
 func (g *Plugin) Version(ctx context.Context, request *VersionRequest) (*VersionResponse, error) {
+	if err := checkVersion(request.Version); err != nil {
+		return nil, err
+	}
 	return &VersionResponse{Version: apiVersion, RuntimeName: runtimeName, RuntimeVersion: runtimeVersion}, nil
 }
 
+func (g *Plugin) Encrypt(ctx context.Context, request *EncryptRequest) (*EncryptResponse, error) {
+	if err := checkVersion(request.Version); err != nil {
+		return nil, err
+	}
+	if err := g.encrypting.Acquire(ctx); err != nil {
+		return nil, grpcError(err)
+	}
+	defer g.encrypting.Release()
+	response, err := g.encrypt(ctx, request)
+	return response, grpcError(err)
+}
+
 // TODO Notify only of error and add metrics.
-func (g *Plugin) Encrypt(ctx context.Context, request *EncryptRequest) (response *EncryptResponse, err error) {
+// The plain text of the request is zeroed once it is encrypted.
+func (g *Plugin) encrypt(ctx context.Context, request *EncryptRequest) (response *EncryptResponse, err error) {
 	defer err2.Handle(&err, handler.Handler(&err))
-	cipher := try.To1(g.crypter.Encrypt(request.Plain))
-	g.logger.MsgWithFields(LogFields{"jwe": string(cipher)}, "encrypted")
+	defer secret.Wipe(request.Plain)
+	state := g.state()
+	cipher := try.To1(state.crypter.Encrypt(ctx, request.Plain))
+	state.logger.MsgWithFields(state.payload(cipher), "encrypted")
 	return &EncryptResponse{Cipher: cipher}, nil
 }
 
+// Cache hits do not count against the limit.
+func (g *Plugin) Decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
+	if err := checkVersion(request.Version); err != nil {
+		return nil, err
+	}
+	state := g.state()
+	state.logger.MsgWithFields(state.payload(request.Cipher), "decrypting")
+	if g.decryptCache != nil {
+		if plain, ok := g.decryptCache.Get(request.Cipher); ok {
+			return &DecryptResponse{Plain: plain}, nil
+		}
+	}
+	if err := g.decrypting.Acquire(ctx); err != nil {
+		return nil, grpcError(err)
+	}
+	defer g.decrypting.Release()
+	response, err := g.decrypt(ctx, request)
+	return response, grpcError(err)
+}
+
 // TODO Notify only of error and add metrics.
-func (g *Plugin) Decrypt(ctx context.Context, request *DecryptRequest) (response *DecryptResponse, err error) {
+func (g *Plugin) decrypt(ctx context.Context, request *DecryptRequest) (response *DecryptResponse, err error) {
 	defer err2.Handle(&err, handler.Handler(&err))
-	g.logger.MsgWithFields(LogFields{"jwe": string(request.Cipher)}, "decrypting")
-	plain := try.To1(crypter.Decrypt(request.Cipher))
+	// Identical ciphertexts decrypted at the same time share one decrypt,
+	// which carries on when the caller that started it gives up and has
+	// until the latest deadline of the callers still waiting for it.
+	crypter := g.state().crypter
+	plain, _ := try.To2(g.decrypts.Do(ctx, request.Cipher, func(ctx context.Context) ([]byte, error) {
+		plain, err := crypter.Decrypt(ctx, request.Cipher)
+		if err == nil && g.decryptCache != nil {
+			g.decryptCache.Put(request.Cipher, plain)
+		}
+		return plain, err
+	}))
 	return &DecryptResponse{Plain: plain}, nil
 }
 
+// The plain text of every decrypt response is zeroed once it is sent, each
+// response has a copy of its own.
+func (g *Plugin) serverOptions() (options []grpc.ServerOption) {
+	options = append(options, grpc.StatsHandler(wiper{}))
+	if g.limits.MaxRecvMsgSize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(g.limits.MaxRecvMsgSize))
+	}
+	if g.limits.MaxSendMsgSize > 0 {
+		options = append(options, grpc.MaxSendMsgSize(g.limits.MaxSendMsgSize))
+	}
+	return options
+}
+
 func (g *Plugin) setupRPCServer() (err error) {
 	defer err2.Handle(&err, handler.Handler(&err))
 
-	// @ implies the use of Linux socket namespace - no file on disk and nothing
-	// to clean-up.
-	if !strings.HasPrefix(g.socket, "@") {
-		try.To(func() error {
-			err = os.Remove(g.socket)
-			if err != nil && !os.IsNotExist(err) {
-				return err
-			}
-			return nil
-		}())
-	}
+	// A listener set before serving was passed to us, by systemd socket
+	// activation, and its socket is not ours to create or remove.
+	if g.Listener != nil {
+		g.state().logger.Msgf("Listening on activated socket: %s", g.Listener.Addr())
+	} else {
+		// @ implies the use of Linux socket namespace - no file on disk and
+		// nothing to clean-up.
+		if !strings.HasPrefix(g.socket, "@") {
+			try.To(func() error {
+				err = os.Remove(g.socket)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			}())
+		}
 
-	g.Listener = try.To1(net.Listen(netProtocol, g.socket))
-	g.logger.Msgf("Listening on unix domain socket: %s", g.socket)
+		g.Listener = try.To1(net.Listen(netProtocol, g.socket))
+		g.state().logger.Msgf("Listening on unix domain socket: %s", g.socket)
+	}
+	if len(g.policy.PeerUIDs) != 0 {
+		uids := map[uint32]bool{}
+		for _, uid := range g.policy.PeerUIDs {
+			uids[uid] = true
+		}
+		g.Listener = &peerListener{Listener: g.Listener, uids: uids, plugin: g}
+	}
 
-	g.Server = grpc.NewServer()
+	g.Server = grpc.NewServer(g.serverOptions()...)
 	RegisterKeyManagementServiceServer(g.Server, g)
 
 	return nil
@@ -109,3 +291,33 @@ func (g *Plugin) ServeKMSRequests() (*grpc.Server, chan error) {
 
 	return g.Server, errorChannel
 }
+
+func (g *Plugin) unixListener() (*net.UnixListener, error) {
+	listener := g.Listener
+	if peer, ok := listener.(*peerListener); ok {
+		listener = peer.Listener
+	}
+	unix, ok := listener.(*net.UnixListener)
+	if !ok {
+		return nil, fmt.Errorf("can not hand off a %T", listener)
+	}
+	return unix, nil
+}
+
+// ListenerFile returns a duplicate of the socket's file descriptor, to hand
+// to a replacement process.
+func (g *Plugin) ListenerFile() (*os.File, error) {
+	unix, err := g.unixListener()
+	if err != nil {
+		return nil, err
+	}
+	return unix.File()
+}
+
+// HandedOff keeps the socket from being removed when we stop serving, once
+// the replacement serves it.
+func (g *Plugin) HandedOff() {
+	if unix, err := g.unixListener(); err == nil {
+		unix.SetUnlinkOnClose(false)
+	}
+}
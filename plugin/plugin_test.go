@@ -0,0 +1,423 @@
+package plugin_test
+
+import (
+	"context"
+	"crypto/elliptic"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/flatheadmill/tang-encryption-provider/allow"
+	"github.com/flatheadmill/tang-encryption-provider/bench"
+	"github.com/flatheadmill/tang-encryption-provider/buildinfo"
+	"github.com/flatheadmill/tang-encryption-provider/crypter"
+	"github.com/flatheadmill/tang-encryption-provider/limit"
+	"github.com/flatheadmill/tang-encryption-provider/logger"
+	"github.com/flatheadmill/tang-encryption-provider/plugin"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+// serve starts a plugin on a socket in a temporary directory and returns a
+// client for it.
+func serve(t *testing.T, crypt plugin.Crypter, limits plugin.Limits, policy plugin.Policy) plugin.KeyManagementServiceClient {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "kms.sock")
+	plug, err := plugin.New(logger.New(ioutil.Discard), crypt, socket, nil, limits, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc, errs := plug.ServeKMSRequests()
+	if rpc == nil {
+		t.Fatal(<-errs)
+	}
+	t.Cleanup(rpc.Stop)
+	conn, err := bench.Dial(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return plugin.NewKeyManagementServiceClient(conn)
+}
+
+// newCrypter returns a crypter for a Tang server on a loopback port whose
+// requests go through the transport returned for the server's URL.
+func newCrypter(t *testing.T, transport func(url string) http.RoundTripper) (*crypter.Crypter, *tangtest.Server) {
+	t.Helper()
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := server.Start()
+	t.Cleanup(listener.Close)
+	httpClient := &http.Client{Transport: transport(listener.URL)}
+	newClient := func(url string) (*tang.Client, error) {
+		client, err := tang.NewClient(url)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+		return client, nil
+	}
+	crypt, err := crypter.NewCrypter(newClient, listener.URL, server.Thumbprint(), suite.Default, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypt, server
+}
+
+// The advertisement takes the only token, the next comes in 200ms. A call
+// whose deadline is sooner is refused without waiting and without a
+// recovery, one whose deadline is later waits for the token.
+func TestDecryptDeadline(t *testing.T) {
+	crypt, server := newCrypter(t, func(string) http.RoundTripper {
+		return limit.NewTransport(nil, 5, 1)
+	})
+	cipher, err := crypt.Encrypt(context.Background(), []byte("deadline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, crypt, plugin.Limits{}, plugin.Policy{})
+
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		code       codes.Code
+		recoveries int64
+	}{
+		{"refused", 50 * time.Millisecond, codes.ResourceExhausted, 0},
+		{"waits", 5 * time.Second, codes.OK, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			start := time.Now()
+			response, err := client.Decrypt(ctx, &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %v, want %v: %v", code, test.code, err)
+			}
+			if err != nil && time.Since(start) >= test.timeout {
+				t.Errorf("refused after %v, not before the deadline of %v", time.Since(start), test.timeout)
+			}
+			if err == nil && string(response.Plain) != "deadline" {
+				t.Errorf("got %q", response.Plain)
+			}
+			if _, recoveries := server.Counts(); recoveries != test.recoveries {
+				t.Errorf("got %d recoveries, want %d", recoveries, test.recoveries)
+			}
+		})
+	}
+}
+
+// gated holds every decrypt until it is released, so that the callers of a
+// coalesced decrypt have all joined before it completes.
+type gated struct {
+	*crypter.Crypter
+	release chan struct{}
+}
+
+func (g gated) Decrypt(ctx context.Context, cipher []byte) ([]byte, error) {
+	<-g.release
+	return g.Crypter.Decrypt(ctx, cipher)
+}
+
+func direct(string) http.RoundTripper {
+	return http.DefaultTransport
+}
+
+// Concurrent decrypts of the same ciphertext cost one Tang recovery, and a
+// caller that gives up does not fail the others.
+func TestDecryptFlight(t *testing.T) {
+	crypt, server := newCrypter(t, direct)
+	cipher, err := crypt.Encrypt(context.Background(), []byte("flight"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := gated{Crypter: crypt, release: make(chan struct{})}
+	plug, err := plugin.New(logger.New(ioutil.Discard), gate, "", nil, plugin.Limits{}, plugin.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 16
+	var wait sync.WaitGroup
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			response, err := plug.Decrypt(context.Background(), &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+			if err == nil && string(response.Plain) != "flight" {
+				err = fmt.Errorf("got %q", response.Plain)
+			}
+			errs[i] = err
+		}(i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, canceled := plug.Decrypt(ctx, &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+	time.Sleep(50 * time.Millisecond)
+	close(gate.release)
+	wait.Wait()
+
+	if code := status.Code(canceled); code != codes.Canceled {
+		t.Errorf("canceled caller got %v, want %v", code, codes.Canceled)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d: %v", i, err)
+		}
+	}
+	if _, recoveries := server.Counts(); recoveries != 1 {
+		t.Errorf("got %d recoveries, want 1", recoveries)
+	}
+}
+
+// Calls beyond the concurrent limit and the queue are refused with
+// ResourceExhausted rather than left to pile up on Tang.
+func TestDecryptSaturated(t *testing.T) {
+	crypt, _ := newCrypter(t, direct)
+	cipher, err := crypt.Encrypt(context.Background(), []byte("saturated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := gated{Crypter: crypt, release: make(chan struct{})}
+	client := serve(t, gate, plugin.Limits{MaxConcurrentDecrypts: 1, MaxQueued: 1}, plugin.Policy{})
+
+	decrypt := func() error {
+		_, err := client.Decrypt(context.Background(), &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+		return err
+	}
+	admitted := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { admitted <- decrypt() }()
+		time.Sleep(20 * time.Millisecond)
+	}
+	saturated := decrypt()
+	close(gate.release)
+
+	if code := status.Code(saturated); code != codes.ResourceExhausted {
+		t.Errorf("got %v, want %v: %v", code, codes.ResourceExhausted, saturated)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-admitted; err != nil {
+			t.Errorf("admitted call got %v", err)
+		}
+	}
+}
+
+// A ciphertext naming a Tang server outside the decrypt allowlist is refused
+// with PermissionDenied before any request is sent.
+func TestDecryptAllowlist(t *testing.T) {
+	crypt, server := newCrypter(t, func(url string) http.RoundTripper {
+		return allow.NewTransport(nil, allow.List{url})
+	})
+	allowed, err := crypt.Encrypt(context.Background(), []byte("allowed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elsewhere, err := crypter.NewCrypter(server.NewClient, "http://tang.elsewhere", server.Thumbprint(), suite.Default, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused, err := elsewhere.Encrypt(context.Background(), []byte("refused"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, crypt, plugin.Limits{}, plugin.Policy{})
+
+	tests := []struct {
+		name   string
+		cipher []byte
+		code   codes.Code
+	}{
+		{"allowed", allowed, codes.OK},
+		{"refused", refused, codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := client.Decrypt(context.Background(), &plugin.DecryptRequest{Version: "v1beta1", Cipher: test.cipher})
+			if code := status.Code(err); code != test.code {
+				t.Errorf("got %v, want %v: %v", code, test.code, err)
+			}
+		})
+	}
+	if _, recoveries := server.Counts(); recoveries != 1 {
+		t.Errorf("got %d recoveries, want 1", recoveries)
+	}
+}
+
+// The socket closes connections from processes of users not in the peer
+// allowlist.
+func TestPeerUIDs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	crypt, _ := newCrypter(t, direct)
+	uid := uint32(os.Getuid())
+	tests := []struct {
+		name    string
+		uids    []uint32
+		allowed bool
+	}{
+		{"own uid", []uint32{uid}, true},
+		{"other uid", []uint32{uid + 1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := serve(t, crypt, plugin.Limits{}, plugin.Policy{PeerUIDs: test.uids})
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := client.Version(ctx, &plugin.VersionRequest{Version: "v1beta1"})
+			if allowed := err == nil; allowed != test.allowed {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+// keeping keeps the plain text the plugin gets from the crypter.
+type keeping struct {
+	*crypter.Crypter
+	plain []byte
+}
+
+func (k *keeping) Decrypt(ctx context.Context, cipher []byte) ([]byte, error) {
+	plain, err := k.Crypter.Decrypt(ctx, cipher)
+	k.plain = plain
+	return plain, err
+}
+
+// Plain texts are zeroed once they are used: the plain text of an encrypt
+// request and the plain text a decrypt shares out once every caller has its
+// copy. Decrypts through the socket, whose responses are zeroed once sent,
+// still arrive intact.
+func TestWipe(t *testing.T) {
+	crypt, _ := newCrypter(t, direct)
+	kept := &keeping{Crypter: crypt}
+	cipher, err := crypt.Encrypt(context.Background(), []byte("wipe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plug, err := plugin.New(logger.New(ioutil.Discard), kept, "", nil, plugin.Limits{}, plugin.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &plugin.EncryptRequest{Version: "v1beta1", Plain: []byte("a data encryption key")}
+	if _, err := plug.Encrypt(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if !secret.Wiped(request.Plain) {
+		t.Errorf("encrypt request left in memory: %q", request.Plain)
+	}
+
+	response, err := plug.Decrypt(context.Background(), &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response.Plain) != "wipe" {
+		t.Errorf("got %q", response.Plain)
+	}
+	if kept.plain == nil || !secret.Wiped(kept.plain) {
+		t.Errorf("decrypted plain text left in memory: %q", kept.plain)
+	}
+
+	client := serve(t, kept, plugin.Limits{}, plugin.Policy{})
+	sent, err := client.Decrypt(context.Background(), &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sent.Plain) != "wipe" {
+		t.Errorf("socket decrypt got %q", sent.Plain)
+	}
+}
+
+// A JWE the decrypt policy rejects is refused with PermissionDenied.
+func TestDecryptRejected(t *testing.T) {
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Suite{Alg: suite.ECDHES, Enc: suite.A128GCM}, suite.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := weak.Encrypt(context.Background(), []byte("weak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypt, err := crypter.NewCrypter(server.NewClient, tangtest.URL, server.Thumbprint(), suite.Default, suite.Policy{Encryptions: []string{suite.A256GCM}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, crypt, plugin.Limits{}, plugin.Policy{})
+	_, err = client.Decrypt(context.Background(), &plugin.DecryptRequest{Version: "v1beta1", Cipher: cipher})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("got %v, want %v: %v", code, codes.PermissionDenied, err)
+	}
+}
+
+// Every call names the KMS API version, anything but v1beta1 is refused
+// before the crypter is used.
+func TestVersion(t *testing.T) {
+	crypt, server := newCrypter(t, direct)
+	cipher, err := crypt.Encrypt(context.Background(), []byte("version"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := serve(t, crypt, plugin.Limits{}, plugin.Policy{})
+	calls := map[string]func(ctx context.Context, version string) error{
+		"version": func(ctx context.Context, version string) error {
+			response, err := client.Version(ctx, &plugin.VersionRequest{Version: version})
+			if err == nil {
+				want := plugin.VersionResponse{Version: "v1beta1", RuntimeName: "TangKMS", RuntimeVersion: buildinfo.Read().RuntimeVersion()}
+				if response.Version != want.Version || response.RuntimeName != want.RuntimeName || response.RuntimeVersion != want.RuntimeVersion {
+					t.Errorf("got %v, want %v", response, &want)
+				}
+			}
+			return err
+		},
+		"encrypt": func(ctx context.Context, version string) error {
+			_, err := client.Encrypt(ctx, &plugin.EncryptRequest{Version: version, Plain: []byte("version")})
+			return err
+		},
+		"decrypt": func(ctx context.Context, version string) error {
+			_, err := client.Decrypt(ctx, &plugin.DecryptRequest{Version: version, Cipher: cipher})
+			return err
+		},
+	}
+	for name, call := range calls {
+		for _, version := range []string{"v1beta1", "v1", "v2", ""} {
+			t.Run(name+"/"+version, func(t *testing.T) {
+				_, before := server.Counts()
+				err := call(context.Background(), version)
+				_, after := server.Counts()
+				if version == "v1beta1" {
+					if err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				if code := status.Code(err); code != codes.InvalidArgument {
+					t.Errorf("got %v, want %v: %v", code, codes.InvalidArgument, err)
+				}
+				if after != before {
+					t.Errorf("%d recoveries for a refused call", after-before)
+				}
+			})
+		}
+	}
+}
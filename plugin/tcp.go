@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/flatheadmill/tang-encryption-provider/mtls"
+)
+
+// Clients that are not Kubernetes reach the plugin over TCP, authenticated
+// by mutual TLS and authorized by the subject of their certificate.
+func authorizeSubjects(subjects []string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		client, ok := peer.FromContext(ctx)
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "no peer")
+		}
+		tlsInfo, ok := client.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+			return nil, status.Error(codes.Unauthenticated, "no verified client certificate")
+		}
+		certificate := tlsInfo.State.VerifiedChains[0][0]
+		if !mtls.Authorized(certificate, subjects) {
+			return nil, status.Errorf(codes.PermissionDenied, "client %q is not authorized", certificate.Subject.String())
+		}
+		return handler(ctx, request)
+	}
+}
+
+// ServeTCP serves the same plugin on a TCP listener with mutual TLS, beside
+// the unix domain socket, authorizing the clients whose certificate subjects
+// are among subjects, or every client the CA vouches for when it is empty.
+func (g *Plugin) ServeTCP(listener net.Listener, config *tls.Config, subjects []string) (*grpc.Server, chan error) {
+	errorChannel := make(chan error, 1)
+
+	options := append(g.serverOptions(), grpc.Creds(credentials.NewTLS(config)), grpc.UnaryInterceptor(authorizeSubjects(subjects)))
+	server := grpc.NewServer(options...)
+	RegisterKeyManagementServiceServer(server, g)
+	g.state().logger.Msgf("Listening with mutual TLS on %s", listener.Addr())
+
+	go func() {
+		defer close(errorChannel)
+		errorChannel <- server.Serve(listener)
+	}()
+
+	return server, errorChannel
+}
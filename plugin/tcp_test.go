@@ -0,0 +1,141 @@
+package plugin_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/flatheadmill/tang-encryption-provider/logger"
+	"github.com/flatheadmill/tang-encryption-provider/mtls"
+	"github.com/flatheadmill/tang-encryption-provider/plugin"
+)
+
+type issued struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pair        tls.Certificate
+}
+
+// issue creates a certificate for the subject, signed by the issuer or self
+// signed when the issuer is nil.
+func issue(t *testing.T, issuer *issued, name string, ca bool) *issued {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"plugin"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.certificate, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issued{certificate: certificate, key: key, pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func writePEM(t *testing.T, path string, kind string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The TCP listener serves only clients with a certificate from the CA whose
+// subject is allowed.
+func TestServeTCP(t *testing.T) {
+	ca := issue(t, nil, "plugin CA", true)
+	server := issue(t, ca, "tang-kms", false)
+
+	dir := t.TempDir()
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.certificate.Raw)
+	writePEM(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", server.certificate.Raw)
+	der, err := x509.MarshalECPrivateKey(server.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "key.pem"), "EC PRIVATE KEY", der)
+	config, err := mtls.ServerConfig(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crypt, _ := newCrypter(t, direct)
+	plug, err := plugin.New(logger.New(ioutil.Discard), crypt, "", nil, plugin.Limits{}, plugin.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc, _ := plug.ServeTCP(listener, config, []string{"CN=allowed,O=plugin"})
+	defer rpc.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	tests := []struct {
+		name   string
+		client *issued
+		ok     func(err error) bool
+	}{
+		{"allowed subject", issue(t, ca, "allowed", false), func(err error) bool { return err == nil }},
+		{"other subject", issue(t, ca, "other", false), func(err error) bool { return status.Code(err) == codes.PermissionDenied }},
+		{"other CA", issue(t, issue(t, nil, "other CA", true), "allowed", false), func(err error) bool { return err != nil }},
+		{"no certificate", nil, func(err error) bool { return err != nil }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: roots}
+			if test.client != nil {
+				config.Certificates = []tls.Certificate{test.client.pair}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			conn, err := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(config)))
+			if err == nil {
+				defer conn.Close()
+				_, err = plugin.NewKeyManagementServiceClient(conn).Version(ctx, &plugin.VersionRequest{Version: "v1beta1"})
+			}
+			if !test.ok(err) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	"context"
+
+	"google.golang.org/grpc/stats"
+
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+// wiper zeroes the plain text of a decrypt response once gRPC has encoded it.
+// gRPC reports the payload after it has handed the encoding to the transport,
+// the encoding is gRPC's and beyond our reach.
+type wiper struct{}
+
+func (wiper) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (wiper) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if out, ok := s.(*stats.OutPayload); ok {
+		if response, ok := out.Payload.(*DecryptResponse); ok {
+			secret.Wipe(response.Plain)
+		}
+	}
+}
+
+func (wiper) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (wiper) HandleConn(context.Context, stats.ConnStats) {}
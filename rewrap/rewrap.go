@@ -0,0 +1,157 @@
+package rewrap
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+
+	"github.com/flatheadmill/tang-encryption-provider/corpus"
+	"github.com/flatheadmill/tang-encryption-provider/envelope"
+	"github.com/flatheadmill/tang-encryption-provider/inspect"
+	"github.com/flatheadmill/tang-encryption-provider/secret"
+)
+
+type Crypter interface {
+	Encrypt(ctx context.Context, plain []byte) (cipher []byte, err error)
+	Decrypt(ctx context.Context, cipher []byte) (plain []byte, err error)
+	KeyID() string
+}
+
+type Status string
+
+const (
+	Rewrapped Status = "rewrapped"
+	Current   Status = "current"
+	Failed    Status = "failed"
+	// Skipped is the status of sss values, rewrapping them to a single tang
+	// pin would drop their threshold policy.
+	Skipped Status = "skipped"
+	// InUse is the status of every value in a dry run.
+	InUse Status = "in-use"
+)
+
+type Result struct {
+	Item   corpus.Item
+	KeyID  string
+	Status Status
+	Value  []byte
+	Err    error
+}
+
+type Rewrapper struct {
+	crypter Crypter
+	dryRun  bool
+}
+
+func New(crypter Crypter, dryRun bool) *Rewrapper {
+	return &Rewrapper{crypter: crypter, dryRun: dryRun}
+}
+
+// Rewrap decrypts a JWE with whatever Tang key it names and encrypts the
+// plain text with the current key. Only the DEK of a KMS envelope value is
+// rewrapped, the data encrypted with the DEK is left as is. Values bound with
+// the sss pin are skipped and left as they are.
+func (r *Rewrapper) Rewrap(ctx context.Context, item corpus.Item) (result Result) {
+	result = Result{Item: item}
+
+	rewrap := func() (err error) {
+		defer err2.Return(&err)
+		err2.Check(item.Err)
+
+		var parsed *envelope.Envelope
+		cipher := item.Value
+		if envelope.IsEnvelope(cipher) {
+			parsed = try.To1(envelope.Parse(cipher))
+			cipher = parsed.Key
+		}
+
+		report := try.To1(inspect.Inspect(cipher))
+		if report.Pin == "sss" {
+			result.Status = Skipped
+			result.Value = item.Value
+			return nil
+		}
+		result.KeyID = report.KeyID
+		if r.dryRun {
+			result.Status = InUse
+			return nil
+		}
+		if result.KeyID == r.crypter.KeyID() {
+			result.Status = Current
+			result.Value = item.Value
+			return nil
+		}
+
+		plain := try.To1(r.crypter.Decrypt(ctx, cipher))
+		defer secret.Wipe(plain)
+		rewrapped := try.To1(r.crypter.Encrypt(ctx, plain))
+		if parsed != nil {
+			parsed.Key = rewrapped
+			rewrapped = parsed.Bytes()
+		}
+
+		result.Status = Rewrapped
+		result.Value = rewrapped
+		return nil
+	}
+
+	if result.Err = rewrap(); result.Err != nil {
+		result.Status = Failed
+	}
+	return result
+}
+
+// All rewraps the items using at most concurrency goroutines and returns the
+// results in the order of the items.
+func (r *Rewrapper) All(ctx context.Context, items []corpus.Item, concurrency int) []Result {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]Result, len(items))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				results[index] = r.Rewrap(ctx, items[index])
+			}
+		}()
+	}
+	for index := range items {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
+
+type Count struct {
+	KeyID  string
+	Status Status
+	Count  int
+}
+
+// Summarize counts results by key ID and status, sorted by key ID.
+func Summarize(results []Result) []Count {
+	counts := map[Count]int{}
+	for _, result := range results {
+		counts[Count{KeyID: result.KeyID, Status: result.Status}]++
+	}
+	summary := []Count{}
+	for count, n := range counts {
+		count.Count = n
+		summary = append(summary, count)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].KeyID == summary[j].KeyID {
+			return summary[i].Status < summary[j].Status
+		}
+		return summary[i].KeyID < summary[j].KeyID
+	})
+	return summary
+}
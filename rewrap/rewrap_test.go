@@ -0,0 +1,182 @@
+package rewrap_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flatheadmill/tang-encryption-provider/corpus"
+	"github.com/flatheadmill/tang-encryption-provider/envelope"
+	"github.com/flatheadmill/tang-encryption-provider/rewrap"
+)
+
+// crypter stands in for a Tang crypter. Its JWEs carry the plain text in the
+// clear after a header naming the kid they were "encrypted" to, and it
+// decrypts only those of the kids it knows. It keeps what it decrypted to
+// check that the plain texts are wiped.
+type crypter struct {
+	kid       string
+	known     map[string]bool
+	mutex     sync.Mutex
+	decrypted [][]byte
+}
+
+func encode64(buffer []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+func compact(header map[string]interface{}, payload []byte) []byte {
+	protected, _ := json.Marshal(header)
+	return []byte(strings.Join([]string{encode64(protected), "", encode64(make([]byte, 12)), encode64(payload), encode64(make([]byte, 16))}, "."))
+}
+
+func seal(kid string, plain []byte) []byte {
+	return compact(map[string]interface{}{"alg": "ECDH-ES", "enc": "A256GCM", "kid": kid, "clevis": map[string]interface{}{"pin": "tang"}}, plain)
+}
+
+func (c *crypter) KeyID() string {
+	return c.kid
+}
+
+func (c *crypter) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	return seal(c.kid, plain), nil
+}
+
+func (c *crypter) Decrypt(ctx context.Context, cipher []byte) ([]byte, error) {
+	parts := strings.Split(string(cipher), ".")
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	var protected struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &protected); err != nil {
+		return nil, err
+	}
+	if !c.known[protected.KeyID] {
+		return nil, fmt.Errorf("unknown kid %s", protected.KeyID)
+	}
+	plain, err := base64.RawURLEncoding.DecodeString(parts[3])
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.decrypted = append(c.decrypted, plain)
+	return plain, err
+}
+
+func TestRewrap(t *testing.T) {
+	dek := []byte("0123456789abcdef0123456789abcdef")
+	stale := seal("stale", dek)
+	current := seal("current", dek)
+	sss := compact(map[string]interface{}{"alg": "dir", "enc": "A256GCM", "clevis": map[string]interface{}{"pin": "sss", "sss": map[string]interface{}{"t": 1, "jwe": []string{string(stale)}}}}, dek)
+	wrapped := func(key []byte) []byte {
+		return (&envelope.Envelope{Provider: "tang", Key: key, Data: []byte("data")}).Bytes()
+	}
+	tests := []struct {
+		name   string
+		item   corpus.Item
+		dryRun bool
+		status rewrap.Status
+		kid    string
+		value  []byte
+		err    string
+	}{{
+		name:   "current",
+		item:   corpus.Item{Value: current},
+		status: rewrap.Current,
+		kid:    "current",
+		value:  current,
+	}, {
+		name:   "stale",
+		item:   corpus.Item{Value: stale},
+		status: rewrap.Rewrapped,
+		kid:    "stale",
+		value:  current,
+	}, {
+		name:   "envelope",
+		item:   corpus.Item{Value: wrapped(stale)},
+		status: rewrap.Rewrapped,
+		kid:    "stale",
+		value:  wrapped(current),
+	}, {
+		name:   "current envelope",
+		item:   corpus.Item{Value: wrapped(current)},
+		status: rewrap.Current,
+		kid:    "current",
+		value:  wrapped(current),
+	}, {
+		name:   "sss",
+		item:   corpus.Item{Value: sss},
+		status: rewrap.Skipped,
+		value:  sss,
+	}, {
+		name:   "dry run",
+		item:   corpus.Item{Value: stale},
+		dryRun: true,
+		status: rewrap.InUse,
+		kid:    "stale",
+	}, {
+		name:   "unreadable",
+		item:   corpus.Item{Err: errors.New("permission denied")},
+		status: rewrap.Failed,
+		err:    "permission denied",
+	}, {
+		name:   "malformed",
+		item:   corpus.Item{Value: []byte("eyJ.a.b")},
+		status: rewrap.Failed,
+		err:    "five parts",
+	}, {
+		name:   "unknown kid",
+		item:   corpus.Item{Value: seal("lost", dek)},
+		status: rewrap.Failed,
+		kid:    "lost",
+		err:    "unknown kid lost",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crypter := &crypter{kid: "current", known: map[string]bool{"current": true, "stale": true}}
+			result := rewrap.New(crypter, test.dryRun).Rewrap(context.Background(), test.item)
+			if result.Status != test.status || result.KeyID != test.kid {
+				t.Fatalf("got %s %q, want %s %q", result.Status, result.KeyID, test.status, test.kid)
+			}
+			if !bytes.Equal(result.Value, test.value) {
+				t.Errorf("got value %q, want %q", result.Value, test.value)
+			}
+			if test.err == "" && result.Err != nil || test.err != "" && (result.Err == nil || !strings.Contains(result.Err.Error(), test.err)) {
+				t.Errorf("got error %v, want %q", result.Err, test.err)
+			}
+			for _, plain := range crypter.decrypted {
+				if !bytes.Equal(plain, make([]byte, len(plain))) {
+					t.Errorf("plain text %q was not wiped", plain)
+				}
+			}
+		})
+	}
+}
+
+func TestAll(t *testing.T) {
+	crypter := &crypter{kid: "current", known: map[string]bool{"current": true, "stale": true}}
+	var items []corpus.Item
+	for i := 0; i < 16; i++ {
+		kid := []string{"current", "stale", "lost"}[i%3]
+		items = append(items, corpus.Item{Source: fmt.Sprint(i), Value: seal(kid, []byte(fmt.Sprint(i)))})
+	}
+	results := rewrap.New(crypter, false).All(context.Background(), items, 4)
+	for i, result := range results {
+		if result.Item.Source != items[i].Source {
+			t.Fatalf("result %d is for item %s", i, result.Item.Source)
+		}
+	}
+	want := []rewrap.Count{
+		{KeyID: "current", Status: rewrap.Current, Count: 6},
+		{KeyID: "lost", Status: rewrap.Failed, Count: 5},
+		{KeyID: "stale", Status: rewrap.Rewrapped, Count: 5},
+	}
+	if summary := rewrap.Summarize(results); !reflect.DeepEqual(summary, want) {
+		t.Fatalf("got %v, want %v", summary, want)
+	}
+}
@@ -0,0 +1,124 @@
+// Package sandbox drops the privileges the server needs only to open its
+// listeners and confines what it can reach afterwards with Landlock.
+package sandbox
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rules are what a restricted process may still reach. Paths that do not
+// exist are skipped.
+type Rules struct {
+	// Read and execute beneath these paths.
+	ReadOnly []string
+	// Read, write, create and remove beneath these paths.
+	ReadWrite []string
+	// The TCP ports the process may connect to. The kernel restricts by port
+	// only, which hosts are reached is left to the allowlist.
+	ConnectPorts []uint16
+}
+
+// Restriction reports what the kernel enforces.
+type Restriction struct {
+	// The Landlock ABI version of the kernel.
+	ABI int
+	// Whether connections and binds are restricted, which needs ABI 4.
+	Network bool
+}
+
+// What a server and a process it hands off to read after startup: DNS and TLS
+// roots beneath /etc, time zones, the process metrics in /proc.
+var systemReadOnly = []string{"/etc", "/proc", "/usr/share/ca-certificates", "/usr/local/share/ca-certificates", "/usr/share/zoneinfo"}
+
+// Server is what a server reaches once its listeners are open.
+type Server struct {
+	// Files read again after startup, as the configuration and TLS files.
+	// Empty names are skipped.
+	Files []string
+	// The binary a handoff executes.
+	Executable string
+	// The KMS socket, nothing is written for an abstract one.
+	UnixSocket string
+	// The Tang servers it connects to.
+	TangURLs []string
+}
+
+// Rules returns the rules that confine the server.
+func (s Server) Rules() (rules Rules, err error) {
+	rules.ReadOnly = append(rules.ReadOnly, systemReadOnly...)
+	// The directories rather than the files, so that a file replaced by a
+	// rename can still be read.
+	for _, path := range append(s.Files, s.Executable) {
+		if path == "" {
+			continue
+		}
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return rules, err
+		}
+		rules.ReadOnly = append(rules.ReadOnly, filepath.Dir(absolute))
+	}
+	// The standard input of the process we hand off to.
+	rules.ReadWrite = append(rules.ReadWrite, os.DevNull)
+	if s.UnixSocket != "" && !strings.HasPrefix(s.UnixSocket, "@") {
+		rules.ReadWrite = append(rules.ReadWrite, filepath.Dir(s.UnixSocket))
+	}
+
+	ports := map[uint16]bool{}
+	for _, location := range s.TangURLs {
+		port, named, err := tangPort(location)
+		if err != nil {
+			return rules, err
+		}
+		ports[port] = true
+		// DNS answers too long for UDP are fetched over TCP.
+		if named {
+			ports[53] = true
+		}
+	}
+	for port := range ports {
+		rules.ConnectPorts = append(rules.ConnectPorts, port)
+	}
+	sort.Slice(rules.ConnectPorts, func(i, j int) bool { return rules.ConnectPorts[i] < rules.ConnectPorts[j] })
+	return rules, nil
+}
+
+// Connects reports whether the rules let a server connect to the Tang server
+// at location.
+func (r Rules) Connects(location string) bool {
+	port, _, err := tangPort(location)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range r.ConnectPorts {
+		if allowed == port {
+			return true
+		}
+	}
+	return false
+}
+
+// The port of a Tang URL and whether its host is a name to resolve.
+func tangPort(location string) (port uint16, named bool, err error) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return 0, false, err
+	}
+	number := parsed.Port()
+	if number == "" {
+		number = map[string]string{"http": "80", "https": "443"}[parsed.Scheme]
+	}
+	n, err := strconv.ParseUint(number, 10, 16)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s has no port: %w", location, err)
+	}
+	_, err = netip.ParseAddr(parsed.Hostname())
+	return uint16(n), err != nil, nil
+}
@@ -0,0 +1,232 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Landlock rights newer than the constants of x/sys.
+const (
+	accessFsV1          = 1<<13 - 1
+	accessFsRefer       = 1 << 13
+	accessFsTruncate    = 1 << 14
+	accessFsIoctlDev    = 1 << 15
+	accessNetBindTCP    = 1 << 0
+	accessNetConnectTCP = 1 << 1
+	ruleNetPort         = 2
+
+	accessFsRead = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	// The rights that apply to a file rather than a directory.
+	accessFsFile = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE | accessFsTruncate | accessFsIoctlDev
+)
+
+type rulesetAttr struct {
+	handledAccessFs  uint64
+	handledAccessNet uint64
+}
+
+// The kernel's struct is packed, it reads the first twelve bytes.
+type pathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+type netPortAttr struct {
+	allowedAccess uint64
+	port          uint64
+}
+
+// Capabilities, no new privileges and Landlock belong to each thread, Go
+// can change them on all of its threads only when it is built without cgo.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall6(trap, a1, a2, a3, 0, 0, 0)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		return errors.New("changing the privileges of every thread needs a binary built with CGO_ENABLED=0")
+	}
+	return errno
+}
+
+func capabilities() (data [2]unix.CapUserData, err error) {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	err = unix.Capget(&header, &data[0])
+	return data, err
+}
+
+// DropPrivileges clears the capability bounding set, switches to uid and gid
+// where they are not zero, clears every capability left and forbids gaining
+// new privileges through exec.
+func DropPrivileges(uid int, gid int) error {
+	data, err := capabilities()
+	if err != nil {
+		return err
+	}
+	// The bounding set can only be cleared while we hold CAP_SETPCAP, a
+	// process we handed off to started without it.
+	if data[0].Effective&(1<<unix.CAP_SETPCAP) != 0 {
+		for capability := uintptr(0); ; capability++ {
+			err := allThreads(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, capability, 0)
+			if err == syscall.EINVAL {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("dropping capability %d from the bounding set: %w", capability, err)
+			}
+		}
+	}
+	if gid == 0 {
+		gid = os.Getgid()
+	}
+	if uid == 0 {
+		uid = os.Getuid()
+	}
+	// A process we handed off to starts as the user we switched to.
+	if gid != os.Getgid() || uid != os.Getuid() {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups %d: %w", gid, err)
+		}
+		if err := syscall.Setresgid(gid, gid, gid); err != nil {
+			return fmt.Errorf("setresgid %d: %w", gid, err)
+		}
+	}
+	if uid != os.Getuid() {
+		if err := syscall.Setresuid(uid, uid, uid); err != nil {
+			return fmt.Errorf("setresuid %d: %w", uid, err)
+		}
+	}
+	// Leaving root clears the capabilities, staying root does not.
+	header, none := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}, [2]unix.CapUserData{}
+	if err := allThreads(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&none[0])), 0); err != nil {
+		return fmt.Errorf("clearing capabilities: %w", err)
+	}
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("setting no new privileges: %w", err)
+	}
+	if data, err = capabilities(); err != nil {
+		return err
+	}
+	if data[0] != none[0] || data[1] != none[1] {
+		return fmt.Errorf("capabilities remain after dropping them: %+v", data)
+	}
+	return nil
+}
+
+// handled returns the rights a ruleset for the Landlock ABI version handles,
+// and the size of the attribute the kernel reads.
+func handled(abi int) (attr rulesetAttr, size uintptr, restriction Restriction) {
+	restriction.ABI = abi
+	attr.handledAccessFs = accessFsV1
+	if abi >= 2 {
+		attr.handledAccessFs |= accessFsRefer
+	}
+	if abi >= 3 {
+		attr.handledAccessFs |= accessFsTruncate
+	}
+	if abi >= 5 {
+		attr.handledAccessFs |= accessFsIoctlDev
+	}
+	size = unsafe.Sizeof(attr.handledAccessFs)
+	if abi >= 4 {
+		attr.handledAccessNet = accessNetBindTCP | accessNetConnectTCP
+		size = unsafe.Sizeof(attr)
+		restriction.Network = true
+	}
+	return attr, size, restriction
+}
+
+func version() (int, error) {
+	abi, _, errno := syscall.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, fmt.Errorf("Landlock is not available: %w", errno)
+	}
+	return int(abi), nil
+}
+
+// ruleset returns a Landlock ruleset for the ABI version allowing the rules.
+func ruleset(rules Rules, abi int) (fd int, restriction Restriction, err error) {
+	attr, size, restriction := handled(abi)
+	ruleset, _, errno := syscall.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), size, 0)
+	if errno != 0 {
+		return -1, restriction, fmt.Errorf("creating Landlock ruleset: %w", errno)
+	}
+	fd = int(ruleset)
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+		}
+	}()
+
+	allow := func(path string, access uint64) error {
+		parent, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if err == unix.ENOENT {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer unix.Close(parent)
+		var stat unix.Stat_t
+		if err := unix.Fstat(parent, &stat); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			access &= accessFsFile
+		}
+		rule := pathBeneathAttr{allowedAccess: access & attr.handledAccessFs, parentFd: int32(parent)}
+		_, _, errno := syscall.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(fd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("allowing %s: %w", path, errno)
+		}
+		return nil
+	}
+	for _, path := range rules.ReadOnly {
+		if err := allow(path, accessFsRead); err != nil {
+			return -1, restriction, err
+		}
+	}
+	for _, path := range rules.ReadWrite {
+		if err := allow(path, attr.handledAccessFs); err != nil {
+			return -1, restriction, err
+		}
+	}
+	if restriction.Network {
+		for _, port := range rules.ConnectPorts {
+			rule := netPortAttr{allowedAccess: accessNetConnectTCP, port: uint64(port)}
+			_, _, errno := syscall.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(fd), ruleNetPort, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+			if errno != 0 {
+				return -1, restriction, fmt.Errorf("allowing port %d: %w", port, errno)
+			}
+		}
+	}
+	return fd, restriction, nil
+}
+
+// Restrict confines every thread of the process, and the processes it starts,
+// to the rules. The network is restricted only when the kernel supports it.
+func Restrict(rules Rules) (restriction Restriction, err error) {
+	abi, err := version()
+	if err != nil {
+		return restriction, err
+	}
+	fd, restriction, err := ruleset(rules, abi)
+	if err != nil {
+		return restriction, err
+	}
+	defer unix.Close(fd)
+
+	// Landlock requires no new privileges, DropPrivileges may not have run.
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return restriction, fmt.Errorf("setting no new privileges: %w", err)
+	}
+	if err := allThreads(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(fd), 0, 0); err != nil {
+		return restriction, fmt.Errorf("restricting with Landlock: %w", err)
+	}
+	return restriction, nil
+}
@@ -0,0 +1,134 @@
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// The test binary restricted with the rules of confined, run by TestRestrict.
+const confined = "TANG_KMS_TEST_CONFINED"
+
+func TestMain(m *testing.M) {
+	if dir := os.Getenv(confined); dir != "" {
+		os.Exit(confine(dir))
+	}
+	os.Exit(m.Run())
+}
+
+// confine restricts itself to reading dir/readable, then reports by its exit
+// status which reads the sandbox let through.
+func confine(dir string) int {
+	if _, err := Restrict(Rules{ReadOnly: []string{filepath.Join(dir, "readable")}}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if strings.Contains(err.Error(), "CGO_ENABLED=0") {
+			return 3
+		}
+		return 1
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "readable", "file")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "closed", "file")); err == nil {
+		fmt.Fprintln(os.Stderr, "read a file outside the rules")
+		return 1
+	}
+	return 0
+}
+
+// The rights handled grow with the ABI, the network is restricted from 4.
+func TestHandled(t *testing.T) {
+	tests := []struct {
+		abi     int
+		fs      uint64
+		net     uint64
+		network bool
+	}{
+		{abi: 1, fs: accessFsV1},
+		{abi: 2, fs: accessFsV1 | accessFsRefer},
+		{abi: 3, fs: accessFsV1 | accessFsRefer | accessFsTruncate},
+		{abi: 4, fs: accessFsV1 | accessFsRefer | accessFsTruncate, net: accessNetBindTCP | accessNetConnectTCP, network: true},
+		{abi: 5, fs: accessFsV1 | accessFsRefer | accessFsTruncate | accessFsIoctlDev, net: accessNetBindTCP | accessNetConnectTCP, network: true},
+		{abi: 7, fs: accessFsV1 | accessFsRefer | accessFsTruncate | accessFsIoctlDev, net: accessNetBindTCP | accessNetConnectTCP, network: true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint("ABI ", test.abi), func(t *testing.T) {
+			attr, size, restriction := handled(test.abi)
+			if attr.handledAccessFs != test.fs || attr.handledAccessNet != test.net {
+				t.Errorf("handles %#x and %#x, want %#x and %#x", attr.handledAccessFs, attr.handledAccessNet, test.fs, test.net)
+			}
+			if restriction.ABI != test.abi || restriction.Network != test.network {
+				t.Errorf("got %+v", restriction)
+			}
+			// A kernel without network rules refuses a larger attribute.
+			if want := map[bool]uintptr{false: 8, true: 16}[test.network]; size != want {
+				t.Errorf("size %d, want %d", size, want)
+			}
+		})
+	}
+}
+
+func landlock(t *testing.T) int {
+	abi, err := version()
+	if err != nil {
+		t.Skip(err)
+	}
+	return abi
+}
+
+// The ruleset is built on every ABI the kernel accepts, older ones included,
+// skipping the paths that do not exist.
+func TestRuleset(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rules := Rules{
+		ReadOnly:     []string{dir, file, filepath.Join(dir, "missing")},
+		ReadWrite:    []string{os.DevNull, dir},
+		ConnectPorts: []uint16{53, 443},
+	}
+	for abi := 1; abi <= landlock(t); abi++ {
+		fd, restriction, err := ruleset(rules, abi)
+		if err != nil {
+			t.Fatalf("ABI %d: %v", abi, err)
+		}
+		unix.Close(fd)
+		if restriction.ABI != abi || restriction.Network != (abi >= 4) {
+			t.Errorf("ABI %d: got %+v", abi, restriction)
+		}
+	}
+	if _, _, err := ruleset(Rules{ReadOnly: []string{file + "/not-a-directory"}}, 1); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("expected an error for a path beneath a file, got %v", err)
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	landlock(t)
+	dir := t.TempDir()
+	for _, name := range []string{"readable", "closed"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name, "file"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	command := exec.Command(os.Args[0])
+	command.Env = append(os.Environ(), confined+"="+dir)
+	output, err := command.CombinedOutput()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 3 {
+		t.Skip(strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sandbox
+
+import "errors"
+
+func DropPrivileges(uid int, gid int) error {
+	return errors.New("dropping privileges is only supported on Linux")
+}
+
+func Restrict(rules Rules) (Restriction, error) {
+	return Restriction{}, errors.New("the sandbox is only supported on Linux")
+}
@@ -0,0 +1,94 @@
+package sandbox
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerRules(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	system := func(paths ...string) []string {
+		return append(append([]string(nil), systemReadOnly...), paths...)
+	}
+	tests := []struct {
+		name   string
+		server Server
+		rules  Rules
+		err    string
+	}{{
+		name: "server",
+		server: Server{
+			Files:      []string{"/etc/tang-kms/config.yaml", "", "/etc/tls/cert.pem"},
+			Executable: "/usr/local/bin/tang-encryption-provider",
+			UnixSocket: "/var/run/kmsplugin/socket.sock",
+			TangURLs:   []string{"https://tang.test", "http://tang.test:8080/"},
+		},
+		rules: Rules{
+			ReadOnly:     system("/etc/tang-kms", "/etc/tls", "/usr/local/bin"),
+			ReadWrite:    []string{os.DevNull, "/var/run/kmsplugin"},
+			ConnectPorts: []uint16{53, 443, 8080},
+		},
+	}, {
+		name:   "relative configuration",
+		server: Server{Files: []string{"tang-kms.yaml"}, TangURLs: []string{"http://127.0.0.1"}},
+		rules: Rules{
+			ReadOnly:     system(wd),
+			ReadWrite:    []string{os.DevNull},
+			ConnectPorts: []uint16{80},
+		},
+	}, {
+		name:   "abstract socket",
+		server: Server{UnixSocket: "@kmsplugin", TangURLs: []string{"http://[::1]:8080", "http://10.0.0.1:8080"}},
+		rules: Rules{
+			ReadOnly:     system(),
+			ReadWrite:    []string{os.DevNull},
+			ConnectPorts: []uint16{8080},
+		},
+	}, {
+		name:   "no port",
+		server: Server{TangURLs: []string{"tang://tang.test"}},
+		err:    "tang://tang.test has no port",
+	}, {
+		name:   "port out of range",
+		server: Server{TangURLs: []string{"http://tang.test:65536"}},
+		err:    "has no port",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := test.server.Rules()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rules, test.rules) {
+				t.Fatalf("got %+v, want %+v", rules, test.rules)
+			}
+		})
+	}
+}
+
+func TestConnects(t *testing.T) {
+	rules := Rules{ConnectPorts: []uint16{443, 8080}}
+	for location, connects := range map[string]bool{
+		"https://tang.test":            true,
+		"http://tang.test:8080/path":   true,
+		"http://tang.test":             false,
+		"https://tang.test:8443":       false,
+		"tang://tang.test":             false,
+		"https://tang.test:not-a-port": false,
+	} {
+		if rules.Connects(location) != connects {
+			t.Errorf("%s connects is %v, want %v", location, !connects, connects)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Package secret keeps plain texts and keys out of memory once they have been
+// used, as far as Go lets us: buffers are zeroed, memory can be kept out of
+// swap and the process out of core dumps.
+package secret
+
+import (
+	"math/big"
+	"runtime"
+)
+
+// Wipe zeroes the buffers.
+func Wipe(buffers ...[]byte) {
+	for _, buffer := range buffers {
+		for i := range buffer {
+			buffer[i] = 0
+		}
+		// The compiler must not drop stores to memory no one reads again.
+		runtime.KeepAlive(buffer)
+	}
+}
+
+// WipeInt zeroes the words of integers such as a private scalar or the
+// coordinate of a shared point, leaving them zero.
+func WipeInt(ints ...*big.Int) {
+	for _, n := range ints {
+		if n == nil {
+			continue
+		}
+		words := n.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+		runtime.KeepAlive(words)
+		n.SetInt64(0)
+	}
+}
+
+// Wiped reports whether every byte of the buffer is zero.
+func Wiped(buffer []byte) bool {
+	for _, b := range buffer {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
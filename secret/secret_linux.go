@@ -0,0 +1,43 @@
+package secret
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// DisableCoreDumps keeps the memory of the process out of core dumps and
+// away from debuggers of the same user. exec clears it, a process we hand off
+// to disables them again.
+func DisableCoreDumps() error {
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{}); err != nil {
+		return fmt.Errorf("setrlimit RLIMIT_CORE: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl PR_SET_DUMPABLE: %w", err)
+	}
+	return nil
+}
+
+// LockMemory locks all memory of the process, present and future, out of
+// swap. Go moves plain texts through buffers of its own and of gRPC, they can
+// not be locked one by one. Once we drop CAP_IPC_LOCK memory beyond
+// RLIMIT_MEMLOCK can not be locked, and the runtime aborts when it can not
+// map the memory it grows into, so the limit must be lifted, by us while we
+// are root or by whoever starts us.
+func LockMemory() error {
+	unlimited := unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unlimited); err != nil {
+		var limit unix.Rlimit
+		if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &limit); err != nil {
+			return fmt.Errorf("getrlimit RLIMIT_MEMLOCK: %w", err)
+		}
+		if limit.Cur != unix.RLIM_INFINITY {
+			return fmt.Errorf("RLIMIT_MEMLOCK is %d bytes and can not be lifted, start with an unlimited memlock limit: %w", limit.Cur, err)
+		}
+	}
+	if err := unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE); err != nil {
+		return fmt.Errorf("mlockall: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package secret
+
+import (
+	"errors"
+	"syscall"
+)
+
+// DisableCoreDumps sets the core size limit to zero, other systems have no
+// equivalent of PR_SET_DUMPABLE.
+func DisableCoreDumps() error {
+	return syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{})
+}
+
+func LockMemory() error {
+	return errors.New("locking memory is only supported on Linux")
+}
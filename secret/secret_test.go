@@ -0,0 +1,49 @@
+package secret
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	tests := []struct {
+		name    string
+		buffers [][]byte
+	}{
+		{"none", nil},
+		{"empty", [][]byte{{}}},
+		{"one", [][]byte{[]byte("a data encryption key")}},
+		{"several", [][]byte{[]byte("key"), nil, []byte("plain text")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Wipe(test.buffers...)
+			for i, buffer := range test.buffers {
+				if !Wiped(buffer) {
+					t.Errorf("buffer %d is %q", i, buffer)
+				}
+			}
+		})
+	}
+	if Wiped([]byte{0, 0, 1}) {
+		t.Errorf("a buffer with a set byte is wiped")
+	}
+}
+
+// The words of the integer are zeroed where they are, not replaced.
+func TestWipeInt(t *testing.T) {
+	n, ok := new(big.Int).SetString("fedcba9876543210fedcba9876543210fedcba9876543210", 16)
+	if !ok {
+		t.Fatal("bad integer")
+	}
+	words := n.Bits()
+	WipeInt(n, nil)
+	if n.Sign() != 0 {
+		t.Errorf("got %v, want 0", n)
+	}
+	for i, word := range words {
+		if word != 0 {
+			t.Errorf("word %d is %x", i, word)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Package selftest runs known-answer tests of the primitives FIPS mode relies
+// on, so that the server refuses to serve rather than encrypt with one that
+// gives a wrong answer. ECDH is tested on each curve both with crypto/elliptic,
+// as we encrypt, and through the McCallum-Relyea exchange, as we decrypt, the
+// Concat KDF of both backends, AES-GCM and AES Key Wrap.
+package selftest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	jcipher "github.com/flatheadmill/go-jose/v3/cipher"
+
+	"github.com/flatheadmill/tang-encryption-provider/clevis"
+	gojose "github.com/flatheadmill/tang-encryption-provider/go-jose"
+	"github.com/flatheadmill/tang-encryption-provider/mcr"
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+)
+
+// Error lists the self-tests that failed.
+type Error struct {
+	Failed []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d self-tests failed: %s", len(e.Failed), strings.Join(e.Failed, "; "))
+}
+
+func decodeHex(encoded string) []byte {
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		panic(err)
+	}
+	return decoded
+}
+
+func compare(name string, got []byte, want []byte) error {
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s: got %x, want %x", name, got, want)
+	}
+	return nil
+}
+
+type exchange struct {
+	curve   elliptic.Curve
+	private string
+	peer    string
+	shared  string
+}
+
+// P-256 is the ECDH-ES example of RFC 7518 appendix C, P-384 and P-521 were
+// computed with OpenSSL.
+var exchanges = []exchange{{
+	curve:   elliptic.P256(),
+	private: "d3f3716913d4310a0026de741b3f18893afc8114f0c84682ba677e313a13988a",
+	peer:    "04c1e349cb61ec70248ce801034c3834e1b88ebe1161cb25af38741f785fcfc4c47bc96708ef80952b53f8d2555fe72b841ed04588628b1d378a594939500ec9c9",
+	shared:  "9e56d91d817135d372834283bf84269cfb316ea3da806a48f6daa7798cfe90c4",
+}, {
+	curve:   elliptic.P384(),
+	private: "7916b711887c6316882cecfefa1743acd7230861ec52cbcbea1bec09fa933cffaf200dcd8892909d92e654c376b07088",
+	peer:    "0493e9d175f91754896421b8a537121a9b491a2499b9348b269d5d8db525bc5e8a9d3c7a81b46d202dd15a6132da39feb2cc5003a5e805c31a471cebb6dc735e07cb5ba6cfe1fde6c839cef2318df2309c7caa5f74244df1b382308516fe8cb4e8",
+	shared:  "fdc4d8640f03ac08c817aaa098e854ed46b168ad70749f715756ebfb0295782a9a97a101cd3ed68c035af130d6be7e50",
+}, {
+	curve:   elliptic.P521(),
+	private: "008d2ff420ab16acb90f6fe71418a698eb44314b3cac8494eacafd59bbe047666045f61dd2fd5438e65c41159362df8474f9571b0e914e5c063282730ea23a6682f2",
+	peer:    "0401c7e2c982bd6b4f349b13a88ff8398a337f9125be37b5214dd846c3dee726fe77d3c87a43f23f73a197ae77ad52a54aaa8bb796e5028bdef51731be7b4e258b44a801e9216eb918cb94066f2d3510f43989b59119ec19c16ce18cb41f593723f706cca10110077764c90ade29af59f1909a6a6dfc8d590e7060a70b4dd698fa2d9fbc16",
+	shared:  "01da352e9f52c6ff85723460ba4f8e766f1734c9ec0a424c0a7b711fd8fbeceb3c24db9b2da4271caeb052bb6112c45b162ed9baadc57d00823604c1ce41b846d56c",
+}}
+
+func (e exchange) keys() (private *ecdsa.PrivateKey, peer *ecdsa.PublicKey, size int, err error) {
+	size = (e.curve.Params().BitSize + 7) / 8
+	x, y := elliptic.Unmarshal(e.curve, decodeHex(e.peer))
+	if x == nil {
+		return nil, nil, 0, fmt.Errorf("peer key is not on the curve")
+	}
+	d := decodeHex(e.private)
+	private = &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	private.Curve = e.curve
+	private.X, private.Y = e.curve.ScalarBaseMult(d)
+	return private, &ecdsa.PublicKey{Curve: e.curve, X: x, Y: y}, size, nil
+}
+
+// The template and the go-jose backend multiply with crypto/elliptic.
+func (e exchange) elliptic() error {
+	private, peer, size, err := e.keys()
+	if err != nil {
+		return err
+	}
+	x, _ := e.curve.ScalarMult(peer.X, peer.Y, private.D.Bytes())
+	return compare("shared secret", x.FillBytes(make([]byte, size)), decodeHex(e.shared))
+}
+
+// Decrypting blinds the peer's key, lets the holder of the private key
+// multiply it and unblinds the result.
+func (e exchange) recovery() error {
+	private, peer, size, err := e.keys()
+	if err != nil {
+		return err
+	}
+	blinding, err := mcr.Blind(&private.PublicKey, peer)
+	if err != nil {
+		return err
+	}
+	defer blinding.Wipe()
+	response, err := mcr.Exchange(private, blinding.Request)
+	if err != nil {
+		return err
+	}
+	shared, err := blinding.Unblind(response)
+	if err != nil {
+		return err
+	}
+	return compare("shared secret", shared.X.FillBytes(make([]byte, size)), decodeHex(e.shared))
+}
+
+// RFC 7518 appendix C, ECDH-ES with A128GCM from Alice to Bob.
+var (
+	kdfShared = decodeHex("9e56d91d817135d372834283bf84269cfb316ea3da806a48f6daa7798cfe90c4")
+	kdfKey    = decodeHex("56aa8deaf8236d205c2228cd71a7101a")
+)
+
+func concatKDF() error {
+	return compare("key", clevis.ConcatKDF(kdfShared, suite.A128GCM, []byte("Alice"), []byte("Bob"), 16), kdfKey)
+}
+
+func goJoseKDF() error {
+	shared := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(kdfShared)}
+	if err := compare("decrypt key", gojose.DeriveECDHES(suite.A128GCM, []byte("Alice"), []byte("Bob"), shared, 16), kdfKey); err != nil {
+		return err
+	}
+	private, peer, _, err := exchanges[0].keys()
+	if err != nil {
+		return err
+	}
+	return compare("encrypt key", jcipher.DeriveECDHES(suite.A128GCM, []byte("Alice"), []byte("Bob"), private, peer, 16), kdfKey)
+}
+
+type sealing struct {
+	enc   string
+	key   string
+	iv    string
+	plain string
+	aad   string
+	// The ciphertext followed by the tag.
+	sealed string
+}
+
+// Test cases 4 and 16 of the GCM specification by McGrew and Viega.
+var sealings = []sealing{{
+	enc:    suite.A128GCM,
+	key:    "feffe9928665731c6d6a8f9467308308",
+	iv:     "cafebabefacedbaddecaf888",
+	plain:  "d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39",
+	aad:    "feedfacedeadbeeffeedfacedeadbeefabaddad2",
+	sealed: "42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e0915bc94fbc3221a5db94fae95ae7121a47",
+}, {
+	enc:    suite.A256GCM,
+	key:    "feffe9928665731c6d6a8f9467308308feffe9928665731c6d6a8f9467308308",
+	iv:     "cafebabefacedbaddecaf888",
+	plain:  "d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39",
+	aad:    "feedfacedeadbeeffeedfacedeadbeefabaddad2",
+	sealed: "522dc1f099567d07f47f37a32a84427d643a8cdcbfe5c0c97598a2bd2555d1aa8cb08e48590dbb3da7b08b1056828838c5f61e6393ba7a0abcc9f66276fc6ece0f4e1768cddf8853bb2d551b",
+}}
+
+func (s sealing) run() error {
+	aead, _, err := suite.NewContentCipher(s.enc, decodeHex(s.key))
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nil, decodeHex(s.iv), decodeHex(s.plain), decodeHex(s.aad))
+	if err := compare("sealed", sealed, decodeHex(s.sealed)); err != nil {
+		return err
+	}
+	opened, err := aead.Open(nil, decodeHex(s.iv), sealed, decodeHex(s.aad))
+	if err != nil {
+		return err
+	}
+	if err := compare("opened", opened, decodeHex(s.plain)); err != nil {
+		return err
+	}
+	// A flipped bit of the tag must fail authentication.
+	sealed[len(sealed)-1] ^= 1
+	if _, err := aead.Open(nil, decodeHex(s.iv), sealed, decodeHex(s.aad)); err == nil {
+		return fmt.Errorf("forged tag authenticated")
+	}
+	return nil
+}
+
+// RFC 3394 section 4.6, a 256 bit key wrapped with a 256 bit key.
+func keyWrap() error {
+	kek := decodeHex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	key := decodeHex("00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f")
+	wrapped, err := suite.WrapKey(kek, key)
+	if err != nil {
+		return err
+	}
+	if err := compare("wrapped", wrapped, decodeHex("28c9f404c4b810f4cbccb35cfb87f8263f5786e2d80ed326cbc7f0e71a99f43bfb988b9b7a02dd21")); err != nil {
+		return err
+	}
+	unwrapped, err := suite.UnwrapKey(kek, wrapped)
+	if err != nil {
+		return err
+	}
+	return compare("unwrapped", unwrapped, key)
+}
+
+// Test is a named known-answer test.
+type Test struct {
+	Name string
+	Run  func() error
+}
+
+// Tests are every known-answer test Run runs.
+func Tests() []Test {
+	var tests []Test
+	for _, e := range exchanges {
+		name := e.curve.Params().Name
+		tests = append(tests, Test{"ECDH " + name, e.elliptic}, Test{"ECDH " + name + " McCallum-Relyea", e.recovery})
+	}
+	tests = append(tests, Test{"Concat KDF", concatKDF}, Test{"Concat KDF go-jose", goJoseKDF})
+	for _, s := range sealings {
+		tests = append(tests, Test{s.enc, s.run})
+	}
+	return append(tests, Test{"AES Key Wrap", keyWrap})
+}
+
+func run(test Test) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return test.Run()
+}
+
+// Run runs every test and returns an *Error naming those that failed.
+func Run() error {
+	var failed []string
+	for _, test := range Tests() {
+		if err := run(test); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", test.Name, err))
+		}
+	}
+	if len(failed) != 0 {
+		return &Error{Failed: failed}
+	}
+	return nil
+}
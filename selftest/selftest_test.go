@@ -0,0 +1,81 @@
+package selftest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKnownAnswers(t *testing.T) {
+	for _, test := range Tests() {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			if err := run(test); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	if err := Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A wrong answer and a panic are both failures, named by Run.
+func TestFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func() (restore func())
+		failed  []string
+	}{{
+		name: "kdf key",
+		corrupt: func() func() {
+			saved := kdfKey
+			kdfKey = append([]byte(nil), kdfKey...)
+			kdfKey[0] ^= 1
+			return func() { kdfKey = saved }
+		},
+		failed: []string{"Concat KDF: ", "Concat KDF go-jose: "},
+	}, {
+		name: "sealed",
+		corrupt: func() func() {
+			saved := sealings[0].sealed
+			sealings[0].sealed = "00" + saved[2:]
+			return func() { sealings[0].sealed = saved }
+		},
+		failed: []string{"A128GCM: sealed"},
+	}, {
+		name: "peer off the curve",
+		corrupt: func() func() {
+			saved := exchanges[1].peer
+			exchanges[1].peer = "04" + strings.Repeat("00", 96)
+			return func() { exchanges[1].peer = saved }
+		},
+		failed: []string{"ECDH P-384: ", "ECDH P-384 McCallum-Relyea: "},
+	}, {
+		name: "panic",
+		corrupt: func() func() {
+			saved := sealings[1].key
+			sealings[1].key = "not hex"
+			return func() { sealings[1].key = saved }
+		},
+		failed: []string{"A256GCM: panic: "},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer test.corrupt()()
+			var failure *Error
+			if err := Run(); !errors.As(err, &failure) {
+				t.Fatalf("expected an *Error, got %v", err)
+			}
+			for _, prefix := range test.failed {
+				found := false
+				for _, failed := range failure.Failed {
+					found = found || strings.HasPrefix(failed, prefix)
+				}
+				if !found {
+					t.Errorf("%q is not in %q", prefix, failure.Failed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+// Package suite names the JWE algorithms the crypters encrypt with, those
+// clevis decrypts, and the policy that limits which a decrypter accepts.
+package suite
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	jcipher "github.com/flatheadmill/go-jose/v3/cipher"
+)
+
+const (
+	ECDHES       = "ECDH-ES"
+	ECDHESA128KW = "ECDH-ES+A128KW"
+	ECDHESA192KW = "ECDH-ES+A192KW"
+	ECDHESA256KW = "ECDH-ES+A256KW"
+
+	A128GCM      = "A128GCM"
+	A192GCM      = "A192GCM"
+	A256GCM      = "A256GCM"
+	A128CBCHS256 = "A128CBC-HS256"
+	A192CBCHS384 = "A192CBC-HS384"
+	A256CBCHS512 = "A256CBC-HS512"
+)
+
+// What we encrypt with.
+var (
+	EncryptAlgorithms  = []string{ECDHES, ECDHESA256KW}
+	EncryptEncryptions = []string{A128GCM, A192GCM, A256GCM, A256CBCHS512}
+)
+
+// What clevis encrypts with, and so what we decrypt, for the tang pin. The
+// sss pin encrypts with `dir`.
+var (
+	DecryptAlgorithms  = []string{ECDHES, ECDHESA128KW, ECDHESA192KW, ECDHESA256KW}
+	DecryptEncryptions = []string{A128GCM, A192GCM, A256GCM, A128CBCHS256, A192CBCHS384, A256CBCHS512}
+)
+
+// ErrRejected is returned for a JWE whose algorithm or encryption the policy
+// does not accept.
+var ErrRejected = errors.New("JWE algorithm rejected by policy")
+
+func contains(list []string, sought string) bool {
+	for _, value := range list {
+		if value == sought {
+			return true
+		}
+	}
+	return false
+}
+
+// Suite is the key management algorithm, alg, and the content encryption,
+// enc, of the JWEs a crypter encrypts.
+type Suite struct {
+	Alg string
+	Enc string
+}
+
+// Default is what the crypters encrypted with before they could be chosen,
+// and what clevis encrypts with.
+var Default = Suite{Alg: ECDHES, Enc: A256GCM}
+
+// Validate reports an alg or enc we do not encrypt with.
+func (s Suite) Validate() error {
+	if !contains(EncryptAlgorithms, s.Alg) {
+		return fmt.Errorf("alg %q must be one of %v", s.Alg, EncryptAlgorithms)
+	}
+	if !contains(EncryptEncryptions, s.Enc) {
+		return fmt.Errorf("enc %q must be one of %v", s.Enc, EncryptEncryptions)
+	}
+	return nil
+}
+
+// Policy limits the alg of tang pins and the enc of every JWE a decrypter
+// accepts, nested ones included, and the curves of the keys of the exchange.
+// Empty lists accept all that we decrypt.
+type Policy struct {
+	Algorithms  []string
+	Encryptions []string
+	Curves      []string
+}
+
+// FIPS accepts only the approved NIST curves and AES-GCM, the key wrapping
+// algorithms are AES Key Wrap.
+var FIPS = Policy{
+	Encryptions: []string{A128GCM, A192GCM, A256GCM},
+	Curves:      []string{"P-256", "P-384", "P-521"},
+}
+
+// Validate reports entries of the lists we do not decrypt.
+func (p Policy) Validate() error {
+	for _, alg := range p.Algorithms {
+		if !contains(DecryptAlgorithms, alg) {
+			return fmt.Errorf("alg %q must be one of %v", alg, DecryptAlgorithms)
+		}
+	}
+	for _, enc := range p.Encryptions {
+		if !contains(DecryptEncryptions, enc) {
+			return fmt.Errorf("enc %q must be one of %v", enc, DecryptEncryptions)
+		}
+	}
+	return nil
+}
+
+// Accepts reports whether JWEs of the suite are decrypted under the policy.
+func (p Policy) Accepts(s Suite) bool {
+	return p.CheckAlg(s.Alg) == nil && p.CheckEnc(s.Enc) == nil
+}
+
+// CheckAlg returns ErrRejected for an alg the policy does not accept.
+func (p Policy) CheckAlg(alg string) error {
+	if len(p.Algorithms) != 0 && !contains(p.Algorithms, alg) {
+		return fmt.Errorf("%w: alg %q", ErrRejected, alg)
+	}
+	return nil
+}
+
+// CheckCurve returns ErrRejected for a curve the policy does not accept.
+func (p Policy) CheckCurve(curve string) error {
+	if len(p.Curves) != 0 && !contains(p.Curves, curve) {
+		return fmt.Errorf("%w: curve %q", ErrRejected, curve)
+	}
+	return nil
+}
+
+// CheckEnc returns ErrRejected for an enc the policy does not accept.
+func (p Policy) CheckEnc(enc string) error {
+	if len(p.Encryptions) != 0 && !contains(p.Encryptions, enc) {
+		return fmt.Errorf("%w: enc %q", ErrRejected, enc)
+	}
+	return nil
+}
+
+// KeySize is the size of the content encryption key of an enc.
+func KeySize(enc string) (int, error) {
+	switch enc {
+	case A128GCM:
+		return 16, nil
+	case A192GCM:
+		return 24, nil
+	case A256GCM, A128CBCHS256:
+		return 32, nil
+	case A192CBCHS384:
+		return 48, nil
+	case A256CBCHS512:
+		return 64, nil
+	}
+	return 0, fmt.Errorf("unsupported enc %q", enc)
+}
+
+// WrapSize is the size of the key that wraps the content encryption key for
+// an alg, zero when the key agreed with ECDH-ES is the content encryption key.
+func WrapSize(alg string) (int, error) {
+	switch alg {
+	case ECDHES:
+		return 0, nil
+	case ECDHESA128KW:
+		return 16, nil
+	case ECDHESA192KW:
+		return 24, nil
+	case ECDHESA256KW:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("unsupported alg %q", alg)
+}
+
+// NewContentCipher returns the AEAD of an enc and the size of its tag. The
+// AEAD of the CBC encryptions reports as overhead the tag and at most a block
+// of padding.
+func NewContentCipher(enc string, key []byte) (aead cipher.AEAD, tagSize int, err error) {
+	size, err := KeySize(enc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(key) != size {
+		return nil, 0, fmt.Errorf("%s needs a %d byte key, got %d", enc, size, len(key))
+	}
+	switch enc {
+	case A128GCM, A192GCM, A256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, 0, err
+		}
+		return aead, aead.Overhead(), nil
+	}
+	aead, err = jcipher.NewCBCHMAC(key, aes.NewCipher)
+	return aead, size / 2, err
+}
+
+// WrapKey wraps a content encryption key with AES Key Wrap, RFC 3394.
+func WrapKey(kek []byte, cek []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return jcipher.KeyWrap(block, cek)
+}
+
+// UnwrapKey unwraps a content encryption key wrapped with AES Key Wrap.
+func UnwrapKey(kek []byte, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return jcipher.KeyUnwrap(block, wrapped)
+}
@@ -0,0 +1,129 @@
+package suite
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestSuiteValidate(t *testing.T) {
+	tests := []struct {
+		suite Suite
+		valid bool
+	}{
+		{Default, true},
+		{Suite{ECDHESA256KW, A128GCM}, true},
+		{Suite{ECDHES, A256CBCHS512}, true},
+		{Suite{ECDHESA128KW, A256GCM}, false},
+		{Suite{ECDHES, A128CBCHS256}, false},
+		{Suite{"dir", A256GCM}, false},
+		{Suite{}, false},
+	}
+	for _, test := range tests {
+		if err := test.suite.Validate(); (err == nil) != test.valid {
+			t.Errorf("%v: got %v", test.suite, err)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	gcm := Policy{Encryptions: []string{A256GCM}}
+	wrapped := Policy{Algorithms: []string{ECDHESA256KW}}
+	tests := []struct {
+		name   string
+		policy Policy
+		check  func(p Policy) error
+		err    error
+	}{
+		{"zero accepts alg", Policy{}, func(p Policy) error { return p.CheckAlg(ECDHESA128KW) }, nil},
+		{"zero accepts enc", Policy{}, func(p Policy) error { return p.CheckEnc(A128CBCHS256) }, nil},
+		{"zero accepts curve", Policy{}, func(p Policy) error { return p.CheckCurve("P-224") }, nil},
+		{"enc listed", gcm, func(p Policy) error { return p.CheckEnc(A256GCM) }, nil},
+		{"enc not listed", gcm, func(p Policy) error { return p.CheckEnc(A128GCM) }, ErrRejected},
+		{"alg listed", wrapped, func(p Policy) error { return p.CheckAlg(ECDHESA256KW) }, nil},
+		{"alg not listed", wrapped, func(p Policy) error { return p.CheckAlg(ECDHES) }, ErrRejected},
+		{"FIPS curve", FIPS, func(p Policy) error { return p.CheckCurve("P-384") }, nil},
+		{"FIPS other curve", FIPS, func(p Policy) error { return p.CheckCurve("P-224") }, ErrRejected},
+		{"FIPS CBC", FIPS, func(p Policy) error { return p.CheckEnc(A256CBCHS512) }, ErrRejected},
+	}
+	for _, test := range tests {
+		if err := test.check(test.policy); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	if !gcm.Accepts(Default) || gcm.Accepts(Suite{ECDHES, A128GCM}) || wrapped.Accepts(Default) {
+		t.Errorf("Accepts disagrees with the checks")
+	}
+	for _, policy := range []Policy{{Algorithms: []string{"dir"}}, {Encryptions: []string{"XC20P"}}} {
+		if policy.Validate() == nil {
+			t.Errorf("%v is valid", policy)
+		}
+	}
+	if err := FIPS.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Every enc we decrypt seals and opens with a key of its size, and refuses a
+// key of any other size.
+func TestNewContentCipher(t *testing.T) {
+	for _, enc := range DecryptEncryptions {
+		t.Run(enc, func(t *testing.T) {
+			size, err := KeySize(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			aead, tagSize, err := NewContentCipher(enc, make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce := make([]byte, aead.NonceSize())
+			sealed := aead.Seal(nil, nonce, []byte("plain text"), []byte("aad"))
+			if len(sealed) < tagSize+len("plain text") {
+				t.Errorf("sealed %d bytes, tag is %d", len(sealed), tagSize)
+			}
+			plain, err := aead.Open(nil, nonce, sealed, []byte("aad"))
+			if err != nil || string(plain) != "plain text" {
+				t.Errorf("got %q %v", plain, err)
+			}
+			if _, err := aead.Open(nil, nonce, sealed, []byte("other")); err == nil {
+				t.Errorf("opened with the wrong aad")
+			}
+			if _, _, err := NewContentCipher(enc, make([]byte, size+1)); err == nil {
+				t.Errorf("accepted a %d byte key", size+1)
+			}
+		})
+	}
+}
+
+// RFC 3394 section 4.1, 128 bits of key data with a 128 bit KEK.
+func TestWrapKey(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	kek := decode("000102030405060708090A0B0C0D0E0F")
+	cek := decode("00112233445566778899AABBCCDDEEFF")
+	want := decode("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+
+	wrapped, err := WrapKey(kek, cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wrapped, want) {
+		t.Errorf("got %X, want %X", wrapped, want)
+	}
+	unwrapped, err := UnwrapKey(kek, wrapped)
+	if err != nil || !bytes.Equal(unwrapped, cek) {
+		t.Errorf("got %X %v", unwrapped, err)
+	}
+	wrapped[0] ^= 1
+	if _, err := UnwrapKey(kek, wrapped); err == nil {
+		t.Errorf("unwrapped a tampered key")
+	}
+}
@@ -0,0 +1,260 @@
+package tang
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/goware/urlx"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+)
+
+const (
+	// Tang advertisements include every advertised key and a signature for each
+	// signing key, they are a few kilobytes.
+	DefaultMaxResponseSize = 1 << 20
+
+	advertisementType = "application/jose+json"
+	keyType           = "application/jwk+json"
+)
+
+// Client speaks the Tang protocol to one Tang server.
+type Client struct {
+	URL string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// MaxResponseSize defaults to DefaultMaxResponseSize.
+	MaxResponseSize int64
+}
+
+func encode64(buffer []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+func NewClient(url string) (client *Client, err error) {
+	defer err2.Return(&err)
+	url = try.To1(urlx.Normalize(try.To1(urlx.Parse(strings.TrimSuffix(url, "/")))))
+	return &Client{URL: url}, nil
+}
+
+func (c *Client) do(request *http.Request, contentType string) (body []byte, err error) {
+	defer err2.Return(&err)
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	limit := c.MaxResponseSize
+	if limit == 0 {
+		limit = DefaultMaxResponseSize
+	}
+
+	response := try.To1(client.Do(request))
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tang request %s %s failed: %s", request.Method, request.URL.Path, response.Status)
+	}
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || mediaType != contentType {
+		return nil, fmt.Errorf("tang response to %s %s has content type %q, expected %q", request.Method, request.URL.Path, response.Header.Get("Content-Type"), contentType)
+	}
+
+	body = try.To1(ioutil.ReadAll(io.LimitReader(response.Body, limit+1)))
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("tang response to %s %s exceeds %d bytes", request.Method, request.URL.Path, limit)
+	}
+	return body, nil
+}
+
+// Advertisement fetches the advertisement signed by the signing key with the
+// given thumbprint and verifies it.
+func (c *Client) Advertisement(ctx context.Context, thumbprint string) (advertisement *Advertisement, err error) {
+	defer err2.Return(&err)
+	if thumbprint == "" {
+		return nil, errMissingThumbprint
+	}
+	request := try.To1(http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/adv/"+thumbprint, nil))
+	return ParseAdvertisement(try.To1(c.do(request, advertisementType)), thumbprint)
+}
+
+// Recover sends the blinded public key to the Tang server for the exchange key
+// kid and returns the server's half of the McCallum-Relyea exchange.
+func (c *Client) Recover(ctx context.Context, kid string, key jwk.Key) (recovered jwk.Key, err error) {
+	defer err2.Return(&err)
+
+	var blinded ecdsa.PublicKey
+	err2.Check(key.Raw(&blinded))
+
+	body := try.To1(json.Marshal(key))
+	request := try.To1(http.NewRequestWithContext(ctx, http.MethodPost, c.URL+"/rec/"+kid, bytes.NewReader(body)))
+	request.Header.Set("Content-Type", keyType)
+
+	recovered = try.To1(jwk.ParseKey(try.To1(c.do(request, keyType))))
+	if err := validate(recovered); err != nil {
+		return nil, fmt.Errorf("invalid tang recovery response: %w", err)
+	}
+	var result ecdsa.PublicKey
+	err2.Check(recovered.Raw(&result))
+	if result.Curve != blinded.Curve {
+		return nil, fmt.Errorf("tang recovery response is on curve %s, expected %s", result.Curve.Params().Name, blinded.Curve.Params().Name)
+	}
+	return recovered, nil
+}
+
+// Advertisement is a verified Tang advertisement.
+type Advertisement struct {
+	// JWS is the advertisement as served.
+	JWS []byte
+	// Payload is the JWK set that was signed, which clevis copies into the
+	// `adv` member of its protected header.
+	Payload []byte
+	Keys    jwk.Set
+}
+
+// Tang keys are always EC keys on one of the NIST curves.
+func validate(key jwk.Key) error {
+	if key.KeyType() != jwa.EC {
+		return fmt.Errorf("key type %s is not EC", key.KeyType())
+	}
+	var raw ecdsa.PublicKey
+	if err := key.Raw(&raw); err != nil {
+		var private ecdsa.PrivateKey
+		if key.Raw(&private) != nil {
+			return err
+		}
+		raw = private.PublicKey
+	}
+	switch raw.Curve {
+	case elliptic.P256(), elliptic.P384(), elliptic.P521():
+	default:
+		return fmt.Errorf("curve %s is not supported", raw.Curve.Params().Name)
+	}
+	if !raw.Curve.IsOnCurve(raw.X, raw.Y) {
+		return fmt.Errorf("point is not on curve %s", raw.Curve.Params().Name)
+	}
+	return nil
+}
+
+var errMissingThumbprint = errors.New("thumbprint of a trusted signing key is required")
+
+// ParseAdvertisement parses and verifies an advertisement. Every signing key
+// must have signed it and one of them must have the thumbprint.
+func ParseAdvertisement(advertisement []byte, thumbprint string) (parsed *Advertisement, err error) {
+	defer err2.Return(&err)
+	if thumbprint == "" {
+		return nil, errMissingThumbprint
+	}
+
+	message := try.To1(jws.Parse(advertisement))
+	keySet := try.To1(jwk.Parse(message.Payload()))
+	parsed = &Advertisement{JWS: advertisement, Payload: message.Payload(), Keys: keySet}
+
+	for _, key := range parsed.keys() {
+		if err := validate(key); err != nil {
+			return nil, fmt.Errorf("invalid advertised key: %w", err)
+		}
+	}
+
+	verifiers := parsed.VerifyKeys()
+	if len(verifiers) == 0 {
+		return nil, fmt.Errorf("advertisement is missing signatures")
+	}
+	trusted := false
+	for _, verifier := range verifiers {
+		try.To1(jws.Verify(advertisement, jwa.SignatureAlgorithm(verifier.Algorithm()), verifier))
+		if try.To1(Thumbprint(verifier)) == thumbprint {
+			trusted = true
+		}
+	}
+	if !trusted {
+		return nil, fmt.Errorf("unable to find key matching %v", thumbprint)
+	}
+	if len(parsed.ExchangeKeys()) == 0 {
+		return nil, fmt.Errorf("advertisement has no exchange keys")
+	}
+
+	return parsed, nil
+}
+
+func (a *Advertisement) keys() []jwk.Key {
+	var keys []jwk.Key
+	ctx := context.Background()
+	for iterator := a.Keys.Iterate(ctx); iterator.Next(ctx); {
+		keys = append(keys, iterator.Pair().Value.(jwk.Key))
+	}
+	return keys
+}
+
+func (a *Advertisement) filter(sought jwk.KeyOperation) []jwk.Key {
+	var keys []jwk.Key
+	for _, key := range a.keys() {
+		for _, op := range key.KeyOps() {
+			if op == sought {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+func (a *Advertisement) VerifyKeys() []jwk.Key {
+	return a.filter(jwk.KeyOpVerify)
+}
+
+func (a *Advertisement) ExchangeKeys() []jwk.Key {
+	return a.filter(jwk.KeyOpDeriveKey)
+}
+
+// ExchangeKey returns a copy of the first exchange key with its `alg` and
+// `key_ops` removed, ready to be used as an ECDH-ES recipient key.
+func (a *Advertisement) ExchangeKey() (exchange jwk.Key, err error) {
+	defer err2.Return(&err)
+	keys := a.ExchangeKeys()
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("advertisement has no exchange keys")
+	}
+	exchange = try.To1(keys[0].Clone())
+	err2.Check(exchange.Set(jwk.KeyOpsKey, jwk.KeyOperationList{}))
+	err2.Check(exchange.Set(jwk.AlgorithmKey, ""))
+	return exchange, nil
+}
+
+// Find returns the advertised key with the given thumbprint or nil.
+func (a *Advertisement) Find(thumbprint string) (jwk.Key, error) {
+	for _, key := range a.keys() {
+		found, err := Thumbprint(key)
+		if err != nil {
+			return nil, err
+		}
+		if found == thumbprint {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// Thumbprint is the base64url SHA-256 JWK thumbprint Tang uses to name keys.
+func Thumbprint(key jwk.Key) (string, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return encode64(thumbprint), nil
+}
@@ -0,0 +1,163 @@
+package tang_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+	"github.com/flatheadmill/tang-encryption-provider/tangtest"
+)
+
+func newKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+// Every response is checked before it is used, a server that answers with the
+// wrong content type, too much, keys that are not Tang keys or an
+// advertisement the thumbprint did not sign is refused.
+func TestClient(t *testing.T) {
+	server, err := tangtest.New(elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertisement, err := server.Advertisement(server.Thumbprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := tang.ParseAdvertisement(advertisement, server.Thumbprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, err := tang.Thumbprint(parsed.ExchangeKeys()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	offCurve := func(curve elliptic.Curve) []byte {
+		public := newKey(t, curve).PublicKey
+		size := (curve.Params().BitSize + 7) / 8
+		y := new(big.Int).Add(public.Y, big.NewInt(1))
+		body, _ := json.Marshal(map[string]string{
+			"kty": "EC",
+			"crv": curve.Params().Name,
+			"x":   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size))),
+			"y":   base64.RawURLEncoding.EncodeToString(y.FillBytes(make([]byte, size))),
+		})
+		return body
+	}
+	respond := func(contentType string, body []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write(body)
+		}
+	}
+	other, err := jwk.New(&newKey(t, elliptic.P384()).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBody, err := json.Marshal(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blinded, err := jwk.New(&newKey(t, elliptic.P256()).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		recover    bool
+		thumbprint string
+		limit      int64
+		err        string
+	}{{
+		name:       "advertisement",
+		handler:    server,
+		thumbprint: server.Thumbprint(),
+	}, {
+		name:    "recovery",
+		handler: server,
+		recover: true,
+	}, {
+		name:       "missing thumbprint",
+		handler:    server,
+		thumbprint: "",
+		err:        "thumbprint of a trusted signing key is required",
+	}, {
+		name:       "not found",
+		handler:    server,
+		thumbprint: base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+		err:        "404 Not Found",
+	}, {
+		name:       "wrong content type",
+		handler:    respond("text/html", advertisement),
+		thumbprint: server.Thumbprint(),
+		err:        `has content type "text/html", expected "application/jose+json"`,
+	}, {
+		name:       "oversized body",
+		handler:    server,
+		thumbprint: server.Thumbprint(),
+		limit:      64,
+		err:        "exceeds 64 bytes",
+	}, {
+		name:       "thumbprint mismatch",
+		handler:    respond("application/jose+json", advertisement),
+		thumbprint: base64.RawURLEncoding.EncodeToString(make([]byte, 32)),
+		err:        "unable to find key matching",
+	}, {
+		name:    "recovery on another curve",
+		handler: respond("application/jwk+json", otherBody),
+		recover: true,
+		err:     "is on curve P-384, expected P-256",
+	}, {
+		name:    "recovery off the curve",
+		handler: respond("application/jwk+json", offCurve(elliptic.P256())),
+		recover: true,
+		err:     "point is not on curve P-256",
+	}, {
+		name:    "recovery content type",
+		handler: respond("application/json", otherBody),
+		recover: true,
+		err:     `expected "application/jwk+json"`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := httptest.NewServer(test.handler)
+			defer started.Close()
+			client, err := tang.NewClient(started.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.MaxResponseSize = test.limit
+			if test.recover {
+				_, err = client.Recover(context.Background(), kid, blinded)
+			} else {
+				_, err = client.Advertisement(context.Background(), test.thumbprint)
+			}
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
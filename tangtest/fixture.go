@@ -0,0 +1,34 @@
+package tangtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/flatheadmill/tang-encryption-provider/suite"
+)
+
+// URL is the Tang URL the tests encrypt to and the golden vectors carry. It
+// does not resolve, the clients of NewClient send every request to the
+// Server.
+const URL = "http://tang.test"
+
+// Plain returns a random plain text of size bytes to encrypt. It is hex, jwx
+// fails to decrypt its own CBC when the plain text ends in what looks like a
+// block of padding, which hex never does.
+func Plain(size int) []byte {
+	random := make([]byte, (size+1)/2)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return []byte(hex.EncodeToString(random)[:size])
+}
+
+// Suites returns every alg and enc the backends encrypt with.
+func Suites() (suites []suite.Suite) {
+	for _, alg := range suite.EncryptAlgorithms {
+		for _, enc := range suite.EncryptEncryptions {
+			suites = append(suites, suite.Suite{Alg: alg, Enc: enc})
+		}
+	}
+	return suites
+}
@@ -0,0 +1,328 @@
+package tangtest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+
+	"github.com/flatheadmill/tang-encryption-provider/handler"
+	"github.com/flatheadmill/tang-encryption-provider/mcr"
+	"github.com/flatheadmill/tang-encryption-provider/tang"
+)
+
+// Server is an in-memory stand-in for a Tang server. It serves the same
+// `/adv` and `/rec` protocol from a key database in the format of
+// `/var/db/tang`, private JWKs one per file, where files beginning with a dot
+// are rotated keys that are no longer advertised but still recover.
+type Server struct {
+	mutex          sync.RWMutex
+	keys           []*key
+	advertisements int64
+	recoveries     int64
+}
+
+type key struct {
+	private    jwk.Key
+	thumbprint string
+	hidden     bool
+}
+
+func encode64(buffer []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+func newKey(private jwk.Key, hidden bool) (k *key, err error) {
+	defer err2.Return(&err)
+	return &key{
+		private:    private,
+		thumbprint: encode64(try.To1(private.Thumbprint(crypto.SHA256))),
+		hidden:     hidden,
+	}, nil
+}
+
+func generate(curve elliptic.Curve, alg string, ops ...jwk.KeyOperation) (k *key, err error) {
+	defer err2.Return(&err)
+	private := try.To1(jwk.New(try.To1(ecdsa.GenerateKey(curve, rand.Reader))))
+	err2.Check(private.Set(jwk.AlgorithmKey, alg))
+	err2.Check(private.Set(jwk.KeyOpsKey, jwk.KeyOperationList(ops)))
+	return newKey(private, false)
+}
+
+// New creates a server with a P-521 signing key, as Tang does, and an
+// exchange key on the given curve.
+func New(curve elliptic.Curve) (server *Server, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+	server = &Server{}
+	err2.Check(server.generate(curve))
+	return server, nil
+}
+
+func (s *Server) generate(curve elliptic.Curve) (err error) {
+	defer err2.Return(&err)
+	signing := try.To1(generate(elliptic.P521(), "ES512", jwk.KeyOpSign, jwk.KeyOpVerify))
+	exchange := try.To1(generate(curve, "ECMR", jwk.KeyOpDeriveKey))
+	s.keys = append(s.keys, signing, exchange)
+	return nil
+}
+
+// Rotate hides the current keys and generates new ones, like `tangd-rotate-keys`.
+func (s *Server) Rotate(curve elliptic.Curve) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range s.keys {
+		key.hidden = true
+	}
+	return s.generate(curve)
+}
+
+// Load reads a Tang key database directory.
+func Load(dir string) (server *Server, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+	server = &Server{}
+	paths := try.To1(filepath.Glob(filepath.Join(dir, "*.jwk")))
+	paths = append(paths, try.To1(filepath.Glob(filepath.Join(dir, ".*.jwk")))...)
+	for _, path := range paths {
+		private := try.To1(jwk.ParseKey(try.To1(ioutil.ReadFile(path))))
+		hidden := strings.HasPrefix(filepath.Base(path), ".")
+		server.keys = append(server.keys, try.To1(newKey(private, hidden)))
+	}
+	if len(server.keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", dir)
+	}
+	return server, nil
+}
+
+// Save writes the key database to a directory that can be read by Load or
+// served by `tangd`.
+func (s *Server) Save(dir string) (err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	err2.Check(os.MkdirAll(dir, 0700))
+	for _, key := range s.keys {
+		name := key.thumbprint + ".jwk"
+		if key.hidden {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			name = "." + name
+		}
+		err2.Check(ioutil.WriteFile(filepath.Join(dir, name), try.To1(json.Marshal(key.private)), 0600))
+	}
+	return nil
+}
+
+func hasOp(k jwk.Key, sought jwk.KeyOperation) bool {
+	for _, op := range k.KeyOps() {
+		if op == sought {
+			return true
+		}
+	}
+	return false
+}
+
+// Thumbprint returns the thumbprint of the first advertised signing key, the
+// value for `TANG_KMS_THUMBPRINT`.
+func (s *Server) Thumbprint() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, key := range s.keys {
+		if !key.hidden && hasOp(key.private, jwk.KeyOpSign) {
+			return key.thumbprint
+		}
+	}
+	return ""
+}
+
+// Counts returns the number of advertisements and recoveries served.
+func (s *Server) Counts() (advertisements int64, recoveries int64) {
+	return atomic.LoadInt64(&s.advertisements), atomic.LoadInt64(&s.recoveries)
+}
+
+func (s *Server) find(thumbprint string) *key {
+	for _, key := range s.keys {
+		if key.thumbprint == thumbprint {
+			return key
+		}
+	}
+	return nil
+}
+
+func public(k jwk.Key, ops ...jwk.KeyOperation) (pub jwk.Key, err error) {
+	defer err2.Return(&err)
+	pub = try.To1(jwk.PublicKeyOf(k))
+	err2.Check(pub.Set(jwk.KeyOpsKey, jwk.KeyOperationList(ops)))
+	return pub, nil
+}
+
+// Advertisement returns the JWS Tang would serve from `/adv/{thumbprint}`, or
+// `/adv` when thumbprint is empty.
+func (s *Server) Advertisement(thumbprint string) (advertisement []byte, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var signers []jwk.Key
+	keySet := jwk.NewSet()
+	for _, key := range s.keys {
+		if hasOp(key.private, jwk.KeyOpSign) && (!key.hidden || key.thumbprint == thumbprint) {
+			signers = append(signers, key.private)
+		}
+		if key.hidden {
+			continue
+		}
+		switch {
+		case hasOp(key.private, jwk.KeyOpSign):
+			keySet.Add(try.To1(public(key.private, jwk.KeyOpVerify)))
+		case hasOp(key.private, jwk.KeyOpDeriveKey):
+			keySet.Add(try.To1(public(key.private, jwk.KeyOpDeriveKey)))
+		}
+	}
+	if thumbprint != "" && s.find(thumbprint) == nil {
+		return nil, fmt.Errorf("unknown signing key %s", thumbprint)
+	}
+
+	payload := try.To1(json.Marshal(keySet))
+	var options []jws.Option
+	for _, signer := range signers {
+		protected := jws.NewHeaders()
+		err2.Check(protected.Set(jws.AlgorithmKey, jwa.SignatureAlgorithm(signer.Algorithm())))
+		err2.Check(protected.Set(jws.ContentTypeKey, "jwk-set+json"))
+		options = append(options, jws.WithSigner(try.To1(jws.NewSigner(jwa.SignatureAlgorithm(signer.Algorithm()))), signer, nil, protected))
+	}
+	return jws.SignMulti(payload, options...)
+}
+
+// Recover performs the server side of the McCallum-Relyea exchange.
+func (s *Server) Recover(thumbprint string, request []byte) (response []byte, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	exchange := s.find(thumbprint)
+	if exchange == nil || !hasOp(exchange.private, jwk.KeyOpDeriveKey) {
+		return nil, fmt.Errorf("unknown exchange key %s", thumbprint)
+	}
+	var private ecdsa.PrivateKey
+	err2.Check(exchange.private.Raw(&private))
+
+	var blinded ecdsa.PublicKey
+	err2.Check(jwk.ParseRawKey(request, &blinded))
+
+	result := try.To1(jwk.New(try.To1(mcr.Exchange(&private, &blinded))))
+	err2.Check(result.Set(jwk.AlgorithmKey, "ECMR"))
+	return json.Marshal(result)
+}
+
+// Decrypt decrypts a clevis JWE directly with the private exchange key named
+// by its kid, without the McCallum-Relyea exchange, as an oracle for client
+// implementations.
+func (s *Server) Decrypt(cipher []byte) (plain []byte, err error) {
+	defer err2.Handle(&err, handler.Handler(&err))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	message := try.To1(jwe.Parse(cipher))
+	exchange := s.find(message.ProtectedHeaders().KeyID())
+	if exchange == nil {
+		return nil, fmt.Errorf("unknown exchange key %s", message.ProtectedHeaders().KeyID())
+	}
+	var private ecdsa.PrivateKey
+	err2.Check(exchange.private.Raw(&private))
+	return jwe.Decrypt(cipher, message.ProtectedHeaders().Algorithm(), &private)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && path[0] == "adv" && len(path) <= 2:
+		thumbprint := ""
+		if len(path) == 2 {
+			thumbprint = path[1]
+		}
+		advertisement, err := s.Advertisement(thumbprint)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		atomic.AddInt64(&s.advertisements, 1)
+		w.Header().Set("Content-Type", "application/jose+json")
+		w.Write(advertisement)
+	case r.Method == http.MethodPost && path[0] == "rec" && len(path) == 2:
+		request, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := s.Recover(path[1], request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt64(&s.recoveries, 1)
+		w.Header().Set("Content-Type", "application/jwk+json")
+		w.Write(response)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type transport struct {
+	handler http.Handler
+}
+
+func (t transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if err := request.Context().Err(); err != nil {
+		return nil, err
+	}
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, request)
+	response := recorder.Result()
+	response.Request = request
+	return response, nil
+}
+
+// Transport returns a round tripper that answers every request with this
+// server whatever the host, so ciphertexts that name a Tang server that does
+// not exist can be decrypted. Give it to the HTTP client of the Tang clients,
+// or install it as `http.DefaultTransport` for code that uses the default
+// client.
+func (s *Server) Transport() http.RoundTripper {
+	return transport{handler: s}
+}
+
+// NewClient creates a Tang client that is answered by this server whatever
+// the URL, to give to the crypters and clevis.Decrypter in place of
+// tang.NewClient.
+func (s *Server) NewClient(url string) (*tang.Client, error) {
+	client, err := tang.NewClient(url)
+	if err != nil {
+		return nil, err
+	}
+	client.HTTPClient = &http.Client{Transport: s.Transport()}
+	return client, nil
+}
+
+// Start serves on a loopback port, the URL is in the returned server.
+func (s *Server) Start() *httptest.Server {
+	return httptest.NewServer(s)
+}
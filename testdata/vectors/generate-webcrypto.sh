@@ -0,0 +1,49 @@
+#!/bin/bash
+
+# Adds golden vectors from node/webcrypto.js, which needs nothing but Node.js
+# 18 or later, three of each kind named on the command line, webcrypto,
+# webcrypto-sss and webcrypto-apu by default. Serves the key database in db with `cmd/vectors -serve` and
+# encrypts with the URL the Go vectors use.
+
+set -e
+
+dir=$(cd "$(dirname "$0")" && pwd)
+port=${PORT:-8080}
+url=http://tang.test
+
+(cd "$dir/../.." && go build -o "$dir/.vectors" ./cmd/vectors)
+"$dir/.vectors" -dir "$dir" -serve 127.0.0.1:$port &
+tangd=$!
+trap "kill $tangd; rm -f $dir/.vectors" EXIT
+sleep 1
+
+thp="$(curl -sf http://127.0.0.1:$port/adv | python3 -c '
+import base64, hashlib, json, sys
+payload = json.load(sys.stdin)["payload"]
+keys = json.loads(base64.urlsafe_b64decode(payload + "=" * (-len(payload) % 4)))["keys"]
+key = next(key for key in keys if "verify" in key["key_ops"])
+required = json.dumps({name: key[name] for name in ("crv", "kty", "x", "y")}, separators=(",", ":"))
+print(base64.urlsafe_b64encode(hashlib.sha256(required.encode()).digest()).decode().rstrip("="))
+')"
+
+# Three more vectors of a kind, named $1, with the environment that follows.
+generate() {
+    kind=$1
+    shift
+    count=$(ls "$dir"/$kind-[0-9]*.jwe 2>/dev/null | wc -l)
+    for i in $(seq $count $((count + 2))); do
+        name=$(printf $kind-%03d $i)
+        head -c $((32 + i)) /dev/urandom | base64 > "$dir/$name.txt"
+        env TANG_URL=http://127.0.0.1:$port TANG_THP="$thp" TANG_CLEVIS_URL=$url "$@" \
+            node "$dir/../../node/webcrypto.js" < "$dir/$name.txt" > "$dir/$name.jwe"
+    done
+}
+
+for kind in ${@:-webcrypto webcrypto-sss webcrypto-apu}; do
+    case $kind in
+    webcrypto) generate webcrypto ;;
+    webcrypto-sss) generate webcrypto-sss SSS_T=2 SSS_N=3 ;;
+    webcrypto-apu) generate webcrypto-apu TANG_APU=tang-encryption-provider TANG_APV=tang ;;
+    *) echo "unknown kind $kind" >&2; exit 1 ;;
+    esac
+done
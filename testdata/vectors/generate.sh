@@ -0,0 +1,41 @@
+#!/bin/bash
+
+# Adds golden vectors from `clevis encrypt tang`, `clevis encrypt sss` and
+# node/encrypt.js. Needs clevis, tangd, socat and a `npm install` in node/.
+# Serves the key database in db with a real tangd on port 8080 and encrypts
+# with the URL the Go vectors use, so all vectors recover through the same
+# stand-in.
+
+set -e
+
+dir=$(cd "$(dirname "$0")" && pwd)
+port=8080
+url=http://tang.test
+
+socat TCP-LISTEN:$port,reuseaddr,fork EXEC:"/usr/libexec/tangd $dir/db" &
+tangd=$!
+trap "kill $tangd" EXIT
+sleep 1
+
+adv="$(curl -sf http://localhost:$port/adv)"
+thp="$(jose fmt -j- -Og payload -SyOg keys -AUo- <<< "$adv" | jose jwk use -i- -r -u verify -o- | jose jwk thp -i-)"
+
+tang="{\"url\":\"$url\",\"adv\":$adv}"
+
+count=$(ls "$dir"/clevis-[0-9]*.jwe 2>/dev/null | wc -l)
+for i in $(seq $count $((count + 2))); do
+    name=$(printf clevis-%03d $i)
+    head -c $((32 + i)) /dev/urandom | base64 > "$dir/$name.txt"
+    clevis encrypt tang "$tang" < "$dir/$name.txt" > "$dir/$name.jwe"
+    echo >> "$dir/$name.jwe"
+
+    name=$(printf clevis-sss-%03d $i)
+    head -c $((32 + i)) /dev/urandom | base64 > "$dir/$name.txt"
+    clevis encrypt sss "{\"t\":2,\"pins\":{\"tang\":[$tang,$tang,$tang]}}" < "$dir/$name.txt" > "$dir/$name.jwe"
+    echo >> "$dir/$name.jwe"
+
+    name=$(printf node-%03d $i)
+    head -c $((32 + i)) /dev/urandom | base64 > "$dir/$name.txt"
+    TANG_URL=http://localhost:$port TANG_THP="$thp" TANG_CLEVIS_URL=$url \
+        node "$dir/../../node/encrypt.js" < "$dir/$name.txt" > "$dir/$name.jwe"
+done